@@ -4,16 +4,79 @@ import (
 	"fmt"
 	"io/ioutil"
 
+	"gomail/queue"
+
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	groupByRecipient = "recipient"
+	groupByTenant    = "tenant"
+	groupByField     = "field"
+
+	defaultTenantHeader = "X-Gomail-Tenant"
+
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+// FifoConfig sets how emails sent to FIFO queues are grouped. Emails of the same message
+// group are sent in the order they were accepted.
+type FifoConfig struct {
+	// recipient (the default), tenant or field
+	GroupBy string `yaml:"group_by"`
+	// header carrying the tenant when grouping by tenant
+	TenantHeader string `yaml:"tenant_header"`
+}
+
+// PriorityQueueUrls sets the queues of the priorities other than normal, whose emails
+// go to queue_urls. A priority without queues of its own uses queue_urls as well.
+type PriorityQueueUrls struct {
+	High []string `yaml:"high"`
+	Low  []string `yaml:"low"`
+}
+
 type Config struct {
-	Port                    int      `yaml:"port"`
-	MaxBodySizeBytes        int64    `yaml:"max_body_size_bytes"`
-	AwsRegion               string   `yaml:"aws_region"`
-	AwsClientTimeoutSeconds int64    `yaml:"aws_client_timeout_seconds"`
-	AccessLogFilePath       string   `yaml:"access_log_file_path"`
-	QueueUrls               []string `yaml:"queue_urls"`
+	Port                    int               `yaml:"port"`
+	MaxBodySizeBytes        int64             `yaml:"max_body_size_bytes"`
+	AwsRegion               string            `yaml:"aws_region"`
+	AwsClientTimeoutSeconds int64             `yaml:"aws_client_timeout_seconds"`
+	AccessLogFilePath       string            `yaml:"access_log_file_path"`
+	QueueBackend            queue.Config      `yaml:"queue_backend"`
+	QueueUrls               []string          `yaml:"queue_urls"`
+	PriorityQueueUrls       PriorityQueueUrls `yaml:"priority_queue_urls"`
+	Fifo                    FifoConfig        `yaml:"fifo"`
+}
+
+func (c *Config) setDefaults() {
+	c.QueueBackend.SetDefaults()
+	if c.Fifo.GroupBy == "" {
+		c.Fifo.GroupBy = groupByRecipient
+	}
+	if c.Fifo.TenantHeader == "" {
+		c.Fifo.TenantHeader = defaultTenantHeader
+	}
+}
+
+// IsFIFO reports whether emails are queued in FIFO queues.
+func (c Config) IsFIFO() bool {
+	return len(c.QueueUrls) > 0 && queue.IsFIFO(c.QueueUrls[0])
+}
+
+// QueueUrlsFor returns the queues the emails of a priority are sent to.
+func (c Config) QueueUrlsFor(priority string) []string {
+	queueUrls := c.QueueUrls
+	switch priority {
+	case priorityHigh:
+		queueUrls = c.PriorityQueueUrls.High
+	case priorityLow:
+		queueUrls = c.PriorityQueueUrls.Low
+	}
+	if len(queueUrls) == 0 {
+		return c.QueueUrls
+	}
+	return queueUrls
 }
 
 func (c Config) validate() error {
@@ -23,7 +86,10 @@ func (c Config) validate() error {
 	if c.MaxBodySizeBytes < 0 {
 		return fmt.Errorf("max_body_size_bytes is invalid")
 	}
-	if c.AwsRegion == "" {
+	if err := c.QueueBackend.Validate(); err != nil {
+		return err
+	}
+	if c.AwsRegion == "" && c.QueueBackend.Type == queue.BackendSQS {
 		return fmt.Errorf("aws_region is missing")
 	}
 	if c.AccessLogFilePath == "" {
@@ -32,6 +98,19 @@ func (c Config) validate() error {
 	if len(c.QueueUrls) == 0 {
 		return fmt.Errorf("queue_urls must contain at least one value")
 	}
+	// the emails of a group must always end up in the same kind of queue
+	for _, queueUrls := range [][]string{c.QueueUrls, c.PriorityQueueUrls.High, c.PriorityQueueUrls.Low} {
+		for _, queueUrl := range queueUrls {
+			if queue.IsFIFO(queueUrl) != c.IsFIFO() {
+				return fmt.Errorf("queue_urls and priority_queue_urls must either all be FIFO queues or none")
+			}
+		}
+	}
+	switch c.Fifo.GroupBy {
+	case groupByRecipient, groupByTenant, groupByField:
+	default:
+		return fmt.Errorf("fifo.group_by must be one of recipient, tenant or field")
+	}
 
 	return nil
 }
@@ -46,6 +125,7 @@ func NewConfig(filePath string) (*Config, error) {
 	if err = yaml.Unmarshal(contents, &config); err != nil {
 		return nil, err
 	}
+	config.setDefaults()
 	if err = config.validate(); err != nil {
 		return nil, err
 	}
@@ -27,6 +27,21 @@ func (s *ConfigSuite) TestConfig() {
 			FilePath:      "fixtures/config_valid.yaml",
 			ExpectedError: nil,
 		},
+		{
+			Case:          "Valid config with memory queue backend and no aws_region",
+			FilePath:      "fixtures/config_memory_queue_backend.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Valid config with priority_queue_urls",
+			FilePath:      "fixtures/config_priority_queue_urls.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Valid config with FIFO queues",
+			FilePath:      "fixtures/config_fifo.yaml",
+			ExpectedError: nil,
+		},
 		{
 			Case:          "Missing config file",
 			FilePath:      "fixtures/missing_config.yaml",
@@ -57,6 +72,26 @@ func (s *ConfigSuite) TestConfig() {
 			FilePath:      "fixtures/config_missing_aws_region.yaml",
 			ExpectedError: fmt.Errorf("aws_region is missing"),
 		},
+		{
+			Case:          "Missing queue_backend.directory",
+			FilePath:      "fixtures/config_disk_queue_backend_missing_directory.yaml",
+			ExpectedError: fmt.Errorf("queue_backend.directory is missing"),
+		},
+		{
+			Case:          "FIFO and standard queue_urls",
+			FilePath:      "fixtures/config_mixed_fifo_queue_urls.yaml",
+			ExpectedError: fmt.Errorf("queue_urls and priority_queue_urls must either all be FIFO queues or none"),
+		},
+		{
+			Case:          "FIFO queue_urls and standard priority_queue_urls",
+			FilePath:      "fixtures/config_mixed_fifo_priority_queue_urls.yaml",
+			ExpectedError: fmt.Errorf("queue_urls and priority_queue_urls must either all be FIFO queues or none"),
+		},
+		{
+			Case:          "Invalid fifo.group_by",
+			FilePath:      "fixtures/config_invalid_fifo_group_by.yaml",
+			ExpectedError: fmt.Errorf("fifo.group_by must be one of recipient, tenant or field"),
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gomail/queue"
+)
+
+const (
+	// read by the pipeline, in unix milliseconds
+	enqueuedAtAttribute = "gomail-enqueued-at"
+	expiresAtAttribute  = "gomail-expires-at"
+
+	// the longest SQS keeps a message (14 days), an email cannot outlive its message
+	maxTtlSeconds = 14 * 24 * 60 * 60
+)
+
+// requestExpiry returns when the email of a request expires, if the request sets expiresAt
+// or ttlSeconds.
+func requestExpiry(request SendEmailRequest, now time.Time) (*time.Time, *ResponseError) {
+	if request.ExpiresAt != nil && request.TtlSeconds != nil {
+		return nil, NewBaseResponseError("Only one of expiresAt and ttlSeconds can be set")
+	}
+	if request.ExpiresAt != nil {
+		if !request.ExpiresAt.After(now) {
+			return nil, NewResponseError(map[string]string{"expiresAt": "Expires at must be in the future"})
+		}
+		return request.ExpiresAt, nil
+	}
+	if request.TtlSeconds != nil {
+		if *request.TtlSeconds <= 0 {
+			return nil, NewResponseError(map[string]string{"ttlSeconds": "TTL seconds must be greater than 0"})
+		}
+		if *request.TtlSeconds > maxTtlSeconds {
+			return nil, NewResponseError(map[string]string{"ttlSeconds": fmt.Sprintf("TTL seconds must not be greater than %d", maxTtlSeconds)})
+		}
+		expiresAt := now.Add(time.Duration(*request.TtlSeconds) * time.Second)
+		return &expiresAt, nil
+	}
+	return nil, nil
+}
+
+func timeAttribute(t time.Time) queue.Attribute {
+	return queue.NumberAttribute(int(t.UnixNano() / int64(time.Millisecond)))
+}
+
+// expiryAttributes stamps the time an email was enqueued, and when it expires if it does.
+func expiryAttributes(now time.Time, expiresAt *time.Time) map[string]queue.Attribute {
+	attributes := map[string]queue.Attribute{enqueuedAtAttribute: timeAttribute(now)}
+	if expiresAt != nil {
+		attributes[expiresAtAttribute] = timeAttribute(*expiresAt)
+	}
+	return attributes
+}
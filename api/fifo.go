@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+)
+
+var (
+	// SQS accepts group and deduplication ids of up to 128 alphanumeric or punctuation
+	// characters
+	fifoIdRegexp = regexp.MustCompile(`^[!-~]{1,128}$`)
+)
+
+// messageGroupId returns the message group of an email, as configured by fifo.group_by.
+func messageGroupId(r *http.Request, request SendEmailRequest) (string, *ResponseError) {
+	switch config.Fifo.GroupBy {
+	case groupByTenant:
+		header := config.Fifo.TenantHeader
+		tenant := r.Header.Get(header)
+		if tenant == "" {
+			return "", NewBaseResponseError(header + " header is required")
+		}
+		if !fifoIdRegexp.MatchString(tenant) {
+			return "", NewBaseResponseError(header + " header is invalid")
+		}
+		return tenant, nil
+	case groupByField:
+		if request.MessageGroupId == "" {
+			return "", NewResponseError(map[string]string{"messageGroupId": "Message group id is required"})
+		}
+		if !fifoIdRegexp.MatchString(request.MessageGroupId) {
+			return "", NewResponseError(map[string]string{"messageGroupId": "Message group id is invalid"})
+		}
+		return request.MessageGroupId, nil
+	}
+
+	// very long addresses do not fit into a group id
+	recipient := request.Email.ToEmail
+	if !fifoIdRegexp.MatchString(recipient) {
+		return hashId(recipient), nil
+	}
+	return recipient, nil
+}
+
+// deduplicationId returns the id of an email SQS drops copies of for 5 minutes: the one
+// the client sent, or else a hash of the request, so that resubmitting the same request
+// does not send the email twice.
+func deduplicationId(request SendEmailRequest, body []byte) (string, *ResponseError) {
+	if request.DeduplicationId == "" {
+		return hashId(string(body)), nil
+	}
+	if !fifoIdRegexp.MatchString(request.DeduplicationId) {
+		return "", NewResponseError(map[string]string{"deduplicationId": "Deduplication id is invalid"})
+	}
+	return request.DeduplicationId, nil
+}
+
+func hashId(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// groupQueueUrl returns the queue of queueUrls the emails of a message group are sent to.
+// It is always the same one, since ordering only holds within a queue.
+func groupQueueUrl(queueUrls []string, groupId string) string {
+	h := fnv.New32a()
+	h.Write([]byte(groupId))
+	return queueUrls[h.Sum32()%uint32(len(queueUrls))]
+}
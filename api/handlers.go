@@ -8,9 +8,11 @@ import (
 	"math/rand"
 	"net/http"
 	"regexp"
+	"time"
+
+	"gomail/queue"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 const (
@@ -35,6 +37,14 @@ func NewBaseResponseError(errorMsg string) *ResponseError {
 
 type SendEmailRequest struct {
 	Email Email `json:"email"`
+	// high, normal (the default) or low
+	Priority string `json:"priority"`
+	// the email is not sent after this time, set at most one of them
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	TtlSeconds *int64     `json:"ttlSeconds"`
+	// only used with FIFO queues
+	MessageGroupId  string `json:"messageGroupId"`
+	DeduplicationId string `json:"deduplicationId"`
 }
 
 type Email struct {
@@ -44,6 +54,12 @@ type Email struct {
 	ToName    string `json:"toName"`
 	Subject   string `json:"subject"`
 	Body      string `json:"body"`
+	ReplyTo   string `json:"replyTo"`
+	// further headers, e.g. List-Unsubscribe, except for the ones in protectedHeaders
+	Headers map[string]string `json:"headers"`
+	// passed to the providers for their analytics, as SES message tags, SendGrid
+	// categories and custom args, or Mailgun tags and variables
+	Tags map[string]string `json:"tags"`
 }
 
 type SendEmailResponse struct {
@@ -62,6 +78,26 @@ func (e Email) Validate() (bool, *ResponseError) {
 	if e.Body == "" {
 		errors["body"] = "Body is required"
 	}
+	if e.ReplyTo != "" {
+		if valid, errorMsg := validateEmail("Reply to", e.ReplyTo); !valid {
+			errors["replyTo"] = errorMsg
+		}
+	}
+	if containsLineBreak(e.FromName) {
+		errors["fromName"] = "From name must not contain line breaks"
+	}
+	if containsLineBreak(e.ToName) {
+		errors["toName"] = "To name must not contain line breaks"
+	}
+	if containsLineBreak(e.Subject) {
+		errors["subject"] = "Subject must not contain line breaks"
+	}
+	if valid, errorMsg := validateHeaders(e.Headers); !valid {
+		errors["headers"] = errorMsg
+	}
+	if valid, errorMsg := validateTags(e.Tags); !valid {
+		errors["tags"] = errorMsg
+	}
 
 	if len(errors) > 0 {
 		return false, NewResponseError(errors)
@@ -69,6 +105,14 @@ func (e Email) Validate() (bool, *ResponseError) {
 	return true, nil
 }
 
+func validatePriority(priority string) *ResponseError {
+	switch priority {
+	case "", priorityHigh, priorityNormal, priorityLow:
+		return nil
+	}
+	return NewResponseError(map[string]string{"priority": "Priority must be one of high, normal or low"})
+}
+
 func validateEmail(fieldName, email string) (bool, string) {
 	if email == "" {
 		return false, fieldName + " is required"
@@ -113,14 +157,45 @@ func SendEmailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get a random queue url from config
-	queueUrl := config.QueueUrls[rand.Intn(len(config.QueueUrls))]
+	if respErr := validatePriority(request.Priority); respErr != nil {
+		log.Print("[REQUEST ERROR] Priority is invalid: ", request.Priority)
+		respondWithError(w, respErr, http.StatusUnprocessableEntity)
+		return
+	}
+	priority := request.Priority
+	if priority == "" {
+		priority = priorityNormal
+	}
+
+	now := time.Now()
+	expiresAt, respErr := requestExpiry(request, now)
+	if respErr != nil {
+		log.Print("[REQUEST ERROR] Expiry is invalid: ", respErr.Errors)
+		respondWithError(w, respErr, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// get a random queue url of the priority from config
+	queueUrls := config.QueueUrlsFor(priority)
+	queueUrl := queueUrls[rand.Intn(len(queueUrls))]
+	input := queue.SendInput{Body: string(body), Attributes: expiryAttributes(now, expiresAt)}
+
+	if config.IsFIFO() {
+		var respErr *ResponseError
+		if input.GroupId, respErr = messageGroupId(r, request); respErr != nil {
+			log.Print("[REQUEST ERROR] Message group id is invalid: ", respErr.Errors)
+			respondWithError(w, respErr, http.StatusUnprocessableEntity)
+			return
+		}
+		if input.DeduplicationId, respErr = deduplicationId(request, body); respErr != nil {
+			log.Print("[REQUEST ERROR] Deduplication id is invalid: ", respErr.Errors)
+			respondWithError(w, respErr, http.StatusUnprocessableEntity)
+			return
+		}
+		queueUrl = groupQueueUrl(queueUrls, input.GroupId)
+	}
 
-	bodyStr := string(body)
-	resp, err := sqsClient.SendMessage(&sqs.SendMessageInput{
-		QueueUrl:    &queueUrl,
-		MessageBody: &bodyStr,
-	})
+	messageId, err := queueBackend.Send(queueUrl, input)
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == invalidContent {
 			log.Print("[REQUEST ERROR] Invalid content in body: ", err.Error())
@@ -131,13 +206,13 @@ func SendEmailHandler(w http.ResponseWriter, r *http.Request) {
 			)
 			return
 		} else {
-			log.Print("[REQUEST ERROR] SQS service returned an error: ", err.Error())
+			log.Printf("[REQUEST ERROR] Queue backend returned an error for %s priority email: %v", priority, err)
 			respondWithError(w, NewBaseResponseError("Service unavailable"), http.StatusServiceUnavailable)
 			return
 		}
 	}
 
-	response := &SendEmailResponse{MessageId: *resp.MessageId}
+	response := &SendEmailResponse{MessageId: messageId}
 	respBytes, err := json.Marshal(response)
 	if err != nil {
 		// This should never happen
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"gomail/awsmock"
+	"gomail/queue"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/stretchr/testify/assert"
@@ -102,10 +105,73 @@ func (s *ApiSuite) TestSendEmail() {
 			ExpectedStatusCode: http.StatusUnprocessableEntity,
 			ExpectedResponse:   `{"errors":{"body":"Body is required"}}`,
 		},
+		{
+			Case:               "Reply to, headers and tags",
+			Body:               `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body","replyTo":"support@example.com","headers":{"List-Unsubscribe":"<mailto:unsubscribe@example.com>","X-Campaign":"spring"},"tags":{"campaign":"spring-2017"}}}`,
+			ConfigMaxBodySize:  standardBodySize,
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedResponse:   fmt.Sprintf(`{"messageId":"%v"}`, stdMessageId),
+		},
+		{
+			Case:               "Invalid reply to",
+			Body:               `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body","replyTo":"support"}}`,
+			ConfigMaxBodySize:  standardBodySize,
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"replyTo":"Reply to is not a valid email"}}`,
+		},
+		{
+			Case:               "Protected header",
+			Body:               `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body","headers":{"bcc":"victim@example.com"}}}`,
+			ConfigMaxBodySize:  standardBodySize,
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"headers":"Header bcc cannot be set"}}`,
+		},
+		{
+			Case:               "Gomail header",
+			Body:               `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body","headers":{"X-Gomail-Tenant":"other"}}}`,
+			ConfigMaxBodySize:  standardBodySize,
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"headers":"Header X-Gomail-Tenant cannot be set"}}`,
+		},
+		{
+			Case:               "Invalid header name",
+			Body:               `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body","headers":{"X-Campaign: spring\r\nBcc":"victim@example.com"}}}`,
+			ConfigMaxBodySize:  standardBodySize,
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"headers":"Header name \"X-Campaign: spring\\r\\nBcc\" is invalid"}}`,
+		},
+		{
+			Case:               "Line break in header value",
+			Body:               `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body","headers":{"X-Campaign":"spring\r\nBcc: victim@example.com"}}}`,
+			ConfigMaxBodySize:  standardBodySize,
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"headers":"Header X-Campaign must not contain line breaks"}}`,
+		},
+		{
+			Case:               "Line breaks in names and subject",
+			Body:               `{"email":{"fromEmail":"from@example.com","fromName":"From\nBcc: victim@example.com","toEmail":"to@example.com","toName":"To\r","subject":"Hello\r\nBcc: victim@example.com","body":"Test body"}}`,
+			ConfigMaxBodySize:  standardBodySize,
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"fromName":"From name must not contain line breaks","subject":"Subject must not contain line breaks","toName":"To name must not contain line breaks"}}`,
+		},
+		{
+			Case:               "Invalid tag",
+			Body:               `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body","tags":{"campaign":"spring 2017"}}}`,
+			ConfigMaxBodySize:  standardBodySize,
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"tags":"Tag \"campaign\" must be letters, digits, underscores or dashes"}}`,
+		},
+		{
+			Case:               "Too many tags",
+			Body:               `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body","tags":{"a":"1","b":"2","c":"3","d":"4","e":"5","f":"6","g":"7","h":"8","i":"9","j":"10","k":"11"}}}`,
+			ConfigMaxBodySize:  standardBodySize,
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"tags":"Tags must not be more than 10"}}`,
+		},
 	}
 
 	for _, testCase := range testCases {
-		sqsClient = awsmock.MockSQSSendEmail(stdQueueUrl, testCase.Body, stdMessageId, testCase.AwsErr)
+		queueBackend = queue.NewSQS(awsmock.MockSQSSendEmail(stdQueueUrl, testCase.Body, stdMessageId, testCase.AwsErr))
 		config = &Config{
 			MaxBodySizeBytes: testCase.ConfigMaxBodySize,
 			QueueUrls:        []string{stdQueueUrl},
@@ -118,3 +184,236 @@ func (s *ApiSuite) TestSendEmail() {
 		assert.Equal(s.T(), testCase.ExpectedResponse, recorder.Body.String())
 	}
 }
+
+func (s *ApiSuite) TestSendEmailFIFO() {
+	fifoQueueUrl := "gomail-mails.fifo"
+	body := `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body"}%s}`
+	testCases := []struct {
+		Case    string
+		GroupBy string
+		Body    string
+		Tenant  string
+
+		ExpectedStatusCode int
+		ExpectedResponse   string
+		ExpectedGroupId    string
+	}{
+		{
+			Case:               "Grouped by recipient",
+			GroupBy:            groupByRecipient,
+			Body:               fmt.Sprintf(body, ""),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedGroupId:    "to@example.com",
+		},
+		{
+			Case:               "Grouped by tenant",
+			GroupBy:            groupByTenant,
+			Body:               fmt.Sprintf(body, `,"deduplicationId":"request-1"`),
+			Tenant:             "acme",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedGroupId:    "acme",
+		},
+		{
+			Case:               "Missing tenant",
+			GroupBy:            groupByTenant,
+			Body:               fmt.Sprintf(body, ""),
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"base":"X-Gomail-Tenant header is required"}}`,
+		},
+		{
+			Case:               "Grouped by field",
+			GroupBy:            groupByField,
+			Body:               fmt.Sprintf(body, `,"messageGroupId":"user-42"`),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedGroupId:    "user-42",
+		},
+		{
+			Case:               "Invalid group field",
+			GroupBy:            groupByField,
+			Body:               fmt.Sprintf(body, `,"messageGroupId":"user 42"`),
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"messageGroupId":"Message group id is invalid"}}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		queueBackend = queue.NewMemory(30)
+		config = &Config{
+			MaxBodySizeBytes: 204800,
+			QueueUrls:        []string{fifoQueueUrl},
+			Fifo:             FifoConfig{GroupBy: testCase.GroupBy, TenantHeader: defaultTenantHeader},
+		}
+		send := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/email/send", strings.NewReader(testCase.Body))
+			if testCase.Tenant != "" {
+				req.Header.Set(defaultTenantHeader, testCase.Tenant)
+			}
+			SendEmailHandler(recorder, req)
+			return recorder
+		}
+		recorder := send()
+
+		assert.Equal(s.T(), testCase.ExpectedStatusCode, recorder.Code, testCase.Case)
+		if testCase.ExpectedStatusCode != http.StatusOK {
+			assert.Equal(s.T(), testCase.ExpectedResponse, recorder.Body.String(), testCase.Case)
+			continue
+		}
+
+		// resubmitting the same request does not queue the email twice
+		assert.Equal(s.T(), recorder.Body.String(), send().Body.String(), testCase.Case)
+		messages, err := queueBackend.Receive(fifoQueueUrl, 10, 0)
+		assert.NoError(s.T(), err, testCase.Case)
+		if assert.Len(s.T(), messages, 1, testCase.Case) {
+			assert.Equal(s.T(), testCase.ExpectedGroupId, messages[0].GroupId, testCase.Case)
+		}
+	}
+}
+
+func (s *ApiSuite) TestSendEmailPriority() {
+	body := `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body"}%s}`
+	testCases := []struct {
+		Case string
+		Body string
+
+		ExpectedStatusCode int
+		ExpectedResponse   string
+		ExpectedQueueUrl   string
+	}{
+		{
+			Case:               "No priority",
+			Body:               fmt.Sprintf(body, ""),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedQueueUrl:   "gomail-mails",
+		},
+		{
+			Case:               "High priority",
+			Body:               fmt.Sprintf(body, `,"priority":"high"`),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedQueueUrl:   "gomail-mails-high",
+		},
+		{
+			Case:               "Priority without queues of its own",
+			Body:               fmt.Sprintf(body, `,"priority":"low"`),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedQueueUrl:   "gomail-mails",
+		},
+		{
+			Case:               "Unknown priority",
+			Body:               fmt.Sprintf(body, `,"priority":"urgent"`),
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"priority":"Priority must be one of high, normal or low"}}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		queueBackend = queue.NewMemory(30)
+		config = &Config{
+			MaxBodySizeBytes:  204800,
+			QueueUrls:         []string{"gomail-mails"},
+			PriorityQueueUrls: PriorityQueueUrls{High: []string{"gomail-mails-high"}},
+		}
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email/send", strings.NewReader(testCase.Body))
+		SendEmailHandler(recorder, req)
+
+		assert.Equal(s.T(), testCase.ExpectedStatusCode, recorder.Code, testCase.Case)
+		if testCase.ExpectedStatusCode != http.StatusOK {
+			assert.Equal(s.T(), testCase.ExpectedResponse, recorder.Body.String(), testCase.Case)
+			continue
+		}
+		depth, err := queueBackend.Depth(testCase.ExpectedQueueUrl)
+		assert.NoError(s.T(), err, testCase.Case)
+		assert.Equal(s.T(), int64(1), depth, testCase.Case)
+	}
+}
+
+func (s *ApiSuite) TestSendEmailExpiry() {
+	body := `{"email":{"fromEmail":"from@example.com","toEmail":"to@example.com","body":"Test body"}%s}`
+	inAnHour := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+	testCases := []struct {
+		Case string
+		Body string
+
+		ExpectedStatusCode int
+		ExpectedResponse   string
+		ExpectedExpiresAt  time.Duration
+	}{
+		{
+			Case:               "No expiry",
+			Body:               fmt.Sprintf(body, ""),
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Case:               "Expires at",
+			Body:               fmt.Sprintf(body, fmt.Sprintf(`,"expiresAt":"%s"`, inAnHour.Format(time.RFC3339Nano))),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedExpiresAt:  time.Hour,
+		},
+		{
+			Case:               "TTL seconds",
+			Body:               fmt.Sprintf(body, `,"ttlSeconds":600`),
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedExpiresAt:  10 * time.Minute,
+		},
+		{
+			Case:               "Expires at in the past",
+			Body:               fmt.Sprintf(body, `,"expiresAt":"2016-01-01T00:00:00Z"`),
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"expiresAt":"Expires at must be in the future"}}`,
+		},
+		{
+			Case:               "Zero TTL seconds",
+			Body:               fmt.Sprintf(body, `,"ttlSeconds":0`),
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"ttlSeconds":"TTL seconds must be greater than 0"}}`,
+		},
+		{
+			Case:               "TTL seconds overflowing a duration",
+			Body:               fmt.Sprintf(body, `,"ttlSeconds":9223372036854775807`),
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"ttlSeconds":"TTL seconds must not be greater than 1209600"}}`,
+		},
+		{
+			Case:               "Both expires at and TTL seconds",
+			Body:               fmt.Sprintf(body, fmt.Sprintf(`,"expiresAt":"%s","ttlSeconds":600`, inAnHour.Format(time.RFC3339Nano))),
+			ExpectedStatusCode: http.StatusUnprocessableEntity,
+			ExpectedResponse:   `{"errors":{"base":"Only one of expiresAt and ttlSeconds can be set"}}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		queueBackend = queue.NewMemory(30)
+		config = &Config{
+			MaxBodySizeBytes: 204800,
+			QueueUrls:        []string{"gomail-mails"},
+		}
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/email/send", strings.NewReader(testCase.Body))
+		SendEmailHandler(recorder, req)
+
+		assert.Equal(s.T(), testCase.ExpectedStatusCode, recorder.Code, testCase.Case)
+		if testCase.ExpectedStatusCode != http.StatusOK {
+			assert.Equal(s.T(), testCase.ExpectedResponse, recorder.Body.String(), testCase.Case)
+			continue
+		}
+		messages, err := queueBackend.Receive("gomail-mails", 1, 0)
+		if !assert.NoError(s.T(), err, testCase.Case) || !assert.Len(s.T(), messages, 1, testCase.Case) {
+			continue
+		}
+		enqueuedAt, err := strconv.ParseInt(messages[0].Attributes[enqueuedAtAttribute].StringValue, 10, 64)
+		assert.NoError(s.T(), err, testCase.Case)
+		assert.InDelta(s.T(), time.Now().UnixNano()/int64(time.Millisecond), enqueuedAt, 5000, testCase.Case)
+
+		expiresAt, ok := messages[0].Attributes[expiresAtAttribute]
+		if testCase.ExpectedExpiresAt == 0 {
+			assert.False(s.T(), ok, testCase.Case)
+			continue
+		}
+		assert.Equal(s.T(), "Number", expiresAt.DataType, testCase.Case)
+		expected := enqueuedAt + int64(testCase.ExpectedExpiresAt/time.Millisecond)
+		actual, err := strconv.ParseInt(expiresAt.StringValue, 10, 64)
+		assert.NoError(s.T(), err, testCase.Case)
+		assert.InDelta(s.T(), expected, actual, 5000, testCase.Case)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// tags are checked against the limits of SES, the pipeline leaves out the tags beyond
+	// the stricter limits of other providers (e.g. Mailgun takes 3 tags)
+	maxTags = 10
+	// no header line may be longer than 998 characters (RFC 5322)
+	maxHeaderLength = 998
+)
+
+var (
+	// a header name is printable ASCII, without spaces or colons (RFC 5322)
+	headerNameRegexp = regexp.MustCompile(`^[!-9;-~]+$`)
+	// SES only accepts tag names and values of up to 256 letters, digits, underscores
+	// and dashes
+	tagRegexp = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,256}$`)
+)
+
+// protectedHeaders are set by gomail or the providers, and cannot be set through the
+// headers of an email. Keys are lower case.
+var protectedHeaders = map[string]bool{
+	"from":                      true,
+	"sender":                    true,
+	"to":                        true,
+	"cc":                        true,
+	"bcc":                       true,
+	"reply-to":                  true,
+	"subject":                   true,
+	"date":                      true,
+	"message-id":                true,
+	"return-path":               true,
+	"received":                  true,
+	"dkim-signature":            true,
+	"mime-version":              true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+	"content-disposition":       true,
+	"content-id":                true,
+}
+
+// containsLineBreak reports whether a value would start a new line of the message
+// headers it is written to.
+func containsLineBreak(value string) bool {
+	return strings.ContainsAny(value, "\r\n")
+}
+
+// validateHeaders checks the custom headers of an email, in the order of their names. It
+// returns the error message of the first invalid one.
+func validateHeaders(headers map[string]string) (bool, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := headers[name]
+		if !headerNameRegexp.MatchString(name) {
+			return false, fmt.Sprintf("Header name %q is invalid", name)
+		}
+		if protectedHeaders[strings.ToLower(name)] || strings.HasPrefix(strings.ToLower(name), "x-gomail-") {
+			return false, fmt.Sprintf("Header %s cannot be set", name)
+		}
+		if containsLineBreak(value) {
+			return false, fmt.Sprintf("Header %s must not contain line breaks", name)
+		}
+		if len(name)+2+len(value) > maxHeaderLength {
+			return false, fmt.Sprintf("Header %s is too long", name)
+		}
+	}
+	return true, ""
+}
+
+// validateTags checks the tags of an email, in the order of their names.
+func validateTags(tags map[string]string) (bool, string) {
+	if len(tags) > maxTags {
+		return false, fmt.Sprintf("Tags must not be more than %d", maxTags)
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !tagRegexp.MatchString(name) || !tagRegexp.MatchString(tags[name]) {
+			return false, fmt.Sprintf("Tag %q must be letters, digits, underscores or dashes", name)
+		}
+	}
+	return true, ""
+}
@@ -11,17 +11,18 @@ import (
 	"syscall"
 	"time"
 
+	"gomail/queue"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
 var (
-	sqsClient sqsiface.SQSAPI
+	queueBackend queue.Backend
 
 	configFilePath = "config.yaml"
 	config         *Config
@@ -43,12 +44,15 @@ func main() {
 		log.Fatal("Could not initialize config: ", err.Error())
 	}
 
-	// initialize sqs client
+	// initialize queue backend
 	awsConfig := aws.NewConfig().
 		WithHTTPClient(&http.Client{Timeout: time.Duration(config.AwsClientTimeoutSeconds) * time.Second}).
 		WithRegion(config.AwsRegion)
 	awsSession := session.New(awsConfig)
-	sqsClient = sqs.New(awsSession)
+	queueBackend, err = queue.New(config.QueueBackend, sqs.New(awsSession))
+	if err != nil {
+		log.Fatal("Could not initialize queue backend: ", err.Error())
+	}
 
 	router := mux.NewRouter()
 
@@ -68,6 +72,9 @@ func main() {
 	}
 
 	corsAllowedHeaders := []string{"Content-Type"}
+	if config.IsFIFO() && config.Fifo.GroupBy == groupByTenant {
+		corsAllowedHeaders = append(corsAllowedHeaders, config.Fifo.TenantHeader)
+	}
 	corsAllowedMethods := []string{"POST"}
 	corsAllowedOrigins := []string{"*"}
 	listenerClosed := make(chan struct{})
@@ -87,7 +94,7 @@ func main() {
 	log.Printf("Server startup complete! Serving requests on port %v", config.Port)
 
 	// setup signal handler and wait for signal
-	signalChannel := make(chan os.Signal)
+	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGINT)
 	<-signalChannel
 
@@ -5,6 +5,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/mock"
 )
 
 type mockAwsErr struct {
@@ -35,19 +36,18 @@ func NewMockAwsErr(code, err string) awserr.Error {
 	}
 }
 
+// MockSQSSendEmail expects an email to be sent to a queue. The message attributes are
+// not compared, since they include the time the email was enqueued.
 func MockSQSSendEmail(queueUrl, messageBody, messageId string, awsErr awserr.Error) *mocks.SQSAPI {
 	mockSQS := new(mocks.SQSAPI)
+	input := mock.MatchedBy(func(input *sqs.SendMessageInput) bool {
+		return *input.QueueUrl == queueUrl && *input.MessageBody == messageBody
+	})
 
 	if awsErr == nil {
-		mockSQS.On("SendMessage", &sqs.SendMessageInput{
-			QueueUrl:    &queueUrl,
-			MessageBody: &messageBody,
-		}).Return(&sqs.SendMessageOutput{MessageId: &messageId}, nil)
+		mockSQS.On("SendMessage", input).Return(&sqs.SendMessageOutput{MessageId: &messageId}, nil)
 	} else {
-		mockSQS.On("SendMessage", &sqs.SendMessageInput{
-			QueueUrl:    &queueUrl,
-			MessageBody: &messageBody,
-		}).Return(nil, awsErr)
+		mockSQS.On("SendMessage", input).Return(nil, awsErr)
 	}
 
 	return mockSQS
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"gomail/queue"
+)
+
+const (
+	maxEntriesPerBatch = queue.MaxBatchSize
+)
+
+var acks = newAcknowledger()
+
+type ackEntry struct {
+	message           *Message
+	visibilityTimeout int64 // only used by visibility changes
+	retries           int
+	done              func(error)
+}
+
+// ackBatch holds the acknowledgements of a single queue waiting to be flushed.
+type ackBatch struct {
+	deletes           []*ackEntry
+	visibilityChanges []*ackEntry
+}
+
+// acknowledger buffers the deletes and visibility changes of received messages per
+// queue, and flushes them with one batch call per 10 messages - either as soon as 10
+// of them are waiting, or every ack_flush_interval_milliseconds. Entries that fail for
+// reasons outside our control are retried up to ack_max_retries times.
+type acknowledger struct {
+	mu                      sync.Mutex
+	batches                 map[string]*ackBatch
+	flushing                int
+	idle                    *sync.Cond
+	failedDeletes           int
+	failedVisibilityChanges int
+}
+
+func newAcknowledger() *acknowledger {
+	a := &acknowledger{batches: make(map[string]*ackBatch)}
+	a.idle = sync.NewCond(&a.mu)
+	return a
+}
+
+// Delete deletes a message from its queue, and stops extending its visibility. done (if
+// any) is called with the outcome once the batch the message ended up in was flushed.
+func (a *acknowledger) Delete(message *Message, done func(error)) {
+	heartbeats[message.QueueUrl].Untrack(message)
+	a.enqueueDelete(&ackEntry{message: message, done: done})
+}
+
+// ChangeVisibility makes a message visible again after visibilityTimeout seconds, and
+// stops extending its visibility in the meantime. done (if any) is called with the
+// outcome once the batch has been flushed.
+func (a *acknowledger) ChangeVisibility(message *Message, visibilityTimeout int64, done func(error)) {
+	heartbeats[message.QueueUrl].Untrack(message)
+	a.enqueueVisibilityChange(&ackEntry{message: message, visibilityTimeout: visibilityTimeout, done: done})
+}
+
+func (a *acknowledger) batch(queueUrl string) *ackBatch {
+	batch, ok := a.batches[queueUrl]
+	if !ok {
+		batch = &ackBatch{}
+		a.batches[queueUrl] = batch
+	}
+	return batch
+}
+
+func (a *acknowledger) enqueueDelete(entry *ackEntry) {
+	queueUrl := entry.message.QueueUrl
+	a.mu.Lock()
+	batch := a.batch(queueUrl)
+	batch.deletes = append(batch.deletes, entry)
+	var full []*ackEntry
+	if len(batch.deletes) >= maxEntriesPerBatch {
+		full, batch.deletes = batch.deletes[:maxEntriesPerBatch], batch.deletes[maxEntriesPerBatch:]
+	}
+	a.mu.Unlock()
+
+	if full != nil {
+		a.startFlush(func() { a.flushDeletes(queueUrl, full) })
+	}
+}
+
+func (a *acknowledger) enqueueVisibilityChange(entry *ackEntry) {
+	queueUrl := entry.message.QueueUrl
+	a.mu.Lock()
+	batch := a.batch(queueUrl)
+	batch.visibilityChanges = append(batch.visibilityChanges, entry)
+	var full []*ackEntry
+	if len(batch.visibilityChanges) >= maxEntriesPerBatch {
+		full, batch.visibilityChanges = batch.visibilityChanges[:maxEntriesPerBatch], batch.visibilityChanges[maxEntriesPerBatch:]
+	}
+	a.mu.Unlock()
+
+	if full != nil {
+		a.startFlush(func() { a.flushVisibilityChanges(queueUrl, full) })
+	}
+}
+
+// startFlush runs flush in the background, keeping track of it so that Flush can wait
+// for it to finish.
+func (a *acknowledger) startFlush(flush func()) {
+	a.mu.Lock()
+	a.flushing++
+	a.mu.Unlock()
+
+	go func() {
+		flush()
+		a.mu.Lock()
+		a.flushing--
+		if a.flushing == 0 {
+			a.idle.Broadcast()
+		}
+		a.mu.Unlock()
+	}()
+}
+
+// flushPending starts flushing all acknowledgements waiting in the buffer.
+func (a *acknowledger) flushPending() {
+	a.mu.Lock()
+	batches := a.batches
+	a.batches = make(map[string]*ackBatch)
+	a.mu.Unlock()
+
+	for queueUrl, batch := range batches {
+		queueUrl := queueUrl
+		for _, entries := range chunk(batch.deletes) {
+			entries := entries
+			a.startFlush(func() { a.flushDeletes(queueUrl, entries) })
+		}
+		for _, entries := range chunk(batch.visibilityChanges) {
+			entries := entries
+			a.startFlush(func() { a.flushVisibilityChanges(queueUrl, entries) })
+		}
+	}
+}
+
+// Run flushes all pending acknowledgements every ack_flush_interval_milliseconds, until
+// ctx is done.
+func (a *acknowledger) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.AckFlushIntervalMilliseconds) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.flushPending()
+		}
+	}
+}
+
+// Flush sends all pending acknowledgements, and returns once all of them (including
+// their retries and flushes that were already running) are done.
+func (a *acknowledger) Flush() {
+	for {
+		a.flushPending()
+
+		a.mu.Lock()
+		for a.flushing > 0 {
+			a.idle.Wait()
+		}
+		empty := len(a.batches) == 0
+		a.mu.Unlock()
+
+		if empty {
+			return
+		}
+	}
+}
+
+// Failures returns the number of deletes and visibility changes that failed for good
+// since the last call.
+func (a *acknowledger) Failures() (deletes, visibilityChanges int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deletes, visibilityChanges = a.failedDeletes, a.failedVisibilityChanges
+	a.failedDeletes, a.failedVisibilityChanges = 0, 0
+	return
+}
+
+func chunk(entries []*ackEntry) [][]*ackEntry {
+	chunks := make([][]*ackEntry, 0, len(entries)/maxEntriesPerBatch+1)
+	for len(entries) > maxEntriesPerBatch {
+		chunks = append(chunks, entries[:maxEntriesPerBatch])
+		entries = entries[maxEntriesPerBatch:]
+	}
+	if len(entries) > 0 {
+		chunks = append(chunks, entries)
+	}
+	return chunks
+}
+
+func (a *acknowledger) flushDeletes(queueUrl string, entries []*ackEntry) {
+	receiptHandles := make([]string, len(entries))
+	for i, entry := range entries {
+		receiptHandles[i] = entry.message.Message.ReceiptHandle
+	}
+
+	failures, err := queueBackend.DeleteBatch(queueUrl, receiptHandles)
+	if err != nil {
+		log.Printf("[ERROR] Could not delete %d messages from queue (%s): %v", len(entries), queueUrl, err.Error())
+		for _, entry := range entries {
+			a.retry(entry, err, a.enqueueDelete, true)
+		}
+		return
+	}
+
+	a.finish(entries, failures, a.enqueueDelete, true)
+}
+
+func (a *acknowledger) flushVisibilityChanges(queueUrl string, entries []*ackEntry) {
+	changes := make([]queue.VisibilityChange, len(entries))
+	for i, entry := range entries {
+		changes[i] = queue.VisibilityChange{
+			ReceiptHandle:     entry.message.Message.ReceiptHandle,
+			VisibilityTimeout: entry.visibilityTimeout,
+		}
+	}
+
+	failures, err := queueBackend.ChangeVisibilityBatch(queueUrl, changes)
+	if err != nil {
+		log.Printf("[ERROR] Could not change visibility of %d messages in queue (%s): %v", len(entries), queueUrl, err.Error())
+		for _, entry := range entries {
+			a.retry(entry, err, a.enqueueVisibilityChange, false)
+		}
+		return
+	}
+
+	a.finish(entries, failures, a.enqueueVisibilityChange, false)
+}
+
+// finish reports the outcome of a flushed batch to each of its entries.
+func (a *acknowledger) finish(entries []*ackEntry, failures []error, enqueue func(*ackEntry), isDelete bool) {
+	for i, entry := range entries {
+		err := failures[i]
+		if err == nil {
+			entry.message.finish()
+			if entry.done != nil {
+				entry.done(nil)
+			}
+			continue
+		}
+
+		// sender faults (e.g. an expired receipt handle) fail the same way when retried
+		if queue.IsSenderFault(err) {
+			a.fail(entry, err, isDelete)
+		} else {
+			a.retry(entry, err, enqueue, isDelete)
+		}
+	}
+}
+
+// retry puts a failed entry back into the buffer to be part of the next flush, unless
+// it was already retried ack_max_retries times.
+func (a *acknowledger) retry(entry *ackEntry, err error, enqueue func(*ackEntry), isDelete bool) {
+	if entry.retries >= config.AckMaxRetries {
+		a.fail(entry, err, isDelete)
+		return
+	}
+	entry.retries++
+	enqueue(entry)
+}
+
+func (a *acknowledger) fail(entry *ackEntry, err error, isDelete bool) {
+	a.mu.Lock()
+	if isDelete {
+		a.failedDeletes++
+	} else {
+		a.failedVisibilityChanges++
+	}
+	a.mu.Unlock()
+
+	action := "change visibility of"
+	if isDelete {
+		action = "delete"
+	}
+	log.Printf(
+		"[ERROR] Could not %s message %s in queue (%s) after %d retries: %v",
+		action,
+		entry.message.Message.Id,
+		entry.message.QueueUrl,
+		entry.retries,
+		err.Error(),
+	)
+	entry.message.finish()
+	if entry.done != nil {
+		entry.done(err)
+	}
+}
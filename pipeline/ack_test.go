@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"gomail/awsmock/mocks"
+	"gomail/queue"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type AckSuite struct {
+	suite.Suite
+}
+
+func TestAckSuite(t *testing.T) {
+	suite.Run(t, new(AckSuite))
+}
+
+const testQueueUrl = "https://sqs.us-east-1.amazonaws.com/111111111111/gomail-mails"
+
+func testMessage(id int) *Message {
+	return NewMessage(&queue.Message{
+		Id:            strconv.Itoa(id),
+		ReceiptHandle: "receipt-" + strconv.Itoa(id),
+		Body:          `{"email":{}}`,
+	}, testQueueUrl)
+}
+
+func (s *AckSuite) TestDeleteBatches() {
+	config = &Config{AckMaxRetries: 1}
+	mockSQS := new(mocks.SQSAPI)
+	queueBackend = queue.NewSQS(mockSQS)
+	a := newAcknowledger()
+
+	batchSizes := make(chan int, 2)
+	mockSQS.On("DeleteMessageBatch", mock.AnythingOfType("*sqs.DeleteMessageBatchInput")).
+		Run(func(args mock.Arguments) {
+			batchSizes <- len(args.Get(0).(*sqs.DeleteMessageBatchInput).Entries)
+		}).
+		Return(&sqs.DeleteMessageBatchOutput{}, nil)
+
+	results := make(chan error, 12)
+	for i := 0; i < 12; i++ {
+		a.Delete(testMessage(i), func(err error) { results <- err })
+	}
+	// the first 10 deletes are flushed right away as a full batch
+	assert.Equal(s.T(), 10, <-batchSizes)
+	a.Flush()
+	assert.Equal(s.T(), 2, <-batchSizes)
+
+	for i := 0; i < 12; i++ {
+		assert.NoError(s.T(), <-results)
+	}
+	mockSQS.AssertNumberOfCalls(s.T(), "DeleteMessageBatch", 2)
+}
+
+func (s *AckSuite) TestEntryFailures() {
+	config = &Config{AckMaxRetries: 1}
+	mockSQS := new(mocks.SQSAPI)
+	queueBackend = queue.NewSQS(mockSQS)
+	a := newAcknowledger()
+
+	// entry 0 always fails on the SQS side, entry 1 has an invalid receipt handle
+	mockSQS.On("ChangeMessageVisibilityBatch", mock.AnythingOfType("*sqs.ChangeMessageVisibilityBatchInput")).
+		Return(func(input *sqs.ChangeMessageVisibilityBatchInput) *sqs.ChangeMessageVisibilityBatchOutput {
+			output := &sqs.ChangeMessageVisibilityBatchOutput{}
+			for _, entry := range input.Entries {
+				switch *entry.ReceiptHandle {
+				case "receipt-0":
+					output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+						Id: entry.Id, Code: aws.String("InternalError"), SenderFault: aws.Bool(false),
+					})
+				case "receipt-1":
+					output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{
+						Id: entry.Id, Code: aws.String("ReceiptHandleIsInvalid"), SenderFault: aws.Bool(true),
+					})
+				}
+			}
+			return output
+		}, nil)
+
+	results := make(map[int]error)
+	for i := 0; i < 3; i++ {
+		id := i
+		a.ChangeVisibility(testMessage(id), 30, func(err error) { results[id] = err })
+	}
+	a.Flush()
+	a.Flush()
+
+	assert.EqualError(s.T(), results[0], "InternalError: ")
+	assert.EqualError(s.T(), results[1], "ReceiptHandleIsInvalid: ")
+	assert.NoError(s.T(), results[2])
+	mockSQS.AssertNumberOfCalls(s.T(), "ChangeMessageVisibilityBatch", 2)
+
+	deletes, visibilityChanges := a.Failures()
+	assert.Equal(s.T(), 0, deletes)
+	assert.Equal(s.T(), 2, visibilityChanges)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+type adminError struct {
+	Errors map[string]string `json:"errors"`
+}
+
+// pipelineStatus is the response of GET /status.
+type pipelineStatus struct {
+	Paused     bool             `json:"paused"`
+	InFlight   int              `json:"inFlight"`
+	Received   int64            `json:"received"`
+	Sent       int64            `json:"sent"`
+	Failed     int64            `json:"failed"`
+	Expired    int64            `json:"expired"`
+	Throttled  int64            `json:"throttled"`
+	HandedBack int64            `json:"handedBack"`
+	Priorities []priorityStatus `json:"priorities"`
+	Queues     []queueStatus    `json:"queues"`
+	Workers    []workerStatus   `json:"workers"`
+}
+
+// queueStatus is part of the response of GET /status.
+type queueStatus struct {
+	Url      string `json:"url"`
+	InFlight int    `json:"inFlight"`
+	// in-flight messages the queue is entitled to while other queues are busy
+	Share    int   `json:"share"`
+	Received int64 `json:"received"`
+}
+
+// Status takes a snapshot of the pipeline and all of its workers.
+func (p *Pipeline) Status() pipelineStatus {
+	status := pipelineStatus{
+		Paused:     p.pause.IsPaused(),
+		Received:   atomic.LoadInt64(&p.stats.received),
+		Sent:       atomic.LoadInt64(&p.stats.sent),
+		Failed:     atomic.LoadInt64(&p.stats.failed),
+		Expired:    atomic.LoadInt64(&p.stats.expired),
+		Throttled:  atomic.LoadInt64(&p.stats.throttled),
+		HandedBack: atomic.LoadInt64(&p.stats.handedBack),
+		Priorities: p.messages.status(),
+		Queues:     make([]queueStatus, 0, len(p.queues)),
+		Workers:    make([]workerStatus, 0, len(p.workers)),
+	}
+	if inFlight != nil {
+		status.InFlight = inFlight.InFlight()
+	}
+
+	for _, stats := range p.queues {
+		queueStatus := queueStatus{
+			Url:      stats.url,
+			Received: atomic.LoadInt64(&stats.received),
+		}
+		if inFlight != nil {
+			queueStatus.InFlight, queueStatus.Share = inFlight.Held(stats.url)
+		}
+		status.Queues = append(status.Queues, queueStatus)
+	}
+
+	routed := 0
+	for _, w := range p.workers {
+		workerStatus := w.status()
+		routed += workerStatus.Routed
+		status.Workers = append(status.Workers, workerStatus)
+	}
+	if routed > 0 {
+		for i := range status.Workers {
+			status.Workers[i].Split = float64(status.Workers[i].Routed) / float64(routed)
+		}
+	}
+	return status
+}
+
+// startAdmin serves the admin endpoints on admin.port, if it is set.
+func startAdmin(p *Pipeline) error {
+	if config.Admin.Port == 0 {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(config.Admin.Port))
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Admin endpoint listening on port %d", config.Admin.Port)
+	go http.Serve(l, newAdminHandler(p, config.Admin.Token))
+	return nil
+}
+
+// newAdminHandler returns the handler of the admin endpoints. Every request must carry
+// the admin token as a bearer token.
+func newAdminHandler(p *Pipeline, token string) http.Handler {
+	a := &admin{pipeline: p}
+	router := mux.NewRouter()
+	router.HandleFunc("/status", a.status).Methods("GET")
+	router.HandleFunc("/workers/{name}/disable", a.disableWorker).Methods("POST")
+	router.HandleFunc("/workers/{name}/enable", a.enableWorker).Methods("POST")
+	router.HandleFunc("/workers/{name}/force-healthy", a.forceHealthy).Methods("POST")
+	router.HandleFunc("/pause", a.pause).Methods("POST")
+	router.HandleFunc("/resume", a.resume).Methods("POST")
+	router.HandleFunc("/deliveries/{id}", a.deliveries).Methods("GET")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			log.Printf("[ERROR] Admin: rejected unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			respondWithAdminError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+func authorized(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(token)) == 1
+}
+
+type admin struct {
+	pipeline *Pipeline
+}
+
+func (a *admin) status(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, a.pipeline.Status())
+}
+
+func (a *admin) disableWorker(w http.ResponseWriter, r *http.Request) {
+	a.updateWorker(w, r, "disabled", func(wk *worker) { wk.SetDisabled(true) })
+}
+
+func (a *admin) enableWorker(w http.ResponseWriter, r *http.Request) {
+	a.updateWorker(w, r, "enabled", func(wk *worker) { wk.SetDisabled(false) })
+}
+
+func (a *admin) forceHealthy(w http.ResponseWriter, r *http.Request) {
+	a.updateWorker(w, r, "forced healthy", func(wk *worker) { wk.ForceHealthy() })
+}
+
+func (a *admin) updateWorker(w http.ResponseWriter, r *http.Request, action string, update func(*worker)) {
+	name := mux.Vars(r)["name"]
+	wk := a.pipeline.worker(name)
+	if wk == nil {
+		respondWithAdminError(w, "Unknown worker", http.StatusNotFound)
+		return
+	}
+
+	update(wk)
+	log.Printf("[INFO] Admin: worker %s %s by %s", wk.name, action, r.RemoteAddr)
+	respondWithJSON(w, wk.status())
+}
+
+func (a *admin) pause(w http.ResponseWriter, r *http.Request) {
+	if a.pipeline.pause.Pause() {
+		log.Printf("[INFO] Admin: pipeline paused by %s", r.RemoteAddr)
+	}
+	respondWithJSON(w, a.pipeline.Status())
+}
+
+func (a *admin) resume(w http.ResponseWriter, r *http.Request) {
+	if a.pipeline.pause.Resume() {
+		log.Printf("[INFO] Admin: pipeline resumed by %s", r.RemoteAddr)
+	}
+	respondWithJSON(w, a.pipeline.Status())
+}
+
+func (a *admin) deliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := deliveryLog.Lookup(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("[ERROR] Admin: could not look up deliveries: %v", err)
+		respondWithAdminError(w, "Could not look up deliveries", http.StatusServiceUnavailable)
+		return
+	}
+	if len(deliveries) == 0 {
+		respondWithAdminError(w, "No delivery found", http.StatusNotFound)
+		return
+	}
+	respondWithJSON(w, deliveries)
+}
+
+// worker looks a worker up by name, ignoring case.
+func (p *Pipeline) worker(name string) *worker {
+	for _, w := range p.workers {
+		if strings.EqualFold(w.name, name) {
+			return w
+		}
+	}
+	return nil
+}
+
+func respondWithJSON(w http.ResponseWriter, response interface{}) {
+	respBytes, err := json.Marshal(response)
+	if err != nil {
+		// This should never happen
+		panic("Could not marshal response: " + err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respBytes)
+}
+
+func respondWithAdminError(w http.ResponseWriter, errorMsg string, httpStatus int) {
+	errorBytes, err := json.Marshal(&adminError{map[string]string{"base": errorMsg}})
+	if err != nil {
+		// This should never happen
+		panic("Could not marshal error response: " + err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(errorBytes)
+}
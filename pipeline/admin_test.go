@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type AdminSuite struct {
+	suite.Suite
+}
+
+func TestAdminSuite(t *testing.T) {
+	suite.Run(t, new(AdminSuite))
+}
+
+const testAdminToken = "secret"
+
+func newAdminTestPipeline() *Pipeline {
+	return &Pipeline{
+		workers: []*worker{
+			newWorker("Sendgrid", &nopWorker{}, ProviderConfig{MaxConcurrency: 1}),
+			newWorker("SES", &nopWorker{}, ProviderConfig{MaxConcurrency: 1}),
+		},
+	}
+}
+
+func (s *AdminSuite) TestAuthentication() {
+	testCases := []struct {
+		Case          string
+		Authorization string
+
+		ExpectedStatusCode int
+	}{
+		{
+			Case:               "Valid token",
+			Authorization:      "Bearer " + testAdminToken,
+			ExpectedStatusCode: http.StatusOK,
+		},
+		{
+			Case:               "Missing token",
+			Authorization:      "",
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Case:               "Wrong token",
+			Authorization:      "Bearer wrong",
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Case:               "Token without scheme",
+			Authorization:      testAdminToken,
+			ExpectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	handler := newAdminHandler(newAdminTestPipeline(), testAdminToken)
+	for _, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/pause", nil)
+		if testCase.Authorization != "" {
+			req.Header.Set("Authorization", testCase.Authorization)
+		}
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(s.T(), testCase.ExpectedStatusCode, recorder.Code, testCase.Case)
+	}
+}
+
+func (s *AdminSuite) TestWorkerActions() {
+	testCases := []struct {
+		Case   string
+		Target string
+
+		ExpectedStatusCode int
+		ExpectedDisabled   bool
+		ExpectedHealthy    bool
+	}{
+		{
+			Case:               "Disable worker",
+			Target:             "/workers/ses/disable",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedDisabled:   true,
+			ExpectedHealthy:    false,
+		},
+		{
+			Case:               "Force worker healthy",
+			Target:             "/workers/SES/force-healthy",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedDisabled:   true,
+			ExpectedHealthy:    true,
+		},
+		{
+			Case:               "Enable worker",
+			Target:             "/workers/ses/enable",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedDisabled:   false,
+			ExpectedHealthy:    true,
+		},
+		{
+			Case:               "Unknown worker",
+			Target:             "/workers/mailgun/disable",
+			ExpectedStatusCode: http.StatusNotFound,
+			ExpectedDisabled:   false,
+			ExpectedHealthy:    true,
+		},
+	}
+
+	p := newAdminTestPipeline()
+	handler := newAdminHandler(p, testAdminToken)
+	ses := p.worker("SES")
+	ses.isHealthy = false
+	for _, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", testCase.Target, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(s.T(), testCase.ExpectedStatusCode, recorder.Code, testCase.Case)
+		assert.Equal(s.T(), testCase.ExpectedDisabled, !ses.IsAvailable(), testCase.Case)
+		assert.Equal(s.T(), testCase.ExpectedHealthy, ses.IsHealthy(), testCase.Case)
+	}
+}
+
+func (s *AdminSuite) TestStatus() {
+	p := newAdminTestPipeline()
+	sendgrid, ses := p.workers[0], p.workers[1]
+	sendgrid.isHealthy = true
+	for i := 0; i < 3; i++ {
+		sendgrid.enqueue(context.Background(), testMessage(i))
+		<-sendgrid.jobs
+		sendgrid.recordResult(false, nil)
+	}
+	ses.enqueue(context.Background(), testMessage(3))
+	<-ses.jobs
+	ses.recordResult(true, assert.AnError)
+	for _, w := range p.workers {
+		w.endWindow()
+	}
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	newAdminHandler(p, testAdminToken).ServeHTTP(recorder, req)
+
+	var status pipelineStatus
+	if assert.Equal(s.T(), http.StatusOK, recorder.Code) && assert.NoError(s.T(), json.Unmarshal(recorder.Body.Bytes(), &status)) {
+		assert.Len(s.T(), status.Workers, 2)
+		assert.Equal(s.T(), 3, status.Workers[0].Routed)
+		assert.Equal(s.T(), 0.75, status.Workers[0].Split)
+		assert.Empty(s.T(), status.Workers[0].LastError)
+		assert.Equal(s.T(), 0.25, status.Workers[1].Split)
+		assert.Equal(s.T(), assert.AnError.Error(), status.Workers[1].LastError)
+		assert.NotNil(s.T(), status.Workers[1].LastErrorAt)
+	}
+}
+
+func (s *AdminSuite) TestPause() {
+	p := newAdminTestPipeline()
+	handler := newAdminHandler(p, testAdminToken)
+	request := func(target string) {
+		req := httptest.NewRequest("POST", target, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	request("/pause")
+	assert.True(s.T(), p.pause.IsPaused())
+
+	resumed := make(chan bool)
+	go func() {
+		resumed <- p.pause.Wait(context.Background())
+	}()
+	select {
+	case <-resumed:
+		s.T().Fatal("consumer did not wait while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	request("/resume")
+	assert.False(s.T(), p.pause.IsPaused())
+	assert.True(s.T(), <-resumed)
+
+	// a paused consumer still stops on shutdown
+	request("/pause")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(s.T(), p.pause.Wait(ctx))
+}
+
+func (s *AdminSuite) TestDeliveries() {
+	dir, err := ioutil.TempDir("", "gomail-delivery-log")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	deliveryLog, err = NewDeliveryLog(DeliveryLogConfig{Type: deliveryLogFile, Path: filepath.Join(dir, "deliveries.ndjson")})
+	s.Require().NoError(err)
+	defer func() {
+		deliveryLog.Close()
+		deliveryLog = nopDeliveryLog{}
+	}()
+	delivery := Delivery{QueueMessageId: "queue-1", Provider: "SES", ProviderMessageId: "ses-1", SentAt: time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)}
+	s.Require().NoError(deliveryLog.Record(delivery))
+
+	testCases := []struct {
+		Case   string
+		Target string
+
+		ExpectedStatusCode int
+		ExpectedDeliveries []Delivery
+	}{
+		{
+			Case:               "Queue message id",
+			Target:             "/deliveries/queue-1",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedDeliveries: []Delivery{delivery},
+		},
+		{
+			Case:               "Provider message id",
+			Target:             "/deliveries/ses-1",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedDeliveries: []Delivery{delivery},
+		},
+		{
+			Case:               "Unknown id",
+			Target:             "/deliveries/queue-2",
+			ExpectedStatusCode: http.StatusNotFound,
+		},
+	}
+
+	handler := newAdminHandler(newAdminTestPipeline(), testAdminToken)
+	for _, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", testCase.Target, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(s.T(), testCase.ExpectedStatusCode, recorder.Code, testCase.Case)
+		if testCase.ExpectedStatusCode == http.StatusOK {
+			var deliveries []Delivery
+			assert.NoError(s.T(), json.Unmarshal(recorder.Body.Bytes(), &deliveries), testCase.Case)
+			assert.Equal(s.T(), testCase.ExpectedDeliveries, deliveries, testCase.Case)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	visibilityTimeoutSafetyFactor = 0.5
+)
+
+// inFlight limits how many messages the pipeline holds at the same time, from the moment
+// they are received until they are acknowledged.
+var inFlight *budget
+
+// budget is a counting semaphore that lets its callers take several slots at once, and
+// shares its slots fairly between queues. Every queue is entitled to a share of the
+// slots that matches its weight. A queue can use the slots other queues leave unused,
+// but as soon as a queue holding less than its share is waiting for slots, released
+// slots go to it first. This way a backlog in one queue cannot hold up the others.
+type budget struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	capacity  int
+	available int
+	closed    bool
+
+	weights     map[string]int
+	totalWeight int
+	held        map[string]int
+	waiting     map[string]int
+}
+
+// newBudget creates a budget of capacity slots, shared between queues according to
+// weights. Queues without a weight have a weight of 1.
+func newBudget(capacity int, weights map[string]int) *budget {
+	b := &budget{
+		capacity:  capacity,
+		available: capacity,
+		weights:   weights,
+		held:      make(map[string]int),
+		waiting:   make(map[string]int),
+	}
+	for _, weight := range weights {
+		b.totalWeight += weight
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *budget) weight(queueUrl string) int {
+	if weight, ok := b.weights[queueUrl]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// share returns the number of slots a queue is entitled to, which is at least 1.
+func (b *budget) share(queueUrl string) int {
+	if b.totalWeight == 0 {
+		return b.capacity
+	}
+	share := b.capacity * b.weight(queueUrl) / b.totalWeight
+	if share < 1 {
+		share = 1
+	}
+	return share
+}
+
+// starved reports whether a queue other than queueUrl is waiting for slots while
+// holding less than its share.
+func (b *budget) starved(queueUrl string) bool {
+	for q, waiting := range b.waiting {
+		if q != queueUrl && waiting > 0 && b.held[q] < b.share(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// Acquire blocks until at least one slot is available to a queue, and takes up to max
+// slots for it. It returns the number of slots taken, which is 0 once the budget is
+// closed.
+func (b *budget) Acquire(queueUrl string, max int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.waiting[queueUrl]++
+	for !b.closed && (b.available == 0 || (b.held[queueUrl] >= b.share(queueUrl) && b.starved(queueUrl))) {
+		b.cond.Wait()
+	}
+	b.waiting[queueUrl]--
+	if b.closed {
+		return 0
+	}
+
+	n := max
+	if n > b.available {
+		n = b.available
+	}
+	// leave the rest to the queues that are short of their share
+	if left := b.share(queueUrl) - b.held[queueUrl]; n > left && left > 0 && b.starved(queueUrl) {
+		n = left
+	}
+	b.available -= n
+	b.held[queueUrl] += n
+	return n
+}
+
+// Release gives back n slots taken for a queue.
+func (b *budget) Release(queueUrl string, n int) {
+	if n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.available += n
+	b.held[queueUrl] -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// Close wakes up all callers waiting in Acquire, and makes further calls return
+// immediately without taking any slots.
+func (b *budget) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// InFlight returns the number of slots currently taken.
+func (b *budget) InFlight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.capacity - b.available
+}
+
+// Held returns the number of slots taken for a queue, and the share it is entitled to.
+func (b *budget) Held(queueUrl string) (held int, share int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.held[queueUrl], b.share(queueUrl)
+}
+
+// inFlightCapacity calculates the in-flight budget: max_in_flight_messages, lowered so
+// that all messages held by the pipeline can be sent within half of the shortest
+// visibility timeout at the combined rate of all workers. Otherwise messages would be
+// received faster than they can be sent, and would become visible again while still
+// waiting for their turn.
+func inFlightCapacity(workers []*worker, visibilityTimeouts map[string]int64) int {
+	capacity := config.MaxInFlightMessages
+
+	var sendsPerSecond float64
+	for _, w := range workers {
+		rate := w.limiter.Rate()
+		if rate == 0 {
+			// at least one worker has no rate limit to estimate from
+			return capacity
+		}
+		sendsPerSecond += rate
+	}
+
+	for _, visibilityTimeout := range visibilityTimeouts {
+		sendable := int(sendsPerSecond * float64(visibilityTimeout) * visibilityTimeoutSafetyFactor)
+		if sendable < 1 {
+			sendable = 1
+		}
+		if sendable < capacity {
+			capacity = sendable
+		}
+	}
+	return capacity
+}
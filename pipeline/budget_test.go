@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type BudgetSuite struct {
+	suite.Suite
+}
+
+func TestBudgetSuite(t *testing.T) {
+	suite.Run(t, new(BudgetSuite))
+}
+
+func (s *BudgetSuite) TestAcquire() {
+	b := newBudget(15, nil)
+	assert.Equal(s.T(), 10, b.Acquire("a", 10))
+	assert.Equal(s.T(), 5, b.Acquire("a", 10))
+	assert.Equal(s.T(), 15, b.InFlight())
+
+	acquired := make(chan int)
+	go func() {
+		acquired <- b.Acquire("a", 10)
+	}()
+	select {
+	case <-acquired:
+		s.T().Fatal("Acquire should block while the budget is used up")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Release("a", 3)
+	assert.Equal(s.T(), 3, <-acquired)
+}
+
+func (s *BudgetSuite) TestFairShare() {
+	b := newBudget(20, map[string]int{"busy": 1, "quiet": 3})
+	held := func(queueUrl string) int {
+		held, _ := b.Held(queueUrl)
+		return held
+	}
+	waitForAcquire := func(queueUrl string) {
+		for {
+			b.mu.Lock()
+			waiting := b.waiting[queueUrl]
+			b.mu.Unlock()
+			if waiting > 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// a queue can use the whole budget while the others are idle
+	assert.Equal(s.T(), 10, b.Acquire("busy", 10))
+	assert.Equal(s.T(), 10, b.Acquire("busy", 10))
+
+	// once another queue is short of its share, released slots go to it first
+	acquired := make(chan int)
+	go func() {
+		acquired <- b.Acquire("quiet", 10)
+	}()
+	waitForAcquire("quiet")
+	busy := make(chan int)
+	go func() {
+		busy <- b.Acquire("busy", 10)
+	}()
+	waitForAcquire("busy")
+
+	b.Release("busy", 4)
+	assert.Equal(s.T(), 4, <-acquired)
+	go func() {
+		acquired <- b.Acquire("quiet", 20)
+	}()
+	waitForAcquire("quiet")
+	b.Release("busy", 12)
+	assert.Equal(s.T(), 11, <-acquired)
+	assert.Equal(s.T(), 15, held("quiet"))
+	_, share := b.Held("quiet")
+	assert.Equal(s.T(), 15, share)
+
+	// the busy queue gets what is left once the quiet one has its share
+	assert.Equal(s.T(), 1, <-busy)
+	assert.Equal(s.T(), 5, held("busy"))
+}
+
+func (s *BudgetSuite) TestInFlightCapacity() {
+	testCases := []struct {
+		Case               string
+		MaxInFlight        int
+		Rates              []float64
+		VisibilityTimeouts map[string]int64
+		ExpectedCapacity   int
+	}{
+		{
+			Case:               "Limited by send rate",
+			MaxInFlight:        1000,
+			Rates:              []float64{1, 10},
+			VisibilityTimeouts: map[string]int64{"a": 30, "b": 60},
+			ExpectedCapacity:   165,
+		},
+		{
+			Case:               "Limited by configuration",
+			MaxInFlight:        100,
+			Rates:              []float64{1, 10},
+			VisibilityTimeouts: map[string]int64{"a": 30},
+			ExpectedCapacity:   100,
+		},
+		{
+			Case:               "Unlimited worker",
+			MaxInFlight:        1000,
+			Rates:              []float64{1, 0},
+			VisibilityTimeouts: map[string]int64{"a": 30},
+			ExpectedCapacity:   1000,
+		},
+		{
+			Case:               "Zero visibility timeout",
+			MaxInFlight:        1000,
+			Rates:              []float64{1},
+			VisibilityTimeouts: map[string]int64{"a": 0},
+			ExpectedCapacity:   1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		config = &Config{MaxInFlightMessages: testCase.MaxInFlight}
+		workers := make([]*worker, len(testCase.Rates))
+		for i, rate := range testCase.Rates {
+			workers[i] = newWorker("", &nopWorker{}, ProviderConfig{MaxConcurrency: 1, MaxSendsPerSecond: rate})
+		}
+
+		capacity := inFlightCapacity(workers, testCase.VisibilityTimeouts)
+		assert.Equal(s.T(), testCase.ExpectedCapacity, capacity, testCase.Case)
+	}
+}
@@ -3,36 +3,685 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
+
+	"gomail/queue"
 
 	"gopkg.in/yaml.v2"
 )
 
+type QueueConfig struct {
+	Url                string `yaml:"url"`
+	DeadLetterQueueUrl string `yaml:"dead_letter_queue_url"`
+	// high, normal (the default) or low
+	Priority string `yaml:"priority"`
+	// share of the in-flight budget the queue gets while other queues are busy, relative
+	// to the weights of the other queues (defaults to 1)
+	Weight int `yaml:"weight"`
+}
+
+// ProviderConfig holds the settings shared by all email providers.
+type ProviderConfig struct {
+	MaxConcurrency    int     `yaml:"max_concurrency"`
+	MaxSendsPerSecond float64 `yaml:"max_sends_per_second"`
+	// emails that may be sent per UTC day and per UTC calendar month by all pipeline
+	// nodes together, 0 means unlimited
+	DailyBudget   int64 `yaml:"daily_budget"`
+	MonthlyBudget int64 `yaml:"monthly_budget"`
+}
+
+func (c *ProviderConfig) setDefaults(defaults ProviderConfig) {
+	if c.MaxConcurrency == 0 {
+		c.MaxConcurrency = defaults.MaxConcurrency
+	}
+	if c.MaxSendsPerSecond == 0 {
+		c.MaxSendsPerSecond = defaults.MaxSendsPerSecond
+	}
+}
+
+func (c ProviderConfig) validate(name string) error {
+	if c.MaxConcurrency < 0 {
+		return fmt.Errorf("%s.max_concurrency is invalid", name)
+	}
+	if c.MaxSendsPerSecond < 0 {
+		return fmt.Errorf("%s.max_sends_per_second is invalid", name)
+	}
+	if c.DailyBudget < 0 {
+		return fmt.Errorf("%s.daily_budget is invalid", name)
+	}
+	if c.MonthlyBudget < 0 {
+		return fmt.Errorf("%s.monthly_budget is invalid", name)
+	}
+	return nil
+}
+
+// SESConfig configures the SES provider.
+type SESConfig struct {
+	ProviderConfig `yaml:",inline"`
+	// the configuration set emails are sent with, which publishes their tags to the
+	// event destinations of the set
+	ConfigurationSet string `yaml:"configuration_set"`
+}
+
+// SMTPConfig configures the relay the SMTP provider delivers through.
+type SMTPConfig struct {
+	ProviderConfig `yaml:",inline"`
+	Host           string `yaml:"host"`
+	Port           int    `yaml:"port"`
+	// none, starttls or implicit
+	TLS string `yaml:"tls"`
+	// none, plain, login or cram-md5
+	Auth               string `yaml:"auth"`
+	Username           string `yaml:"username"`
+	Password           string `yaml:"password"`
+	TimeoutSeconds     int64  `yaml:"timeout_seconds"`
+	IdleTimeoutSeconds int64  `yaml:"idle_timeout_seconds"`
+}
+
+func (c *SMTPConfig) setDefaults() {
+	c.ProviderConfig.setDefaults(defaultSMTPConfig)
+	if c.TLS == "" {
+		c.TLS = smtpTLSStartTLS
+	}
+	if c.Port == 0 {
+		if c.TLS == smtpTLSImplicit {
+			c.Port = defaultSMTPImplicitTLSPort
+		} else {
+			c.Port = defaultSMTPPort
+		}
+	}
+	if c.Auth == "" {
+		if c.Username != "" {
+			c.Auth = smtpAuthPlain
+		} else {
+			c.Auth = smtpAuthNone
+		}
+	}
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = defaultSMTPTimeoutSeconds
+	}
+	if c.IdleTimeoutSeconds == 0 {
+		c.IdleTimeoutSeconds = defaultSMTPIdleTimeoutSeconds
+	}
+}
+
+func (c SMTPConfig) validate() error {
+	if err := c.ProviderConfig.validate("smtp"); err != nil {
+		return err
+	}
+	if c.Host == "" {
+		return fmt.Errorf("smtp.host is missing")
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("smtp.port is invalid")
+	}
+	switch c.TLS {
+	case smtpTLSNone, smtpTLSStartTLS, smtpTLSImplicit:
+	default:
+		return fmt.Errorf("smtp.tls must be one of none, starttls or implicit")
+	}
+	switch c.Auth {
+	case smtpAuthNone:
+	case smtpAuthPlain, smtpAuthLogin, smtpAuthCRAMMD5:
+		if c.Username == "" {
+			return fmt.Errorf("smtp.username is required for %s authentication", c.Auth)
+		}
+	default:
+		return fmt.Errorf("smtp.auth must be one of none, plain, login or cram-md5")
+	}
+	if c.TimeoutSeconds < 0 {
+		return fmt.Errorf("smtp.timeout_seconds is invalid")
+	}
+	if c.IdleTimeoutSeconds < 0 {
+		return fmt.Errorf("smtp.idle_timeout_seconds is invalid")
+	}
+	return nil
+}
+
+// MailgunConfig configures the Mailgun domain the Mailgun provider sends from.
+type MailgunConfig struct {
+	ProviderConfig `yaml:",inline"`
+	Domain         string `yaml:"domain"`
+	ApiKey         string `yaml:"api_key"`
+	// us or eu, depending on where the domain was created
+	Region         string `yaml:"region"`
+	TimeoutSeconds int64  `yaml:"timeout_seconds"`
+}
+
+func (c *MailgunConfig) setDefaults() {
+	c.ProviderConfig.setDefaults(defaultMailgunConfig)
+	if c.Region == "" {
+		c.Region = mailgunRegionUS
+	}
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = defaultMailgunTimeoutSeconds
+	}
+}
+
+func (c MailgunConfig) validate() error {
+	if err := c.ProviderConfig.validate("mailgun"); err != nil {
+		return err
+	}
+	if c.Domain == "" {
+		return fmt.Errorf("mailgun.domain is missing")
+	}
+	if c.ApiKey == "" {
+		return fmt.Errorf("mailgun.api_key is missing")
+	}
+	if _, ok := mailgunBaseUrls[c.Region]; !ok {
+		return fmt.Errorf("mailgun.region must be one of us or eu")
+	}
+	if c.TimeoutSeconds < 0 {
+		return fmt.Errorf("mailgun.timeout_seconds is invalid")
+	}
+	return nil
+}
+
+// WebhookConfig configures the in-house delivery service the webhook provider posts
+// emails to.
+type WebhookConfig struct {
+	ProviderConfig `yaml:",inline"`
+	Url            string `yaml:"url"`
+	// key of the HMAC signature of every request
+	Secret         string `yaml:"secret"`
+	TimeoutSeconds int64  `yaml:"timeout_seconds"`
+}
+
+func (c *WebhookConfig) setDefaults() {
+	c.ProviderConfig.setDefaults(defaultWebhookConfig)
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = defaultWebhookTimeoutSeconds
+	}
+}
+
+func (c WebhookConfig) validate() error {
+	if err := c.ProviderConfig.validate("webhook"); err != nil {
+		return err
+	}
+	u, err := url.Parse(c.Url)
+	if c.Url == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook.url must be an http or https url")
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("webhook.secret is missing")
+	}
+	if c.TimeoutSeconds < 0 {
+		return fmt.Errorf("webhook.timeout_seconds is invalid")
+	}
+	return nil
+}
+
+// FileConfig configures the directory the file provider writes emails to, and the
+// failures it simulates.
+type FileConfig struct {
+	ProviderConfig `yaml:",inline"`
+	Directory      string `yaml:"directory"`
+	// eml or maildir
+	Format string `yaml:"format"`
+	// share of sends that fail, between 0 and 1
+	FailureRate         float64 `yaml:"failure_rate"`
+	LatencyMilliseconds int64   `yaml:"latency_milliseconds"`
+}
+
+func (c *FileConfig) setDefaults() {
+	c.ProviderConfig.setDefaults(defaultFileConfig)
+	if c.Format == "" {
+		c.Format = fileFormatEml
+	}
+}
+
+func (c FileConfig) validate() error {
+	if err := c.ProviderConfig.validate("file"); err != nil {
+		return err
+	}
+	if c.Directory == "" {
+		return fmt.Errorf("file.directory is missing")
+	}
+	if c.Format != fileFormatEml && c.Format != fileFormatMaildir {
+		return fmt.Errorf("file.format must be one of eml or maildir")
+	}
+	if c.FailureRate < 0 || c.FailureRate > 1 {
+		return fmt.Errorf("file.failure_rate must be between 0 and 1")
+	}
+	if c.LatencyMilliseconds < 0 {
+		return fmt.Errorf("file.latency_milliseconds is invalid")
+	}
+	return nil
+}
+
+// hasBudget reports whether the provider has a daily or monthly send budget.
+func (c ProviderConfig) hasBudget() bool {
+	return c.DailyBudget > 0 || c.MonthlyBudget > 0
+}
+
+// AdminConfig configures the admin listener. The listener is only started if a port
+// is set.
+type AdminConfig struct {
+	Port  int    `yaml:"port"`
+	Token string `yaml:"token"`
+}
+
 type Config struct {
-	AwsRegion                            string   `yaml:"aws_region"`
-	AwsClientTimeoutSeconds              int64    `yaml:"aws_client_timeout_seconds"`
-	MinimumIterationDurationMilliseconds int64    `yaml:"minimum_iteration_duration_milliseconds"`
-	HealthyThreshold                     int      `yaml:"healthy_threshold"`
-	UnhealthyThreshold                   int      `yaml:"unhealthy_threshold"`
-	SendgridApiKey                       string   `yaml:"sendgrid_api_key"`
-	QueueUrls                            []string `yaml:"queue_urls"`
+	AwsRegion                       string             `yaml:"aws_region"`
+	AwsClientTimeoutSeconds         int64              `yaml:"aws_client_timeout_seconds"`
+	HealthCheckIntervalMilliseconds int64              `yaml:"health_check_interval_milliseconds"`
+	HealthyThreshold                int                `yaml:"healthy_threshold"`
+	UnhealthyThreshold              int                `yaml:"unhealthy_threshold"`
+	Providers                       []string           `yaml:"providers"`
+	SendgridApiKey                  string             `yaml:"sendgrid_api_key"`
+	SES                             SESConfig          `yaml:"ses"`
+	Sendgrid                        ProviderConfig     `yaml:"sendgrid"`
+	SMTP                            SMTPConfig         `yaml:"smtp"`
+	Mailgun                         MailgunConfig      `yaml:"mailgun"`
+	Webhook                         WebhookConfig      `yaml:"webhook"`
+	File                            FileConfig         `yaml:"file"`
+	QueueBackend                    queue.Config       `yaml:"queue_backend"`
+	DeliveryLog                     DeliveryLogConfig  `yaml:"delivery_log"`
+	CounterStore                    CounterStoreConfig `yaml:"counter_store"`
+	QueueUrls                       []string           `yaml:"queue_urls"`
+	Queues                          []QueueConfig      `yaml:"queues"`
+	PriorityWeights                 PriorityWeights    `yaml:"priority_weights"`
+	RoutingRules                    []RoutingRule      `yaml:"routing_rules"`
+	ConsumersPerQueue               int                `yaml:"consumers_per_queue"`
+	WaitTimeSeconds                 int64              `yaml:"wait_time_seconds"`
+	MessageBufferSize               int                `yaml:"message_buffer_size"`
+	MaxInFlightMessages             int                `yaml:"max_in_flight_messages"`
+	AckFlushIntervalMilliseconds    int64              `yaml:"ack_flush_interval_milliseconds"`
+	AckMaxRetries                   int                `yaml:"ack_max_retries"`
+	ShutdownTimeoutSeconds          int64              `yaml:"shutdown_timeout_seconds"`
+	RetryBaseDelaySeconds           int64              `yaml:"retry_base_delay_seconds"`
+	RetryMaxDelaySeconds            int64              `yaml:"retry_max_delay_seconds"`
+	MaxAttempts                     int                `yaml:"max_attempts"`
+	MaxFailuresPerProvider          int                `yaml:"max_failures_per_provider"`
+	DefaultTTLSeconds               DefaultTTLConfig   `yaml:"default_ttl_seconds"`
+	Admin                           AdminConfig        `yaml:"admin"`
+}
+
+const (
+	defaultHealthCheckIntervalMilliseconds = 5000
+	defaultConsumersPerQueue               = 2
+	defaultWaitTimeSeconds                 = 20
+	defaultMessageBufferSize               = 100
+	defaultMaxInFlightMessages             = 1000
+	defaultAckFlushIntervalMilliseconds    = 200
+	defaultAckMaxRetries                   = 3
+	defaultShutdownTimeoutSeconds          = 20
+	defaultRetryBaseDelaySeconds           = 10
+	defaultRetryMaxDelaySeconds            = 900
+	defaultMaxAttempts                     = 10
+	defaultMaxFailuresPerProvider          = 3
+	defaultQueueWeight                     = 1
+
+	defaultSMTPPort               = 587
+	defaultSMTPImplicitTLSPort    = 465
+	defaultSMTPTimeoutSeconds     = 30
+	defaultSMTPIdleTimeoutSeconds = 60
+	defaultWebhookTimeoutSeconds  = 30
+	defaultMailgunTimeoutSeconds  = 30
+
+	// SQS does not accept visibility timeouts longer than 12 hours
+	maxVisibilityTimeoutSeconds = 43200
+	// SQS does not long-poll for longer than 20 seconds
+	maxWaitTimeSeconds = 20
+)
+
+// providers that can be enabled through the providers setting
+const (
+	providerSES      = "ses"
+	providerSendgrid = "sendgrid"
+	providerSMTP     = "smtp"
+	providerMailgun  = "mailgun"
+	providerWebhook  = "webhook"
+	providerFile     = "file"
+)
+
+const (
+	smtpTLSNone     = "none"
+	smtpTLSStartTLS = "starttls"
+	smtpTLSImplicit = "implicit"
+
+	smtpAuthNone    = "none"
+	smtpAuthPlain   = "plain"
+	smtpAuthLogin   = "login"
+	smtpAuthCRAMMD5 = "cram-md5"
+)
+
+var (
+	defaultProviders = []string{providerSendgrid, providerSES}
+
+	// a new SES account is limited to 1 email per second until it leaves the sandbox
+	defaultSESConfig = ProviderConfig{
+		MaxConcurrency:    1,
+		MaxSendsPerSecond: 1,
+	}
+	defaultSendgridConfig = ProviderConfig{
+		MaxConcurrency:    10,
+		MaxSendsPerSecond: 10,
+	}
+	defaultSMTPConfig = ProviderConfig{
+		MaxConcurrency:    5,
+		MaxSendsPerSecond: 5,
+	}
+	defaultMailgunConfig = ProviderConfig{
+		MaxConcurrency:    10,
+		MaxSendsPerSecond: 10,
+	}
+	defaultWebhookConfig = ProviderConfig{
+		MaxConcurrency:    10,
+		MaxSendsPerSecond: 10,
+	}
+	defaultFileConfig = ProviderConfig{
+		MaxConcurrency:    10,
+		MaxSendsPerSecond: 10,
+	}
+)
+
+func (c *Config) setDefaults() {
+	// queue_urls is a shorthand for queues without any extra settings
+	for _, queueUrl := range c.QueueUrls {
+		c.Queues = append(c.Queues, QueueConfig{Url: queueUrl})
+	}
+	c.QueueUrls = nil
+	for i := range c.Queues {
+		if c.Queues[i].Priority == "" {
+			c.Queues[i].Priority = priorityNormal
+		}
+		if c.Queues[i].Weight == 0 {
+			c.Queues[i].Weight = defaultQueueWeight
+		}
+	}
+	if c.PriorityWeights.High == 0 {
+		c.PriorityWeights.High = defaultPriorityWeights.High
+	}
+	if c.PriorityWeights.Normal == 0 {
+		c.PriorityWeights.Normal = defaultPriorityWeights.Normal
+	}
+	if c.PriorityWeights.Low == 0 {
+		c.PriorityWeights.Low = defaultPriorityWeights.Low
+	}
+
+	if len(c.Providers) == 0 {
+		c.Providers = defaultProviders
+	}
+	c.QueueBackend.SetDefaults()
+	c.DeliveryLog.SetDefaults()
+	c.CounterStore.SetDefaults()
+	if c.HealthCheckIntervalMilliseconds == 0 {
+		c.HealthCheckIntervalMilliseconds = defaultHealthCheckIntervalMilliseconds
+	}
+	if c.ConsumersPerQueue == 0 {
+		c.ConsumersPerQueue = defaultConsumersPerQueue
+	}
+	if c.WaitTimeSeconds == 0 {
+		c.WaitTimeSeconds = defaultWaitTimeSeconds
+	}
+	if c.MessageBufferSize == 0 {
+		c.MessageBufferSize = defaultMessageBufferSize
+	}
+	if c.MaxInFlightMessages == 0 {
+		c.MaxInFlightMessages = defaultMaxInFlightMessages
+	}
+	c.SES.ProviderConfig.setDefaults(defaultSESConfig)
+	c.Sendgrid.setDefaults(defaultSendgridConfig)
+	if c.ProviderEnabled(providerSMTP) {
+		c.SMTP.setDefaults()
+	}
+	if c.ProviderEnabled(providerMailgun) {
+		c.Mailgun.setDefaults()
+	}
+	if c.ProviderEnabled(providerWebhook) {
+		c.Webhook.setDefaults()
+	}
+	if c.ProviderEnabled(providerFile) {
+		c.File.setDefaults()
+	}
+	if c.AckFlushIntervalMilliseconds == 0 {
+		c.AckFlushIntervalMilliseconds = defaultAckFlushIntervalMilliseconds
+	}
+	if c.AckMaxRetries == 0 {
+		c.AckMaxRetries = defaultAckMaxRetries
+	}
+	if c.ShutdownTimeoutSeconds == 0 {
+		c.ShutdownTimeoutSeconds = defaultShutdownTimeoutSeconds
+	}
+	if c.RetryBaseDelaySeconds == 0 {
+		c.RetryBaseDelaySeconds = defaultRetryBaseDelaySeconds
+	}
+	if c.RetryMaxDelaySeconds == 0 {
+		c.RetryMaxDelaySeconds = defaultRetryMaxDelaySeconds
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = defaultMaxAttempts
+	}
+	if c.MaxFailuresPerProvider == 0 {
+		c.MaxFailuresPerProvider = defaultMaxFailuresPerProvider
+	}
 }
 
 func (c Config) validate() error {
-	if c.AwsRegion == "" {
+	if err := c.QueueBackend.Validate(); err != nil {
+		return err
+	}
+	if err := c.DeliveryLog.Validate(); err != nil {
+		return err
+	}
+
+	// AWS is only needed for SQS queues and sending through SES
+	if c.AwsRegion == "" && (c.QueueBackend.Type == queue.BackendSQS || c.ProviderEnabled(providerSES)) {
 		return fmt.Errorf("aws_region is missing")
 	}
 
-	if c.SendgridApiKey == "" {
+	seen := make(map[string]bool, len(c.Providers))
+	for _, provider := range c.Providers {
+		switch provider {
+		case providerSES, providerSendgrid, providerSMTP, providerMailgun, providerWebhook, providerFile:
+		default:
+			return fmt.Errorf("providers contains unknown provider %s", provider)
+		}
+		if seen[provider] {
+			return fmt.Errorf("providers contains %s more than once", provider)
+		}
+		seen[provider] = true
+	}
+
+	for i, rule := range c.RoutingRules {
+		if err := rule.validate(fmt.Sprintf("routing_rules[%d]", i), c); err != nil {
+			return err
+		}
+	}
+
+	if c.ProviderEnabled(providerSendgrid) && c.SendgridApiKey == "" {
 		return fmt.Errorf("sendgrid_api_key is missing")
 	}
 
-	if len(c.QueueUrls) == 0 {
-		return fmt.Errorf("queue_urls must contain at least one value")
+	if len(c.Queues) == 0 {
+		return fmt.Errorf("queues (or queue_urls) must contain at least one queue")
+	}
+
+	for _, q := range c.Queues {
+		if q.Url == "" {
+			return fmt.Errorf("queues must all have a url")
+		}
+		if q.DeadLetterQueueUrl == q.Url {
+			return fmt.Errorf("dead_letter_queue_url of %s must be a different queue", q.Url)
+		}
+		// SQS only moves messages of a FIFO queue to another FIFO queue, and vice versa
+		if q.DeadLetterQueueUrl != "" && queue.IsFIFO(q.DeadLetterQueueUrl) != queue.IsFIFO(q.Url) {
+			return fmt.Errorf("dead_letter_queue_url of %s must be a FIFO queue if and only if the queue is", q.Url)
+		}
+		if q.Weight < 0 {
+			return fmt.Errorf("weight of %s is invalid", q.Url)
+		}
+		if !isPriority(q.Priority) {
+			return fmt.Errorf("priority of %s must be one of high, normal or low", q.Url)
+		}
+	}
+
+	for _, priority := range priorities {
+		if c.PriorityWeights.weight(priority) < 0 {
+			return fmt.Errorf("priority_weights.%s is invalid", priority)
+		}
+	}
+
+	if c.HealthCheckIntervalMilliseconds < 0 {
+		return fmt.Errorf("health_check_interval_milliseconds is invalid")
+	}
+
+	if c.ConsumersPerQueue < 0 {
+		return fmt.Errorf("consumers_per_queue is invalid")
+	}
+
+	if c.WaitTimeSeconds < 0 || c.WaitTimeSeconds > maxWaitTimeSeconds {
+		return fmt.Errorf("wait_time_seconds must be between 1 and %d", maxWaitTimeSeconds)
+	}
+
+	// a long poll must not be cut short by the http client
+	if c.AwsClientTimeoutSeconds > 0 && c.AwsClientTimeoutSeconds <= c.WaitTimeSeconds {
+		return fmt.Errorf("aws_client_timeout_seconds must be greater than wait_time_seconds")
+	}
+
+	if c.MessageBufferSize < 0 {
+		return fmt.Errorf("message_buffer_size is invalid")
+	}
+
+	if c.MaxInFlightMessages < 0 {
+		return fmt.Errorf("max_in_flight_messages is invalid")
+	}
+
+	if err := c.SES.ProviderConfig.validate("ses"); err != nil {
+		return err
+	}
+
+	if err := c.Sendgrid.validate("sendgrid"); err != nil {
+		return err
+	}
+
+	if c.ProviderEnabled(providerSMTP) {
+		if err := c.SMTP.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.ProviderEnabled(providerMailgun) {
+		if err := c.Mailgun.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.ProviderEnabled(providerWebhook) {
+		if err := c.Webhook.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.ProviderEnabled(providerFile) {
+		if err := c.File.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.AckFlushIntervalMilliseconds < 0 {
+		return fmt.Errorf("ack_flush_interval_milliseconds is invalid")
+	}
+
+	if c.AckMaxRetries < 0 {
+		return fmt.Errorf("ack_max_retries is invalid")
+	}
+
+	if c.ShutdownTimeoutSeconds < 0 {
+		return fmt.Errorf("shutdown_timeout_seconds is invalid")
+	}
+
+	if c.RetryBaseDelaySeconds < 0 {
+		return fmt.Errorf("retry_base_delay_seconds is invalid")
+	}
+
+	if c.RetryMaxDelaySeconds < c.RetryBaseDelaySeconds || c.RetryMaxDelaySeconds > maxVisibilityTimeoutSeconds {
+		return fmt.Errorf("retry_max_delay_seconds must be between retry_base_delay_seconds and %d", maxVisibilityTimeoutSeconds)
+	}
+
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("max_attempts is invalid")
+	}
+
+	if c.MaxFailuresPerProvider < 0 {
+		return fmt.Errorf("max_failures_per_provider is invalid")
+	}
+
+	for _, priority := range priorities {
+		if c.DefaultTTLSeconds.ttlSeconds(priority) < 0 {
+			return fmt.Errorf("default_ttl_seconds.%s is invalid", priority)
+		}
+	}
+
+	// the counter store is only needed to keep the send budgets
+	if c.HasSendBudgets() {
+		if err := c.CounterStore.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Admin.Port < 0 || c.Admin.Port > 65535 {
+		return fmt.Errorf("admin.port is invalid")
+	}
+
+	// the admin listener can stop all sending, it must never be left open
+	if c.Admin.Port > 0 && c.Admin.Token == "" {
+		return fmt.Errorf("admin.token is required when admin.port is set")
 	}
 
 	return nil
 }
 
+// ProviderEnabled reports whether the given provider is listed in providers.
+func (c Config) ProviderEnabled(provider string) bool {
+	for _, p := range c.Providers {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// ProviderConfig returns the settings shared by all providers of an enabled provider.
+func (c Config) ProviderConfig(provider string) ProviderConfig {
+	switch provider {
+	case providerSES:
+		return c.SES.ProviderConfig
+	case providerSendgrid:
+		return c.Sendgrid
+	case providerSMTP:
+		return c.SMTP.ProviderConfig
+	case providerMailgun:
+		return c.Mailgun.ProviderConfig
+	case providerWebhook:
+		return c.Webhook.ProviderConfig
+	case providerFile:
+		return c.File.ProviderConfig
+	}
+	return ProviderConfig{}
+}
+
+// HasSendBudgets reports whether any enabled provider has a send budget.
+func (c Config) HasSendBudgets() bool {
+	for _, provider := range c.Providers {
+		if c.ProviderConfig(provider).hasBudget() {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue returns the settings of the queue with the given url.
+func (c Config) Queue(queueUrl string) QueueConfig {
+	for _, queue := range c.Queues {
+		if queue.Url == queueUrl {
+			return queue
+		}
+	}
+	return QueueConfig{Url: queueUrl}
+}
+
 func NewConfig(filePath string) (*Config, error) {
 	contents, err := ioutil.ReadFile(filePath)
 	if err != nil {
@@ -43,6 +692,7 @@ func NewConfig(filePath string) (*Config, error) {
 	if err = yaml.Unmarshal(contents, &config); err != nil {
 		return nil, err
 	}
+	config.setDefaults()
 	if err = config.validate(); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigSuite struct {
+	suite.Suite
+}
+
+func TestConfigSuite(t *testing.T) {
+	suite.Run(t, new(ConfigSuite))
+}
+
+func (s *ConfigSuite) TestConfig() {
+	testCases := []struct {
+		Case          string
+		FilePath      string
+		ExpectedError error
+	}{
+		{
+			Case:          "Valid config",
+			FilePath:      "fixtures/config_valid.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Valid config with queue_urls",
+			FilePath:      "fixtures/config_queue_urls.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Valid config with smtp provider and no sendgrid_api_key",
+			FilePath:      "fixtures/config_smtp.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Valid config with mailgun provider",
+			FilePath:      "fixtures/config_mailgun.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Valid config with webhook provider",
+			FilePath:      "fixtures/config_webhook.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Valid config with file provider",
+			FilePath:      "fixtures/config_file.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Valid config with disk queue backend and no aws_region",
+			FilePath:      "fixtures/config_disk_queue_backend.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Valid config with routing rules",
+			FilePath:      "fixtures/config_routing_rules.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Missing config file",
+			FilePath:      "fixtures/missing_config.yaml",
+			ExpectedError: fmt.Errorf("no such file or directory"),
+		},
+		{
+			Case:          "Missing sendgrid_api_key",
+			FilePath:      "fixtures/config_missing_sendgrid_api_key.yaml",
+			ExpectedError: fmt.Errorf("sendgrid_api_key is missing"),
+		},
+		{
+			Case:          "Empty queue_urls",
+			FilePath:      "fixtures/config_empty_queue_urls.yaml",
+			ExpectedError: fmt.Errorf("queues (or queue_urls) must contain at least one queue"),
+		},
+		{
+			Case:          "Dead letter queue same as source queue",
+			FilePath:      "fixtures/config_same_dead_letter_queue.yaml",
+			ExpectedError: fmt.Errorf("must be a different queue"),
+		},
+		{
+			Case:          "Standard dead letter queue for FIFO queue",
+			FilePath:      "fixtures/config_fifo_standard_dead_letter_queue.yaml",
+			ExpectedError: fmt.Errorf("must be a FIFO queue if and only if the queue is"),
+		},
+		{
+			Case:          "Invalid wait_time_seconds",
+			FilePath:      "fixtures/config_invalid_wait_time.yaml",
+			ExpectedError: fmt.Errorf("wait_time_seconds must be between 1 and 20"),
+		},
+		{
+			Case:          "AWS client timeout shorter than long poll",
+			FilePath:      "fixtures/config_short_client_timeout.yaml",
+			ExpectedError: fmt.Errorf("aws_client_timeout_seconds must be greater than wait_time_seconds"),
+		},
+		{
+			Case:          "Admin port without token",
+			FilePath:      "fixtures/config_admin_missing_token.yaml",
+			ExpectedError: fmt.Errorf("admin.token is required when admin.port is set"),
+		},
+		{
+			Case:          "Unknown provider",
+			FilePath:      "fixtures/config_unknown_provider.yaml",
+			ExpectedError: fmt.Errorf("providers contains unknown provider postmark"),
+		},
+		{
+			Case:          "Missing smtp.host",
+			FilePath:      "fixtures/config_smtp_missing_host.yaml",
+			ExpectedError: fmt.Errorf("smtp.host is missing"),
+		},
+		{
+			Case:          "Invalid mailgun.region",
+			FilePath:      "fixtures/config_mailgun_invalid_region.yaml",
+			ExpectedError: fmt.Errorf("mailgun.region must be one of us or eu"),
+		},
+		{
+			Case:          "Invalid mailgun.timeout_seconds",
+			FilePath:      "fixtures/config_mailgun_invalid_timeout.yaml",
+			ExpectedError: fmt.Errorf("mailgun.timeout_seconds is invalid"),
+		},
+		{
+			Case:          "Missing webhook.secret",
+			FilePath:      "fixtures/config_webhook_missing_secret.yaml",
+			ExpectedError: fmt.Errorf("webhook.secret is missing"),
+		},
+		{
+			Case:          "Invalid file.failure_rate",
+			FilePath:      "fixtures/config_file_invalid_failure_rate.yaml",
+			ExpectedError: fmt.Errorf("file.failure_rate must be between 0 and 1"),
+		},
+		{
+			Case:          "Valid config with file delivery_log",
+			FilePath:      "fixtures/config_delivery_log.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Missing delivery_log.path",
+			FilePath:      "fixtures/config_delivery_log_missing_path.yaml",
+			ExpectedError: fmt.Errorf("delivery_log.path is missing"),
+		},
+		{
+			Case:          "Unknown delivery_log.type",
+			FilePath:      "fixtures/config_invalid_delivery_log.yaml",
+			ExpectedError: fmt.Errorf("delivery_log.type must be one of none or file"),
+		},
+		{
+			Case:          "Valid config with send budgets kept in redis",
+			FilePath:      "fixtures/config_send_budgets.yaml",
+			ExpectedError: nil,
+		},
+		{
+			Case:          "Send budgets without counter_store.path",
+			FilePath:      "fixtures/config_send_budgets_missing_counter_store.yaml",
+			ExpectedError: fmt.Errorf("counter_store.path is missing"),
+		},
+		{
+			Case:          "Negative max_attempts",
+			FilePath:      "fixtures/config_invalid_max_attempts.yaml",
+			ExpectedError: fmt.Errorf("max_attempts is invalid"),
+		},
+		{
+			Case:          "Negative daily_budget",
+			FilePath:      "fixtures/config_invalid_daily_budget.yaml",
+			ExpectedError: fmt.Errorf("file.daily_budget is invalid"),
+		},
+		{
+			Case:          "Unknown queue_backend.type",
+			FilePath:      "fixtures/config_invalid_queue_backend.yaml",
+			ExpectedError: fmt.Errorf("queue_backend.type must be one of sqs, memory or disk"),
+		},
+		{
+			Case:          "Unknown queue priority",
+			FilePath:      "fixtures/config_invalid_queue_priority.yaml",
+			ExpectedError: fmt.Errorf("priority of gomail-mails must be one of high, normal or low"),
+		},
+		{
+			Case:          "Negative queue weight",
+			FilePath:      "fixtures/config_invalid_queue_weight.yaml",
+			ExpectedError: fmt.Errorf("weight of gomail-mails is invalid"),
+		},
+		{
+			Case:          "Negative default_ttl_seconds",
+			FilePath:      "fixtures/config_invalid_default_ttl.yaml",
+			ExpectedError: fmt.Errorf("default_ttl_seconds.low is invalid"),
+		},
+		{
+			Case:          "Routing rule with a provider that is not enabled",
+			FilePath:      "fixtures/config_routing_rule_disabled_provider.yaml",
+			ExpectedError: fmt.Errorf("routing_rules[0].providers contains mailgun which is not enabled in providers"),
+		},
+		{
+			Case:          "Routing rule with an invalid domain pattern",
+			FilePath:      "fixtures/config_routing_rule_invalid_domain.yaml",
+			ExpectedError: fmt.Errorf("routing_rules[0] contains invalid domain pattern mail.*.com"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		config, err := NewConfig(testCase.FilePath)
+		if testCase.ExpectedError != nil && assert.Error(s.T(), err, testCase.Case) {
+			assert.Nil(s.T(), config)
+			assert.Contains(s.T(), err.Error(), testCase.ExpectedError.Error())
+		} else {
+			assert.NoError(s.T(), err, testCase.Case)
+			assert.NotNil(s.T(), config)
+		}
+	}
+}
+
+func (s *ConfigSuite) TestQueueDefaults() {
+	config, err := NewConfig("fixtures/config_priorities.yaml")
+	if assert.NoError(s.T(), err) {
+		assert.Equal(s.T(), priorityHigh, config.Queue("gomail-mails-high").Priority)
+		assert.Equal(s.T(), priorityNormal, config.Queue("gomail-mails").Priority)
+		assert.Equal(s.T(), priorityLow, config.Queue("gomail-mails-low").Priority)
+		assert.Equal(s.T(), defaultQueueWeight, config.Queue("gomail-mails").Weight)
+		assert.Equal(s.T(), 3, config.Queue("gomail-mails-low").Weight)
+		assert.Equal(s.T(), PriorityWeights{High: 10, Normal: defaultPriorityWeights.Normal, Low: 2}, config.PriorityWeights)
+		assert.Equal(s.T(), DefaultTTLConfig{High: 900}, config.DefaultTTLSeconds)
+	}
+}
+
+func (s *ConfigSuite) TestSMTPDefaults() {
+	config, err := NewConfig("fixtures/config_smtp.yaml")
+	if assert.NoError(s.T(), err) {
+		assert.Equal(s.T(), []string{providerSES, providerSMTP}, config.Providers)
+		assert.Equal(s.T(), defaultSMTPPort, config.SMTP.Port)
+		assert.Equal(s.T(), defaultSMTPConfig, config.SMTP.ProviderConfig)
+		assert.Equal(s.T(), smtpAuthLogin, config.SMTP.Auth)
+	}
+}
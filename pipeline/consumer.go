@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxNumberOfMessagesPerReceive = 10
+	consumerErrorBackoff          = 5 * time.Second
+)
+
+// queueStats counts the messages received from a queue.
+type queueStats struct {
+	url      string
+	received int64
+	// received since the last health check
+	receivedInWindow int64
+}
+
+// consume long-polls a queue until ctx is done, pushing every received message to the
+// pipeline. A consumer only asks for as many messages as the queue's part of the
+// in-flight budget allows, so it stops receiving while the pipeline holds too many
+// unacknowledged messages. It also stops receiving while the pipeline is paused.
+func (p *Pipeline) consume(ctx context.Context, stats *queueStats) {
+	queueUrl := stats.url
+	priority := config.Queue(queueUrl).Priority
+	for ctx.Err() == nil {
+		if !p.pause.Wait(ctx) {
+			return
+		}
+
+		slots := inFlight.Acquire(queueUrl, maxNumberOfMessagesPerReceive)
+		if slots == 0 {
+			// the budget was closed, we are shutting down
+			return
+		}
+
+		messages, err := queueBackend.Receive(queueUrl, slots, config.WaitTimeSeconds)
+		if err != nil {
+			inFlight.Release(queueUrl, slots)
+			log.Printf("[ERROR] error retrieving messages from queue (%s): %v", queueUrl, err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(consumerErrorBackoff):
+			}
+			continue
+		}
+
+		inFlight.Release(queueUrl, slots-len(messages))
+		atomic.AddInt64(&p.stats.received, int64(len(messages)))
+		atomic.AddInt64(&stats.received, int64(len(messages)))
+		atomic.AddInt64(&stats.receivedInWindow, int64(len(messages)))
+		for _, message := range messages {
+			m := NewMessage(message, queueUrl)
+			m.Priority = priority
+			heartbeats[queueUrl].Track(m)
+			groups.Hold(m)
+			if !p.messages.Push(ctx, m) {
+				// received while shutting down, nobody is going to send it
+				p.handBack(m)
+			}
+		}
+	}
+}
+
+// endReceiveWindow returns a summary of the messages received from every queue since the
+// last call, e.g. "gomail-mails: 120, gomail-mails-low: 10".
+func (p *Pipeline) endReceiveWindow() string {
+	counts := make([]string, 0, len(p.queues))
+	for _, stats := range p.queues {
+		counts = append(counts, fmt.Sprintf("%s: %d", stats.url, atomic.SwapInt64(&stats.receivedInWindow, 0)))
+	}
+	return strings.Join(counts, ", ")
+}
+
+// pauseSwitch stops consumers from receiving new messages without shutting the pipeline
+// down. Messages already received are still sent.
+type pauseSwitch struct {
+	mu sync.Mutex
+	// closed on resume, nil while not paused
+	resumed chan struct{}
+}
+
+// Pause pauses consuming, and reports whether the pipeline was running before.
+func (s *pauseSwitch) Pause() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resumed != nil {
+		return false
+	}
+	s.resumed = make(chan struct{})
+	return true
+}
+
+// Resume resumes consuming, and reports whether the pipeline was paused before.
+func (s *pauseSwitch) Resume() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resumed == nil {
+		return false
+	}
+	close(s.resumed)
+	s.resumed = nil
+	return true
+}
+
+func (s *pauseSwitch) IsPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resumed != nil
+}
+
+// Wait blocks while the pipeline is paused. It returns false if ctx is done first.
+func (s *pauseSwitch) Wait(ctx context.Context) bool {
+	s.mu.Lock()
+	resumed := s.resumed
+	s.mu.Unlock()
+	if resumed == nil {
+		return true
+	}
+
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
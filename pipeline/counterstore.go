@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gomail/queue"
+)
+
+const (
+	counterStoreFile  = "file"
+	counterStoreRedis = "redis"
+
+	defaultRedisKeyPrefix = "gomail:"
+	// longest a single redis command may take, connecting included
+	redisTimeout = 5 * time.Second
+)
+
+// CounterStoreConfig selects where the counters shared by all pipeline nodes are kept.
+type CounterStoreConfig struct {
+	// file (the default) or redis
+	Type string `yaml:"type"`
+	// file the counters are kept in, shared by the pipeline nodes of a host or a shared
+	// filesystem
+	Path string `yaml:"path"`
+	// host:port of the redis server shared by all pipeline nodes
+	RedisAddress  string `yaml:"redis_address"`
+	RedisPassword string `yaml:"redis_password"`
+	// prepended to the name of every counter (defaults to gomail:)
+	RedisKeyPrefix string `yaml:"redis_key_prefix"`
+}
+
+func (c *CounterStoreConfig) SetDefaults() {
+	if c.Type == "" {
+		c.Type = counterStoreFile
+	}
+	if c.RedisKeyPrefix == "" {
+		c.RedisKeyPrefix = defaultRedisKeyPrefix
+	}
+}
+
+func (c CounterStoreConfig) Validate() error {
+	switch c.Type {
+	case counterStoreFile:
+		if c.Path == "" {
+			return fmt.Errorf("counter_store.path is missing")
+		}
+	case counterStoreRedis:
+		if c.RedisAddress == "" {
+			return fmt.Errorf("counter_store.redis_address is missing")
+		}
+	default:
+		return fmt.Errorf("counter_store.type must be one of file or redis")
+	}
+	return nil
+}
+
+// CounterStore keeps counters that all pipeline nodes share.
+type CounterStore interface {
+	// Add adds delta to a counter and returns its new value. A counter starts at 0, and
+	// starts from 0 again once it expired at expiresAt.
+	Add(name string, delta int64, expiresAt time.Time) (int64, error)
+	// Get returns the value of a counter, 0 if it does not exist.
+	Get(name string) (int64, error)
+	Close() error
+}
+
+// NewCounterStore creates the counter store selected by the config.
+func NewCounterStore(config CounterStoreConfig) (CounterStore, error) {
+	switch config.Type {
+	case counterStoreFile:
+		return newFileCounterStore(config.Path), nil
+	case counterStoreRedis:
+		return newRedisCounterStore(config.RedisAddress, config.RedisPassword, config.RedisKeyPrefix), nil
+	}
+	return nil, fmt.Errorf("unknown counter store %s", config.Type)
+}
+
+// fileCounter is a counter as kept in the file of a fileCounterStore.
+type fileCounter struct {
+	Value     int64     `json:"value"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// fileCounterStore keeps all counters in a single JSON file. Every operation holds an
+// exclusive lock on the file, so processes sharing it share the counters. Expired
+// counters are dropped whenever the file is written.
+type fileCounterStore struct {
+	path string
+}
+
+func newFileCounterStore(path string) *fileCounterStore {
+	return &fileCounterStore{path: path}
+}
+
+func (s *fileCounterStore) Add(name string, delta int64, expiresAt time.Time) (int64, error) {
+	var value int64
+	err := s.withCounters(func(counters map[string]fileCounter) bool {
+		now := time.Now()
+		for n, counter := range counters {
+			if !now.Before(counter.ExpiresAt) {
+				delete(counters, n)
+			}
+		}
+		value = counters[name].Value + delta
+		counters[name] = fileCounter{Value: value, ExpiresAt: expiresAt}
+		return true
+	})
+	return value, err
+}
+
+func (s *fileCounterStore) Get(name string) (int64, error) {
+	var value int64
+	err := s.withCounters(func(counters map[string]fileCounter) bool {
+		if counter, ok := counters[name]; ok && time.Now().Before(counter.ExpiresAt) {
+			value = counter.Value
+		}
+		return false
+	})
+	return value, err
+}
+
+func (s *fileCounterStore) Close() error {
+	return nil
+}
+
+// withCounters runs fn on the counters, holding the lock of the file. The counters are
+// written back if fn returns true.
+func (s *fileCounterStore) withCounters(fn func(counters map[string]fileCounter) bool) error {
+	unlock, err := queue.LockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	counters := make(map[string]fileCounter)
+	contents, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) > 0 {
+		if err := json.Unmarshal(contents, &counters); err != nil {
+			return err
+		}
+	}
+	if !fn(counters) {
+		return nil
+	}
+
+	if contents, err = json.Marshal(counters); err != nil {
+		return err
+	}
+	// a crash while writing must not lose the counters, so they are replaced at once
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// redisCounterStore keeps the counters in a redis server, through a single connection
+// that is opened again after any error.
+type redisCounterStore struct {
+	address   string
+	password  string
+	keyPrefix string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisCounterStore(address, password, keyPrefix string) *redisCounterStore {
+	return &redisCounterStore{address: address, password: password, keyPrefix: keyPrefix}
+}
+
+func (s *redisCounterStore) Add(name string, delta int64, expiresAt time.Time) (int64, error) {
+	key := s.keyPrefix + name
+	milliseconds := expiresAt.UnixNano() / int64(time.Millisecond)
+	replies, err := s.do(
+		[]string{"INCRBY", key, strconv.FormatInt(delta, 10)},
+		[]string{"PEXPIREAT", key, strconv.FormatInt(milliseconds, 10)},
+	)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis replied to INCRBY with %v", replies[0])
+	}
+	return value, nil
+}
+
+func (s *redisCounterStore) Get(name string) (int64, error) {
+	replies, err := s.do([]string{"GET", s.keyPrefix + name})
+	if err != nil {
+		return 0, err
+	}
+	switch reply := replies[0].(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return strconv.ParseInt(reply, 10, 64)
+	}
+	return 0, fmt.Errorf("redis replied to GET with %v", replies[0])
+}
+
+func (s *redisCounterStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// do sends commands to redis in a single round trip, and returns their replies.
+func (s *redisCounterStore) do(commands ...[]string) ([]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies, err := s.roundTrip(commands)
+	if err != nil && s.conn != nil {
+		// the replies of the connection can no longer be told apart
+		s.conn.Close()
+		s.conn = nil
+	}
+	return replies, err
+}
+
+func (s *redisCounterStore) roundTrip(commands [][]string) ([]interface{}, error) {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var request []byte
+	for _, command := range commands {
+		request = appendRedisCommand(request, command)
+	}
+	if _, err := s.conn.Write(request); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readRedisReply(s.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redisError); ok {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+func (s *redisCounterStore) connect() error {
+	conn, err := net.DialTimeout("tcp", s.address, redisTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+	if s.password == "" {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := conn.Write(appendRedisCommand(nil, []string{"AUTH", s.password})); err != nil {
+		return err
+	}
+	reply, err := readRedisReply(s.reader)
+	if err != nil {
+		return err
+	}
+	if err, ok := reply.(redisError); ok {
+		return err
+	}
+	return nil
+}
+
+// redisError is an error reply of redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// appendRedisCommand appends a command to a request, as an array of bulk strings.
+func appendRedisCommand(request []byte, command []string) []byte {
+	request = append(request, fmt.Sprintf("*%d\r\n", len(command))...)
+	for _, arg := range command {
+		request = append(request, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	return request
+}
+
+// readRedisReply reads a reply that is not an array: a string, an int64, a redisError,
+// or nil.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return redisError(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		bulk := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		return string(bulk[:length]), nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CounterStoreSuite struct {
+	suite.Suite
+}
+
+func TestCounterStoreSuite(t *testing.T) {
+	suite.Run(t, new(CounterStoreSuite))
+}
+
+// fakeRedis serves the few redis commands the redis counter store uses.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu        sync.Mutex
+	values    map[string]int64
+	expiresAt map[string]int64
+}
+
+func newFakeRedis(s *CounterStoreSuite, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	r := &fakeRedis{
+		listener:  listener,
+		password:  password,
+		values:    make(map[string]int64),
+		expiresAt: make(map[string]int64),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		command, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+
+		var reply string
+		r.mu.Lock()
+		switch {
+		case command[0] == "AUTH":
+			authenticated = command[1] == r.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case command[0] == "INCRBY":
+			delta, _ := strconv.ParseInt(command[2], 10, 64)
+			r.values[command[1]] += delta
+			reply = fmt.Sprintf(":%d\r\n", r.values[command[1]])
+		case command[0] == "PEXPIREAT":
+			r.expiresAt[command[1]], _ = strconv.ParseInt(command[2], 10, 64)
+			reply = ":1\r\n"
+		case command[0] == "GET":
+			reply = "$-1\r\n"
+			if value, ok := r.values[command[1]]; ok {
+				s := strconv.FormatInt(value, 10)
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		r.mu.Unlock()
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	command := make([]string, n)
+	for i := range command {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		command[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return command, nil
+}
+
+func (s *CounterStoreSuite) TestFileCounterStore() {
+	dir, err := ioutil.TempDir("", "gomail-counters")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "counters.json")
+
+	// stores sharing the file share the counters
+	a, b := newFileCounterStore(path), newFileCounterStore(path)
+	expiresAt := time.Now().Add(time.Hour)
+	value, err := a.Add("sent", 2, expiresAt)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(2), value)
+	value, err = b.Add("sent", 3, expiresAt)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(5), value)
+	value, err = a.Get("sent")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(5), value)
+
+	value, err = a.Get("missing")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(0), value)
+
+	// an expired counter starts from 0 again
+	_, err = a.Add("expired", 7, time.Now().Add(-time.Second))
+	assert.NoError(s.T(), err)
+	value, err = a.Get("expired")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(0), value)
+	value, err = a.Add("expired", 1, expiresAt)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), value)
+}
+
+func (s *CounterStoreSuite) TestRedisCounterStore() {
+	r := newFakeRedis(s, "secret")
+	defer r.listener.Close()
+
+	store := newRedisCounterStore(r.listener.Addr().String(), "secret", "gomail:")
+	defer store.Close()
+	expiresAt := time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)
+	value, err := store.Add("sent", 2, expiresAt)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(2), value)
+	value, err = store.Add("sent", -1, expiresAt)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), value)
+	value, err = store.Get("sent")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), value)
+	value, err = store.Get("missing")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(0), value)
+
+	r.mu.Lock()
+	assert.Equal(s.T(), int64(1), r.values["gomail:sent"])
+	assert.Equal(s.T(), expiresAt.UnixNano()/int64(time.Millisecond), r.expiresAt["gomail:sent"])
+	r.mu.Unlock()
+
+	// the connection is opened again after it broke
+	store.mu.Lock()
+	store.conn.Close()
+	store.mu.Unlock()
+	_, err = store.Get("sent")
+	assert.Error(s.T(), err)
+	value, err = store.Get("sent")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), value)
+
+	wrongPassword := newRedisCounterStore(r.listener.Addr().String(), "wrong", "gomail:")
+	defer wrongPassword.Close()
+	_, err = wrongPassword.Get("sent")
+	if assert.Error(s.T(), err) {
+		assert.Contains(s.T(), err.Error(), "WRONGPASS")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"gomail/queue"
+)
+
+const (
+	deadLetterReasonUnparseable = "unparseable"
+	deadLetterReasonRejected    = "rejected"
+	deadLetterReasonExhausted   = "exhausted"
+	deadLetterReasonExpired     = "expired"
+	// every provider failed the message max_failures_per_provider times
+	deadLetterReasonFailedEverywhere = "failed-everywhere"
+
+	deadLetterAttributeReason            = "gomail-reason"
+	deadLetterAttributeSourceQueue       = "gomail-source-queue"
+	deadLetterAttributeSourceMessageId   = "gomail-source-message-id"
+	deadLetterAttributeLastError         = "gomail-last-error"
+	deadLetterAttributeAttempts          = "gomail-attempts"
+	maxDeadLetterAttributeLastErrorBytes = 1024
+)
+
+// deadLetter moves a message that will not be sent to the dead letter queue configured
+// for its source queue, describing why it ended up there. The original message is only
+// deleted once the copy was published; if no dead letter queue is configured the
+// message is dropped.
+func deadLetter(message *Message, reason string, cause error) error {
+	messageId := message.Message.Id
+	dlqUrl := config.Queue(message.QueueUrl).DeadLetterQueueUrl
+	if dlqUrl == "" {
+		log.Printf(
+			"[ERROR] No dead letter queue configured for queue (%s), dropping message %s (reason: %s)",
+			message.QueueUrl,
+			messageId,
+			reason,
+		)
+		deleteFromQueue(message, nil)
+		return nil
+	}
+
+	lastError := ""
+	if cause != nil {
+		lastError = cause.Error()
+	}
+	if len(lastError) > maxDeadLetterAttributeLastErrorBytes {
+		lastError = lastError[:maxDeadLetterAttributeLastErrorBytes]
+	}
+
+	// the copy keeps the attributes of the message (e.g. its expiry and the id of the
+	// message it was requeued from), so that it can be traced back and redriven
+	attributes := make(map[string]queue.Attribute, len(message.Message.Attributes)+6)
+	for name, value := range message.Message.Attributes {
+		attributes[name] = value
+	}
+	attributes[deadLetterAttributeReason] = queue.StringAttribute(reason)
+	attributes[deadLetterAttributeSourceQueue] = queue.StringAttribute(message.QueueUrl)
+	attributes[deadLetterAttributeSourceMessageId] = queue.StringAttribute(messageId)
+	attributes[deadLetterAttributeAttempts] = queue.NumberAttribute(message.Attempt())
+	// empty string attributes are rejected by SQS
+	if lastError != "" {
+		attributes[deadLetterAttributeLastError] = queue.StringAttribute(lastError)
+	}
+	if len(message.history) > 0 {
+		history, err := json.Marshal(message.history)
+		if err != nil {
+			// This should never happen
+			panic("Could not marshal attempt history: " + err.Error())
+		}
+		attributes[attemptHistoryAttribute] = queue.StringAttribute(string(history))
+	}
+
+	input := queue.SendInput{Body: message.Message.Body, Attributes: attributes}
+	if queue.IsFIFO(dlqUrl) {
+		// keep the group together, and do not dead-letter the same message twice
+		input.GroupId = message.Message.GroupId
+		input.DeduplicationId = messageId
+	}
+	_, err := queueBackend.Send(dlqUrl, input)
+	if err != nil {
+		log.Printf("[ERROR] Could not push message %s to dead letter queue: %v", messageId, err.Error())
+		// leave the message to come back once its visibility timeout expires
+		message.finish()
+		return err
+	}
+
+	log.Printf("[INFO] Message %s moved to dead letter queue (reason: %s, attempts: %d)", messageId, reason, message.Attempt())
+	deleteFromQueue(message, nil)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"gomail/awsmock/mocks"
+	"gomail/queue"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type DeadLetterSuite struct {
+	suite.Suite
+}
+
+func TestDeadLetterSuite(t *testing.T) {
+	suite.Run(t, new(DeadLetterSuite))
+}
+
+func (s *DeadLetterSuite) TestDeadLetter() {
+	stdQueueUrl := "https://sqs.us-east-1.amazonaws.com/111111111111/gomail-mails"
+	stdDlqUrl := "https://sqs.us-east-1.amazonaws.com/111111111111/gomail-mails-dlq"
+	testCases := []struct {
+		Case         string
+		DlqUrl       string
+		SendErr      error
+		ExpectSend   bool
+		ExpectDelete bool
+	}{
+		{
+			Case:         "Dead letter queue configured",
+			DlqUrl:       stdDlqUrl,
+			ExpectSend:   true,
+			ExpectDelete: true,
+		},
+		{
+			Case:         "No dead letter queue configured",
+			ExpectDelete: true,
+		},
+		{
+			Case:       "Dead letter queue unavailable",
+			DlqUrl:     stdDlqUrl,
+			SendErr:    fmt.Errorf("service unavailable"),
+			ExpectSend: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		config = &Config{
+			Queues: []QueueConfig{{Url: stdQueueUrl, DeadLetterQueueUrl: testCase.DlqUrl}},
+		}
+		mockSQS := new(mocks.SQSAPI)
+		queueBackend = queue.NewSQS(mockSQS)
+		message := NewMessage(&queue.Message{
+			Id:            "1",
+			ReceiptHandle: "receipt",
+			Body:          "body",
+			Attributes: map[string]queue.Attribute{
+				enqueuedAtAttribute:        queue.NumberAttribute(1488369600000),
+				originalMessageIdAttribute: queue.StringAttribute("0"),
+			},
+			ReceiveCount: 3,
+		}, stdQueueUrl)
+
+		if testCase.ExpectSend {
+			mockSQS.On("SendMessage", mock.MatchedBy(func(input *sqs.SendMessageInput) bool {
+				attributes := input.MessageAttributes
+				return *input.QueueUrl == stdDlqUrl &&
+					*input.MessageBody == "body" &&
+					*attributes[deadLetterAttributeReason].StringValue == deadLetterReasonRejected &&
+					*attributes[deadLetterAttributeSourceQueue].StringValue == stdQueueUrl &&
+					*attributes[deadLetterAttributeLastError].StringValue == "invalid recipient" &&
+					*attributes[deadLetterAttributeAttempts].StringValue == "3" &&
+					*attributes[enqueuedAtAttribute].StringValue == "1488369600000" &&
+					*attributes[originalMessageIdAttribute].StringValue == "0"
+			})).Return(&sqs.SendMessageOutput{MessageId: aws.String("2")}, testCase.SendErr)
+		}
+		if testCase.ExpectDelete {
+			mockSQS.On("DeleteMessageBatch", &sqs.DeleteMessageBatchInput{
+				QueueUrl: &stdQueueUrl,
+				Entries: []*sqs.DeleteMessageBatchRequestEntry{
+					{Id: aws.String("0"), ReceiptHandle: aws.String("receipt")},
+				},
+			}).Return(&sqs.DeleteMessageBatchOutput{}, nil)
+		}
+
+		err := deadLetter(message, deadLetterReasonRejected, fmt.Errorf("invalid recipient"))
+		acks.Flush()
+		assert.Equal(s.T(), testCase.SendErr, err, testCase.Case)
+		mockSQS.AssertExpectations(s.T())
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	deliveryLogNone = "none"
+	deliveryLogFile = "file"
+
+	// longest line of the delivery log file that can be read back
+	maxDeliveryLogLineBytes = 1024 * 1024
+)
+
+// DeliveryLogConfig selects where deliveries are recorded.
+type DeliveryLogConfig struct {
+	// none (the default) or file
+	Type string `yaml:"type"`
+	// file the deliveries are appended to, one JSON object per line
+	Path string `yaml:"path"`
+}
+
+func (c *DeliveryLogConfig) SetDefaults() {
+	if c.Type == "" {
+		c.Type = deliveryLogNone
+	}
+}
+
+func (c DeliveryLogConfig) Validate() error {
+	switch c.Type {
+	case deliveryLogNone:
+	case deliveryLogFile:
+		if c.Path == "" {
+			return fmt.Errorf("delivery_log.path is missing")
+		}
+	default:
+		return fmt.Errorf("delivery_log.type must be one of none or file")
+	}
+	return nil
+}
+
+// Delivery is the record of an email a provider accepted.
+type Delivery struct {
+	// id of the queue message the API enqueued the email as
+	QueueMessageId string `json:"queueMessageId"`
+	// id of the requeued copy the email was sent from, if it was requeued after a failure
+	RequeuedMessageId string `json:"requeuedMessageId,omitempty"`
+	QueueUrl          string `json:"queueUrl"`
+	Provider          string `json:"provider"`
+	// id the provider gave the message, if it gave one
+	ProviderMessageId string     `json:"providerMessageId,omitempty"`
+	ToEmail           string     `json:"toEmail"`
+	Priority          string     `json:"priority"`
+	Attempt           int        `json:"attempt"`
+	EnqueuedAt        *time.Time `json:"enqueuedAt,omitempty"`
+	SentAt            time.Time  `json:"sentAt"`
+}
+
+// HasId reports whether any of the ids of a delivery is id.
+func (d Delivery) HasId(id string) bool {
+	return id != "" && (id == d.QueueMessageId || id == d.RequeuedMessageId || id == d.ProviderMessageId)
+}
+
+// DeliveryLog keeps the record of every email sent.
+type DeliveryLog interface {
+	Record(delivery Delivery) error
+	// Lookup returns the deliveries that have id as their queue, requeued or provider
+	// message id, oldest first.
+	Lookup(id string) ([]Delivery, error)
+	Close() error
+}
+
+// NewDeliveryLog creates the delivery log selected by the config.
+func NewDeliveryLog(config DeliveryLogConfig) (DeliveryLog, error) {
+	switch config.Type {
+	case deliveryLogNone:
+		return nopDeliveryLog{}, nil
+	case deliveryLogFile:
+		return newFileDeliveryLog(config.Path)
+	}
+	return nil, fmt.Errorf("unknown delivery log %s", config.Type)
+}
+
+// newDelivery describes the sending of a message by a worker.
+func newDelivery(message *Message, provider, providerMessageId string, sentAt time.Time) Delivery {
+	delivery := Delivery{
+		QueueMessageId:    message.OriginalId(),
+		QueueUrl:          message.QueueUrl,
+		Provider:          provider,
+		ProviderMessageId: providerMessageId,
+		Priority:          message.Priority,
+		Attempt:           message.Attempt(),
+		SentAt:            sentAt.UTC(),
+	}
+	if delivery.QueueMessageId != message.Message.Id {
+		delivery.RequeuedMessageId = message.Message.Id
+	}
+	if message.Email != nil {
+		delivery.ToEmail = message.Email.ToEmail
+	}
+	if enqueuedAt, ok := message.timeAttribute(enqueuedAtAttribute); ok {
+		enqueuedAt = enqueuedAt.UTC()
+		delivery.EnqueuedAt = &enqueuedAt
+	}
+	return delivery
+}
+
+type nopDeliveryLog struct{}
+
+func (nopDeliveryLog) Record(delivery Delivery) error {
+	return nil
+}
+
+func (nopDeliveryLog) Lookup(id string) ([]Delivery, error) {
+	return nil, fmt.Errorf("delivery log is disabled")
+}
+
+func (nopDeliveryLog) Close() error {
+	return nil
+}
+
+// fileDeliveryLog appends deliveries to a file as newline delimited JSON. The file is
+// never rewritten, so it can be rotated or shipped elsewhere like any other log. Lookups
+// scan the whole file.
+type fileDeliveryLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func newFileDeliveryLog(path string) (*fileDeliveryLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDeliveryLog{path: path, file: file}, nil
+}
+
+func (l *fileDeliveryLog) Record(delivery Delivery) error {
+	line, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// a single write, so that concurrent records never interleave
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+func (l *fileDeliveryLog) Lookup(id string) ([]Delivery, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var deliveries []Delivery
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxDeliveryLogLineBytes)
+	for scanner.Scan() {
+		var delivery Delivery
+		// a line cut short by a crash is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &delivery); err != nil {
+			continue
+		}
+		if delivery.HasId(id) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, scanner.Err()
+}
+
+func (l *fileDeliveryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gomail/queue"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type DeliveryLogSuite struct {
+	suite.Suite
+}
+
+func TestDeliveryLogSuite(t *testing.T) {
+	suite.Run(t, new(DeliveryLogSuite))
+}
+
+// providerIdWorker sends every email successfully, as the provider message id it is given.
+type providerIdWorker struct {
+	messageId string
+}
+
+func (w *providerIdWorker) Send(email *Email) (string, error) {
+	return w.messageId, nil
+}
+
+func tempDeliveryLogPath(s *DeliveryLogSuite) (string, func()) {
+	dir, err := ioutil.TempDir("", "gomail-delivery-log")
+	s.Require().NoError(err)
+	return filepath.Join(dir, "deliveries.ndjson"), func() { os.RemoveAll(dir) }
+}
+
+func (s *DeliveryLogSuite) TestFileDeliveryLog() {
+	path, cleanup := tempDeliveryLogPath(s)
+	defer cleanup()
+
+	sentAt := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	deliveries := []Delivery{
+		{QueueMessageId: "queue-1", Provider: "SES", ProviderMessageId: "ses-1", SentAt: sentAt},
+		{QueueMessageId: "queue-2", Provider: "Sendgrid", ProviderMessageId: "sendgrid-2", SentAt: sentAt},
+		{QueueMessageId: "queue-3", RequeuedMessageId: "queue-4", Provider: "SMTP", SentAt: sentAt},
+	}
+
+	l, err := newFileDeliveryLog(path)
+	s.Require().NoError(err)
+	for _, delivery := range deliveries[:2] {
+		assert.NoError(s.T(), l.Record(delivery))
+	}
+	assert.NoError(s.T(), l.Close())
+
+	// records are appended to the deliveries of earlier runs, after a line a crash cut short
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	s.Require().NoError(err)
+	file.WriteString(`{"queueMessageId":"queue-`)
+	file.Close()
+	l, err = newFileDeliveryLog(path)
+	s.Require().NoError(err)
+	defer l.Close()
+	assert.NoError(s.T(), l.Record(Delivery{}))
+	assert.NoError(s.T(), l.Record(deliveries[2]))
+
+	testCases := []struct {
+		Case               string
+		Id                 string
+		ExpectedDeliveries []Delivery
+	}{
+		{
+			Case:               "Queue message id",
+			Id:                 "queue-2",
+			ExpectedDeliveries: []Delivery{deliveries[1]},
+		},
+		{
+			Case:               "Provider message id",
+			Id:                 "ses-1",
+			ExpectedDeliveries: []Delivery{deliveries[0]},
+		},
+		{
+			Case:               "Queue message id of a requeued message",
+			Id:                 "queue-3",
+			ExpectedDeliveries: []Delivery{deliveries[2]},
+		},
+		{
+			Case:               "Requeued message id",
+			Id:                 "queue-4",
+			ExpectedDeliveries: []Delivery{deliveries[2]},
+		},
+		{
+			Case:               "Unknown id",
+			Id:                 "queue-5",
+			ExpectedDeliveries: nil,
+		},
+		{
+			Case:               "Empty id",
+			Id:                 "",
+			ExpectedDeliveries: nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		found, err := l.Lookup(testCase.Id)
+		assert.NoError(s.T(), err, testCase.Case)
+		assert.Equal(s.T(), testCase.ExpectedDeliveries, found, testCase.Case)
+	}
+}
+
+func (s *DeliveryLogSuite) TestRecordDelivery() {
+	path, cleanup := tempDeliveryLogPath(s)
+	defer cleanup()
+	var err error
+	deliveryLog, err = NewDeliveryLog(DeliveryLogConfig{Type: deliveryLogFile, Path: path})
+	s.Require().NoError(err)
+	defer func() {
+		deliveryLog.Close()
+		deliveryLog = nopDeliveryLog{}
+	}()
+
+	config = &Config{AckMaxRetries: 1}
+	queueBackend = queue.NewMemory(30)
+	enqueuedAt := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	message := testMessage(2)
+	message.Email = &Email{ToEmail: "to@example.com"}
+	message.Priority = priorityHigh
+	message.Message.Attributes = map[string]queue.Attribute{
+		enqueuedAtAttribute:        millisecondsAttribute(enqueuedAt),
+		originalMessageIdAttribute: queue.StringAttribute("1"),
+	}
+
+	p := &Pipeline{}
+	w := newWorker("SES", &providerIdWorker{messageId: "ses-1"}, ProviderConfig{MaxConcurrency: 1})
+	w.assign()
+	assert.True(s.T(), p.send(context.Background(), w, message))
+
+	deliveries, err := deliveryLog.Lookup("ses-1")
+	if assert.NoError(s.T(), err) && assert.Len(s.T(), deliveries, 1) {
+		delivery := deliveries[0]
+		assert.Equal(s.T(), "1", delivery.QueueMessageId)
+		assert.Equal(s.T(), "2", delivery.RequeuedMessageId)
+		assert.Equal(s.T(), testQueueUrl, delivery.QueueUrl)
+		assert.Equal(s.T(), "SES", delivery.Provider)
+		assert.Equal(s.T(), "to@example.com", delivery.ToEmail)
+		assert.Equal(s.T(), priorityHigh, delivery.Priority)
+		if assert.NotNil(s.T(), delivery.EnqueuedAt) {
+			assert.True(s.T(), enqueuedAt.Equal(*delivery.EnqueuedAt))
+		}
+		assert.WithinDuration(s.T(), time.Now(), delivery.SentAt, time.Minute)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// set by the API on every message, in unix milliseconds
+	enqueuedAtAttribute = "gomail-enqueued-at"
+	expiresAtAttribute  = "gomail-expires-at"
+)
+
+// DefaultTTLConfig sets how long after being enqueued the messages of each priority
+// expire, unless the API request said otherwise. 0 means never.
+type DefaultTTLConfig struct {
+	High   int64 `yaml:"high"`
+	Normal int64 `yaml:"normal"`
+	Low    int64 `yaml:"low"`
+}
+
+func (c DefaultTTLConfig) ttlSeconds(priority string) int64 {
+	switch priority {
+	case priorityHigh:
+		return c.High
+	case priorityLow:
+		return c.Low
+	}
+	return c.Normal
+}
+
+func (m *Message) timeAttribute(name string) (time.Time, bool) {
+	attribute, ok := m.Message.Attributes[name]
+	if !ok {
+		return time.Time{}, false
+	}
+	milliseconds, err := strconv.ParseInt(attribute.StringValue, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, milliseconds*int64(time.Millisecond)), true
+}
+
+// ExpiresAt returns when a message expires: at the time the API request asked for, or
+// else once the default TTL of its priority has passed since it was enqueued. It returns
+// false if the message never expires.
+func (m *Message) ExpiresAt() (time.Time, bool) {
+	if expiresAt, ok := m.timeAttribute(expiresAtAttribute); ok {
+		return expiresAt, true
+	}
+	ttl := config.DefaultTTLSeconds.ttlSeconds(m.Priority)
+	enqueuedAt, ok := m.timeAttribute(enqueuedAtAttribute)
+	if ttl <= 0 || !ok {
+		return time.Time{}, false
+	}
+	return enqueuedAt.Add(time.Duration(ttl) * time.Second), true
+}
+
+// expire dead-letters a message that expired before it could be sent, and reports
+// whether it did.
+func (p *Pipeline) expire(message *Message) bool {
+	expiresAt, ok := message.ExpiresAt()
+	if !ok || time.Now().Before(expiresAt) {
+		return false
+	}
+
+	atomic.AddInt64(&p.stats.expired, 1)
+	log.Printf(
+		"[ERROR] Message %s expired at %s before it could be sent (%s priority, attempt %d)",
+		message.Message.Id,
+		expiresAt.UTC().Format(time.RFC3339),
+		message.Priority,
+		message.Attempt(),
+	)
+	go deadLetter(message, deadLetterReasonExpired, fmt.Errorf("expired at %s", expiresAt.UTC().Format(time.RFC3339)))
+	return true
+}
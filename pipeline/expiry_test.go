@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gomail/queue"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ExpirySuite struct {
+	suite.Suite
+}
+
+func TestExpirySuite(t *testing.T) {
+	suite.Run(t, new(ExpirySuite))
+}
+
+func millisecondsAttribute(t time.Time) queue.Attribute {
+	return queue.NumberAttribute(int(t.UnixNano() / int64(time.Millisecond)))
+}
+
+func (s *ExpirySuite) TestExpiresAt() {
+	enqueuedAt := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		Case       string
+		Priority   string
+		Attributes map[string]queue.Attribute
+
+		ExpectedExpiresAt time.Time
+		ExpectedOk        bool
+	}{
+		{
+			Case:     "Expires at set by the request",
+			Priority: priorityHigh,
+			Attributes: map[string]queue.Attribute{
+				enqueuedAtAttribute: millisecondsAttribute(enqueuedAt),
+				expiresAtAttribute:  millisecondsAttribute(enqueuedAt.Add(time.Hour)),
+			},
+			ExpectedExpiresAt: enqueuedAt.Add(time.Hour),
+			ExpectedOk:        true,
+		},
+		{
+			Case:              "Default TTL of the priority",
+			Priority:          priorityHigh,
+			Attributes:        map[string]queue.Attribute{enqueuedAtAttribute: millisecondsAttribute(enqueuedAt)},
+			ExpectedExpiresAt: enqueuedAt.Add(15 * time.Minute),
+			ExpectedOk:        true,
+		},
+		{
+			Case:       "Priority without default TTL",
+			Priority:   priorityNormal,
+			Attributes: map[string]queue.Attribute{enqueuedAtAttribute: millisecondsAttribute(enqueuedAt)},
+			ExpectedOk: false,
+		},
+		{
+			Case:     "Invalid expires at",
+			Priority: priorityNormal,
+			Attributes: map[string]queue.Attribute{
+				enqueuedAtAttribute: millisecondsAttribute(enqueuedAt),
+				expiresAtAttribute:  queue.StringAttribute("soon"),
+			},
+			ExpectedOk: false,
+		},
+		{
+			Case:       "Not stamped with an enqueue time",
+			Priority:   priorityHigh,
+			Attributes: map[string]queue.Attribute{},
+			ExpectedOk: false,
+		},
+	}
+
+	config = &Config{DefaultTTLSeconds: DefaultTTLConfig{High: 900}}
+	for _, testCase := range testCases {
+		message := testMessage(1)
+		message.Priority = testCase.Priority
+		message.Message.Attributes = testCase.Attributes
+
+		expiresAt, ok := message.ExpiresAt()
+		assert.Equal(s.T(), testCase.ExpectedOk, ok, testCase.Case)
+		if testCase.ExpectedOk {
+			assert.True(s.T(), testCase.ExpectedExpiresAt.Equal(expiresAt), testCase.Case)
+		}
+	}
+}
+
+func (s *ExpirySuite) TestExpire() {
+	const queueUrl, dlqUrl = "gomail-mails", "gomail-mails-dlq"
+	config = &Config{
+		Queues:        []QueueConfig{{Url: queueUrl, DeadLetterQueueUrl: dlqUrl}},
+		AckMaxRetries: 1,
+	}
+	queueBackend = queue.NewMemory(30)
+	now := time.Now()
+	queueBackend.Send(queueUrl, queue.SendInput{
+		Body:       "expired",
+		Attributes: map[string]queue.Attribute{expiresAtAttribute: millisecondsAttribute(now.Add(-time.Minute))},
+	})
+	queueBackend.Send(queueUrl, queue.SendInput{
+		Body:       "not expired",
+		Attributes: map[string]queue.Attribute{expiresAtAttribute: millisecondsAttribute(now.Add(time.Minute))},
+	})
+	messages, err := queueBackend.Receive(queueUrl, 10, 0)
+	s.Require().NoError(err)
+	s.Require().Len(messages, 2)
+
+	p := &Pipeline{}
+	for _, m := range messages {
+		assert.Equal(s.T(), m.Body == "expired", p.expire(NewMessage(m, queueUrl)), m.Body)
+	}
+	assert.Equal(s.T(), int64(1), p.stats.expired)
+
+	var deadLettered []*queue.Message
+	for i := 0; i < 100 && len(deadLettered) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		acks.Flush()
+		deadLettered, _ = queueBackend.Receive(dlqUrl, 10, 0)
+	}
+	if assert.Len(s.T(), deadLettered, 1) {
+		assert.Equal(s.T(), deadLetterReasonExpired, deadLettered[0].Attributes[deadLetterAttributeReason].StringValue)
+		assert.Contains(s.T(), deadLettered[0].Attributes[deadLetterAttributeLastError].StringValue, "expired at")
+	}
+}
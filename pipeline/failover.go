@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"gomail/queue"
+)
+
+const (
+	// attribute carrying the attempts that failed before the message was requeued
+	attemptHistoryAttribute     = "gomail-attempt-history"
+	maxAttemptHistoryErrorBytes = 256
+	// attribute carrying the id of the message the API enqueued, once it was requeued
+	originalMessageIdAttribute = "gomail-original-message-id"
+)
+
+// failedAttempt is an entry of the attempt history of a message.
+type failedAttempt struct {
+	Provider string    `json:"provider"`
+	Error    string    `json:"error"`
+	At       time.Time `json:"at"`
+}
+
+// attemptHistory reads the attempts that failed before a message was requeued.
+func attemptHistory(message *queue.Message) []failedAttempt {
+	attribute, ok := message.Attributes[attemptHistoryAttribute]
+	if !ok {
+		return nil
+	}
+	var history []failedAttempt
+	if err := json.Unmarshal([]byte(attribute.StringValue), &history); err != nil {
+		log.Printf("[ERROR] Could not read attempt history of message %s: %v", message.Id, err)
+		return nil
+	}
+	return history
+}
+
+// recordFailure adds a failed attempt to the history of a message.
+func (m *Message) recordFailure(provider string, cause error) {
+	attempt := failedAttempt{Provider: provider, At: time.Now().UTC()}
+	if cause != nil {
+		attempt.Error = cause.Error()
+	}
+	if len(attempt.Error) > maxAttemptHistoryErrorBytes {
+		attempt.Error = attempt.Error[:maxAttemptHistoryErrorBytes]
+	}
+	m.history = append(m.history, attempt)
+}
+
+// OriginalId returns the id the message had when the API enqueued it, which requeued
+// copies keep.
+func (m *Message) OriginalId() string {
+	if attribute, ok := m.Message.Attributes[originalMessageIdAttribute]; ok && attribute.StringValue != "" {
+		return attribute.StringValue
+	}
+	return m.Message.Id
+}
+
+// failures counts the attempts of a provider that failed.
+func failures(history []failedAttempt, provider string) int {
+	count := 0
+	for _, attempt := range history {
+		if strings.EqualFold(attempt.Provider, provider) {
+			count++
+		}
+	}
+	return count
+}
+
+// failedEverywhere reports whether every enabled provider failed a message at least
+// max_failures_per_provider times.
+func failedEverywhere(history []failedAttempt) bool {
+	if config.MaxFailuresPerProvider <= 0 || len(config.Providers) == 0 {
+		return false
+	}
+	for _, provider := range config.Providers {
+		if failures(history, provider) < config.MaxFailuresPerProvider {
+			return false
+		}
+	}
+	return true
+}
+
+// leastFailed returns the workers that are best suited to retry a message: out of the
+// enabled workers - the healthy ones if there are any - those that failed the message
+// the least number of times.
+func leastFailed(workers []*worker, history []failedAttempt) []*worker {
+	available := make([]*worker, 0, len(workers))
+	healthy := make([]*worker, 0, len(workers))
+	for _, w := range workers {
+		if !w.IsAvailable() {
+			continue
+		}
+		available = append(available, w)
+		if w.IsHealthy() {
+			healthy = append(healthy, w)
+		}
+	}
+	if len(healthy) > 0 {
+		available = healthy
+	}
+
+	var candidates []*worker
+	fewest := 0
+	for _, w := range available {
+		count := failures(history, w.name)
+		if candidates == nil || count < fewest {
+			candidates, fewest = nil, count
+		}
+		if count == fewest {
+			candidates = append(candidates, w)
+		}
+	}
+	if len(candidates) == 0 {
+		return workers
+	}
+	return candidates
+}
+
+// requeue replaces a failed message with a copy that carries its attempt history and is
+// delivered after delay seconds, so that the next attempt knows which providers failed
+// it. It returns false if the copy could not be sent.
+func requeue(message *Message, delay int64) bool {
+	history, err := json.Marshal(message.history)
+	if err != nil {
+		// This should never happen
+		panic("Could not marshal attempt history: " + err.Error())
+	}
+	attributes := make(map[string]queue.Attribute, len(message.Message.Attributes)+2)
+	for name, value := range message.Message.Attributes {
+		attributes[name] = value
+	}
+	attributes[attemptHistoryAttribute] = queue.StringAttribute(string(history))
+	attributes[originalMessageIdAttribute] = queue.StringAttribute(message.OriginalId())
+
+	copyId, err := queueBackend.Send(message.QueueUrl, queue.SendInput{
+		Body:         message.Message.Body,
+		Attributes:   attributes,
+		DelaySeconds: delay,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Could not requeue message %s, it is retried without its attempt history: %v", message.Message.Id, err)
+		return false
+	}
+
+	log.Printf("[INFO] Message %s was requeued as message %s", message.Message.Id, copyId)
+	deleteFromQueue(message, func(err error) {
+		if err != nil {
+			log.Printf("[ERROR] Message %s was requeued as message %s but stays in the queue, it will be sent twice", message.Message.Id, copyId)
+		}
+	})
+	return true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"gomail/queue"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type FailoverSuite struct {
+	suite.Suite
+}
+
+func TestFailoverSuite(t *testing.T) {
+	suite.Run(t, new(FailoverSuite))
+}
+
+func (s *FailoverSuite) TestRouteFailedMessage() {
+	testCases := []struct {
+		Case           string
+		Failed         []string
+		Healthy        map[string]bool
+		ExpectedCounts map[string]int
+	}{
+		{
+			Case:           "Providers that did not fail the message",
+			Failed:         []string{"SES"},
+			Healthy:        map[string]bool{"SES": true, "Sendgrid": true, "SMTP": true},
+			ExpectedCounts: map[string]int{"Sendgrid": 5, "SMTP": 5},
+		},
+		{
+			Case:           "Provider that failed the message the least",
+			Failed:         []string{"SES", "Sendgrid", "SES", "SMTP", "Sendgrid"},
+			Healthy:        map[string]bool{"SES": true, "Sendgrid": true, "SMTP": true},
+			ExpectedCounts: map[string]int{"SMTP": 10},
+		},
+		{
+			Case:           "Healthy providers first",
+			Failed:         []string{"SES"},
+			Healthy:        map[string]bool{"SES": true, "Sendgrid": false, "SMTP": false},
+			ExpectedCounts: map[string]int{"SES": 10},
+		},
+		{
+			Case:           "All providers unhealthy",
+			Failed:         []string{"SES"},
+			Healthy:        map[string]bool{"SES": false, "Sendgrid": false, "SMTP": false},
+			ExpectedCounts: map[string]int{"Sendgrid": 5, "SMTP": 5},
+		},
+	}
+
+	config = &Config{}
+	for _, testCase := range testCases {
+		p := &Pipeline{}
+		for _, name := range []string{"SES", "Sendgrid", "SMTP"} {
+			w := newWorker(name, &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+			w.isHealthy = testCase.Healthy[name]
+			p.workers = append(p.workers, w)
+		}
+
+		message := testMessage(1)
+		message.Email = &Email{ToEmail: "to@example.com"}
+		for _, provider := range testCase.Failed {
+			message.recordFailure(provider, fmt.Errorf("failed"))
+		}
+		counts := make(map[string]int)
+		for i := 0; i < 10; i++ {
+			counts[p.routeMessage(message).name]++
+		}
+		assert.Equal(s.T(), testCase.ExpectedCounts, counts, testCase.Case)
+	}
+}
+
+func (s *FailoverSuite) TestRequeue() {
+	const queueUrl, dlqUrl = "gomail-mails", "gomail-mails-dlq"
+	config = &Config{
+		Providers:              []string{providerSES, providerSendgrid},
+		Queues:                 []QueueConfig{{Url: queueUrl, DeadLetterQueueUrl: dlqUrl}},
+		MaxAttempts:            10,
+		MaxFailuresPerProvider: 2,
+		AckMaxRetries:          1,
+	}
+	queueBackend = queue.NewMemory(30)
+	queueBackend.Send(queueUrl, queue.SendInput{Body: "body"})
+
+	// every failure requeues a copy of the message that knows who failed it
+	originalId := ""
+	for i, provider := range []string{"SES", "Sendgrid", "SES"} {
+		messages, err := queueBackend.Receive(queueUrl, 10, 0)
+		s.Require().NoError(err)
+		s.Require().Len(messages, 1)
+		message := NewMessage(messages[0], queueUrl)
+		assert.Equal(s.T(), i+1, message.Attempt())
+		assert.Len(s.T(), message.history, i)
+		if i == 0 {
+			originalId = message.Message.Id
+		} else {
+			assert.NotEqual(s.T(), originalId, message.Message.Id)
+		}
+		assert.Equal(s.T(), originalId, message.OriginalId())
+
+		handleFailure(message, provider, fmt.Errorf("%s failed", provider))
+		acks.Flush()
+		depth, _ := queueBackend.Depth(queueUrl)
+		assert.Equal(s.T(), int64(1), depth)
+	}
+
+	// once all providers failed it twice, it is dead-lettered with its full history
+	messages, _ := queueBackend.Receive(queueUrl, 10, 0)
+	s.Require().Len(messages, 1)
+	message := NewMessage(messages[0], queueUrl)
+	assert.Equal(s.T(), 4, message.Attempt())
+	handleFailure(message, "Sendgrid", fmt.Errorf("Sendgrid failed"))
+	acks.Flush()
+
+	depth, _ := queueBackend.Depth(queueUrl)
+	assert.Equal(s.T(), int64(0), depth)
+	deadLettered, _ := queueBackend.Receive(dlqUrl, 10, 0)
+	if assert.Len(s.T(), deadLettered, 1) {
+		attributes := deadLettered[0].Attributes
+		assert.Equal(s.T(), deadLetterReasonFailedEverywhere, attributes[deadLetterAttributeReason].StringValue)
+		assert.Equal(s.T(), "4", attributes[deadLetterAttributeAttempts].StringValue)
+
+		var history []failedAttempt
+		assert.NoError(s.T(), json.Unmarshal([]byte(attributes[attemptHistoryAttribute].StringValue), &history))
+		providers := make([]string, 0, len(history))
+		for _, attempt := range history {
+			providers = append(providers, attempt.Provider)
+		}
+		assert.Equal(s.T(), []string{"SES", "Sendgrid", "SES", "Sendgrid"}, providers)
+		assert.Equal(s.T(), "Sendgrid failed", history[3].Error)
+	}
+}
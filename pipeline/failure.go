@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// permanentError wraps a failure that will happen again no matter how many times the
+// message is retried (e.g. the provider rejected the recipient address).
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func newPermanentError(err error) error {
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// throttledError wraps a failure caused by the provider refusing to take more messages
+// for now. The provider told us when to try again.
+type throttledError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e throttledError) Error() string {
+	return e.err.Error()
+}
+
+func newThrottledError(err error, retryAfter time.Duration) error {
+	return throttledError{err, retryAfter}
+}
+
+func isThrottled(err error) bool {
+	_, ok := err.(throttledError)
+	return ok
+}
+
+// requestedRetryDelay returns the delay a throttling provider asked for, if any.
+func requestedRetryDelay(err error) (time.Duration, bool) {
+	throttled, ok := err.(throttledError)
+	return throttled.retryAfter, ok
+}
+
+// parseRetryAfter reads the value of a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if date.Before(now) {
+		return 0, true
+	}
+	return date.Sub(now), true
+}
+
+// classifyHTTPStatus decides whether the error of an unsuccessful response from a provider's
+// HTTP API is permanent. Client errors mean the provider refused the message itself, except
+// for authentication and rate limiting errors which are problems on our side that go away
+// eventually.
+func classifyHTTPStatus(statusCode int, err error) error {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return err
+	}
+	if statusCode >= 400 && statusCode < 500 {
+		return newPermanentError(err)
+	}
+	return err
+}
+
+// handleFailure decides what happens to a message a provider could not send: permanently
+// rejected messages are dead-lettered right away, anything else is retried later.
+func handleFailure(message *Message, provider string, err error) {
+	message.recordFailure(provider, err)
+	if isPermanent(err) {
+		log.Printf("[ERROR] Message %s was permanently rejected: %v", message.Message.Id, err)
+		deadLetter(message, deadLetterReasonRejected, err)
+		return
+	}
+
+	returnToQueue(message, err)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	fileFormatEml     = "eml"
+	fileFormatMaildir = "maildir"
+)
+
+// FileWorker writes emails to a local directory instead of sending them, either as
+// .eml files or as a Maildir. It can simulate a failure rate and latency, to see how the
+// rest of the pipeline copes with a misbehaving provider.
+type FileWorker struct {
+	config   FileConfig
+	hostname string
+	// sequence number of the files written, to tell apart files written at the same time
+	sequence int64
+}
+
+func newFileWorker(config FileConfig) *FileWorker {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return &FileWorker{config: config, hostname: hostname}
+}
+
+func (w *FileWorker) Send(email *Email) (string, error) {
+	if w.config.LatencyMilliseconds > 0 {
+		time.Sleep(time.Duration(w.config.LatencyMilliseconds) * time.Millisecond)
+	}
+	if w.config.FailureRate > 0 && rand.Float64() < w.config.FailureRate {
+		return "", fmt.Errorf("simulated failure")
+	}
+
+	now := time.Now()
+	messageId := newMessageId(email)
+	contents := formatEmail(email, messageId, now)
+	if w.config.Format == fileFormatMaildir {
+		return messageId, w.writeMaildir(contents, now)
+	}
+	name := fmt.Sprintf("%d-%d.eml", now.UnixNano(), atomic.AddInt64(&w.sequence, 1))
+	return messageId, writeFileAtomically(w.config.Directory, name, contents)
+}
+
+// writeMaildir delivers a message to the new/ directory of a Maildir, through tmp/ as
+// the Maildir format requires.
+func (w *FileWorker) writeMaildir(contents []byte, now time.Time) error {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(w.config.Directory, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	name := fmt.Sprintf(
+		"%d.M%dP%dQ%d.%s",
+		now.Unix(),
+		now.Nanosecond()/1000,
+		os.Getpid(),
+		atomic.AddInt64(&w.sequence, 1),
+		w.hostname,
+	)
+	tmpPath := filepath.Join(w.config.Directory, "tmp", name)
+	if err := ioutil.WriteFile(tmpPath, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(w.config.Directory, "new", name))
+}
+
+// writeFileAtomically writes a file under a temporary name first, so that readers of
+// the directory never see a partially written email.
+func writeFileAtomically(dir, name string, contents []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmpPath, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, name))
+}
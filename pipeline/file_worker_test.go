@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type FileWorkerSuite struct {
+	suite.Suite
+}
+
+func TestFileWorkerSuite(t *testing.T) {
+	suite.Run(t, new(FileWorkerSuite))
+}
+
+func readDir(dir string) []string {
+	infos, _ := ioutil.ReadDir(dir)
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func (s *FileWorkerSuite) TestSend() {
+	testCases := []struct {
+		Case        string
+		Format      string
+		FailureRate float64
+
+		ExpectedError bool
+		// directory the emails end up in, relative to the configured one
+		ExpectedDir string
+	}{
+		{
+			Case:        "Eml files",
+			Format:      fileFormatEml,
+			ExpectedDir: ".",
+		},
+		{
+			Case:        "Maildir",
+			Format:      fileFormatMaildir,
+			ExpectedDir: "new",
+		},
+		{
+			Case:          "Every send fails",
+			Format:        fileFormatEml,
+			FailureRate:   1,
+			ExpectedError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		dir, err := ioutil.TempDir("", "gomail-file-worker")
+		if err != nil {
+			s.T().Fatal(err)
+		}
+		// written to a directory that does not exist yet
+		outbox := filepath.Join(dir, "outbox")
+		w := newFileWorker(FileConfig{Directory: outbox, Format: testCase.Format, FailureRate: testCase.FailureRate})
+
+		for i := 0; i < 3; i++ {
+			messageId, err := w.Send(testEmail())
+			if testCase.ExpectedError {
+				assert.Error(s.T(), err, testCase.Case)
+			} else {
+				assert.NoError(s.T(), err, testCase.Case)
+				assert.True(s.T(), strings.HasSuffix(messageId, "@example.com"), testCase.Case)
+			}
+		}
+
+		if testCase.ExpectedError {
+			assert.Empty(s.T(), readDir(outbox), testCase.Case)
+		} else {
+			names := readDir(filepath.Join(outbox, testCase.ExpectedDir))
+			emails := 0
+			for _, name := range names {
+				path := filepath.Join(outbox, testCase.ExpectedDir, name)
+				if info, err := os.Stat(path); err != nil || info.IsDir() {
+					continue
+				}
+				emails++
+				contents, err := ioutil.ReadFile(path)
+				if assert.NoError(s.T(), err, testCase.Case) {
+					assert.Contains(s.T(), string(contents), "To: <to@example.com>\r\nSubject: Test subject\r\n", testCase.Case)
+					assert.True(s.T(), strings.HasSuffix(string(contents), "\r\n\r\nTest body\r\nSecond line\r\n"), testCase.Case)
+				}
+			}
+			assert.Equal(s.T(), 3, emails, testCase.Case)
+			if testCase.Format == fileFormatMaildir {
+				assert.Empty(s.T(), readDir(filepath.Join(outbox, "tmp")), testCase.Case)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func (s *FileWorkerSuite) TestLatency() {
+	dir, err := ioutil.TempDir("", "gomail-file-worker")
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := newFileWorker(FileConfig{Directory: dir, Format: fileFormatEml, LatencyMilliseconds: 50})
+	start := time.Now()
+	_, err = w.Send(testEmail())
+	assert.NoError(s.T(), err)
+	assert.True(s.T(), time.Since(start) >= 50*time.Millisecond)
+}
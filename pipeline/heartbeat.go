@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"gomail/queue"
+)
+
+// heartbeats holds the heartbeat of every queue, keyed by queue url.
+var heartbeats = make(map[string]*heartbeat)
+
+// heartbeat keeps the messages received from a queue invisible for as long as the
+// pipeline is processing them, so that SQS does not hand them out to another pipeline
+// node when a send takes longer than the queue's visibility timeout. Every third of the
+// visibility timeout, messages whose deadline is near are made invisible for another
+// full visibility timeout.
+type heartbeat struct {
+	queueUrl          string
+	visibilityTimeout int64
+	interval          time.Duration
+
+	mu        sync.Mutex
+	deadlines map[*Message]time.Time
+}
+
+func newHeartbeat(queueUrl string, visibilityTimeout int64) *heartbeat {
+	interval := time.Duration(visibilityTimeout) * time.Second / 3
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return &heartbeat{
+		queueUrl:          queueUrl,
+		visibilityTimeout: visibilityTimeout,
+		interval:          interval,
+		deadlines:         make(map[*Message]time.Time),
+	}
+}
+
+// Track starts extending the visibility of a message that was just received.
+func (h *heartbeat) Track(message *Message) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deadlines[message] = time.Now().Add(time.Duration(h.visibilityTimeout) * time.Second)
+}
+
+// Untrack stops extending the visibility of a message. Since the lock is held while
+// visibility is being extended, no extension can override a visibility change made
+// after Untrack returns.
+func (h *heartbeat) Untrack(message *Message) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.deadlines, message)
+}
+
+// Run extends the visibility of tracked messages every heartbeat interval, until ctx is
+// done.
+func (h *heartbeat) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.beat()
+		}
+	}
+}
+
+func (h *heartbeat) beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	due := make([]*Message, 0)
+	for message, deadline := range h.deadlines {
+		if deadline.Sub(now) < 2*h.interval {
+			due = append(due, message)
+		}
+	}
+
+	for len(due) > 0 {
+		n := len(due)
+		if n > maxEntriesPerBatch {
+			n = maxEntriesPerBatch
+		}
+		h.extend(due[:n], now)
+		due = due[n:]
+	}
+}
+
+func (h *heartbeat) extend(messages []*Message, now time.Time) {
+	changes := make([]queue.VisibilityChange, len(messages))
+	for i, message := range messages {
+		changes[i] = queue.VisibilityChange{
+			ReceiptHandle:     message.Message.ReceiptHandle,
+			VisibilityTimeout: h.visibilityTimeout,
+		}
+	}
+
+	failures, err := queueBackend.ChangeVisibilityBatch(h.queueUrl, changes)
+	if err != nil {
+		log.Printf("[ERROR] Could not extend visibility of %d messages in queue (%s): %v", len(messages), h.queueUrl, err.Error())
+		return
+	}
+
+	deadline := now.Add(time.Duration(h.visibilityTimeout) * time.Second)
+	for i, message := range messages {
+		if failures[i] != nil {
+			log.Printf("[ERROR] Could not extend visibility of a message in queue (%s): %v", h.queueUrl, failures[i].Error())
+			continue
+		}
+		h.deadlines[message] = deadline
+	}
+}
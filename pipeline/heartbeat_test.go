@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gomail/awsmock/mocks"
+	"gomail/queue"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type HeartbeatSuite struct {
+	suite.Suite
+}
+
+func TestHeartbeatSuite(t *testing.T) {
+	suite.Run(t, new(HeartbeatSuite))
+}
+
+func (s *HeartbeatSuite) TestInterval() {
+	assert.Equal(s.T(), 10*time.Second, newHeartbeat(testQueueUrl, 30).interval)
+	assert.Equal(s.T(), time.Second, newHeartbeat(testQueueUrl, 1).interval)
+}
+
+func (s *HeartbeatSuite) TestBeat() {
+	mockSQS := new(mocks.SQSAPI)
+	queueBackend = queue.NewSQS(mockSQS)
+	h := newHeartbeat(testQueueUrl, 30)
+
+	fresh, due, done := testMessage(1), testMessage(2), testMessage(3)
+	h.Track(fresh)
+	h.Track(due)
+	h.Track(done)
+	h.deadlines[due] = time.Now().Add(15 * time.Second)
+	h.deadlines[done] = time.Now().Add(15 * time.Second)
+	h.Untrack(done)
+
+	mockSQS.On("ChangeMessageVisibilityBatch", &sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: aws.String(testQueueUrl),
+		Entries: []*sqs.ChangeMessageVisibilityBatchRequestEntry{
+			{Id: aws.String("0"), ReceiptHandle: aws.String("receipt-2"), VisibilityTimeout: aws.Int64(30)},
+		},
+	}).Return(&sqs.ChangeMessageVisibilityBatchOutput{}, nil).Once()
+	h.beat()
+	mockSQS.AssertExpectations(s.T())
+
+	// the extended message is not due anymore
+	assert.True(s.T(), h.deadlines[due].Sub(time.Now()) > 20*time.Second)
+	h.beat()
+	mockSQS.AssertNumberOfCalls(s.T(), "ChangeMessageVisibilityBatch", 1)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	mailgunRegionUS = "us"
+	mailgunRegionEU = "eu"
+
+	// enough of the response body to tell what went wrong
+	maxMailgunErrorBodySize = 1024
+	// enough of the response body to read the message id from
+	maxMailgunResponseBodySize = 4096
+)
+
+// Mailgun keeps domains created in the EU region on separate servers
+var mailgunBaseUrls = map[string]string{
+	mailgunRegionUS: "https://api.mailgun.net",
+	mailgunRegionEU: "https://api.eu.mailgun.net",
+}
+
+// classifyMailgunResponse turns an unsuccessful Mailgun response into an error. Rate
+// limited sends throttle the worker, until the time given by the Retry-After header if
+// there is one.
+func classifyMailgunResponse(resp *http.Response, body string, now time.Time) error {
+	err := fmt.Errorf("mailgun responded with status code %d: %s", resp.StatusCode, body)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			return newThrottledError(err, retryAfter)
+		}
+		return newThrottledError(err, minThrottleDelay)
+	}
+	return classifyHTTPStatus(resp.StatusCode, err)
+}
+
+// MailgunWorker sends emails through the messages API of a Mailgun domain.
+type MailgunWorker struct {
+	domain  string
+	apiKey  string
+	baseUrl string
+	client  *http.Client
+}
+
+func newMailgunWorker(config MailgunConfig) *MailgunWorker {
+	return &MailgunWorker{
+		domain:  config.Domain,
+		apiKey:  config.ApiKey,
+		baseUrl: mailgunBaseUrls[config.Region],
+		client:  &http.Client{Timeout: time.Duration(config.TimeoutSeconds) * time.Second},
+	}
+}
+
+// mailgunResponse is the response of a successful send.
+type mailgunResponse struct {
+	Id string `json:"id"`
+}
+
+func (w *MailgunWorker) Send(email *Email) (string, error) {
+	form := url.Values{}
+	form.Set("from", email.From())
+	form.Set("to", email.To())
+	form.Set("subject", email.Subject)
+	form.Set("text", email.Body)
+	if email.ReplyTo != "" {
+		form.Set("h:Reply-To", email.ReplyTo)
+	}
+	for _, name := range sortedKeys(email.Headers) {
+		form.Set("h:"+name, email.Headers[name])
+	}
+	// tags are both tags, which the analytics of Mailgun are grouped by, and variables,
+	// which its webhooks pass back
+	for _, tag := range providerTags("Mailgun", email.Tags, mailgunMaxTags, mailgunMaxTagLength) {
+		form.Add("o:tag", tag)
+	}
+	for _, name := range sortedKeys(email.Tags) {
+		form.Set("v:"+name, email.Tags[name])
+	}
+
+	endpoint := fmt.Sprintf("%s/v3/%s/messages", w.baseUrl, url.PathEscape(w.domain))
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("api", w.apiKey)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxMailgunErrorBodySize))
+		return "", classifyMailgunResponse(resp, strings.TrimSpace(string(body)), time.Now())
+	}
+	// the email was accepted whether or not the response can be read
+	var response mailgunResponse
+	json.NewDecoder(io.LimitReader(resp.Body, maxMailgunResponseBodySize)).Decode(&response)
+	// drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	return strings.Trim(response.Id, "<>"), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type MailgunWorkerSuite struct {
+	suite.Suite
+}
+
+func TestMailgunWorkerSuite(t *testing.T) {
+	suite.Run(t, new(MailgunWorkerSuite))
+}
+
+func (s *MailgunWorkerSuite) TestSend() {
+	testCases := []struct {
+		Case         string
+		StatusCode   int
+		RetryAfter   string
+		ResponseBody string
+
+		ExpectedMessageId  string
+		ExpectedError      bool
+		ExpectedPermanent  bool
+		ExpectedRetryAfter time.Duration
+	}{
+		{
+			Case:              "Message queued",
+			StatusCode:        http.StatusOK,
+			ResponseBody:      `{"id":"<20170301120000.1.ABCDEF@mg.example.com>","message":"Queued. Thank you."}`,
+			ExpectedMessageId: "20170301120000.1.ABCDEF@mg.example.com",
+		},
+		{
+			Case:         "Message queued without an id",
+			StatusCode:   http.StatusOK,
+			ResponseBody: "Queued",
+		},
+		{
+			Case:              "Invalid recipient",
+			StatusCode:        http.StatusBadRequest,
+			ResponseBody:      `{"message":"'to' parameter is not a valid address. please check documentation"}`,
+			ExpectedError:     true,
+			ExpectedPermanent: true,
+		},
+		{
+			Case:              "Invalid API key",
+			StatusCode:        http.StatusUnauthorized,
+			ResponseBody:      "Forbidden",
+			ExpectedError:     true,
+			ExpectedPermanent: false,
+		},
+		{
+			Case:               "Rate limited",
+			StatusCode:         http.StatusTooManyRequests,
+			RetryAfter:         "30",
+			ExpectedError:      true,
+			ExpectedPermanent:  false,
+			ExpectedRetryAfter: 30 * time.Second,
+		},
+		{
+			Case:               "Rate limited without Retry-After",
+			StatusCode:         http.StatusTooManyRequests,
+			ExpectedError:      true,
+			ExpectedPermanent:  false,
+			ExpectedRetryAfter: minThrottleDelay,
+		},
+		{
+			Case:              "Server error",
+			StatusCode:        http.StatusInternalServerError,
+			ExpectedError:     true,
+			ExpectedPermanent: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		var request *http.Request
+		var form map[string][]string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			request, form = r, r.PostForm
+			if testCase.RetryAfter != "" {
+				w.Header().Set("Retry-After", testCase.RetryAfter)
+			}
+			w.WriteHeader(testCase.StatusCode)
+			w.Write([]byte(testCase.ResponseBody))
+		}))
+		w := newMailgunWorker(MailgunConfig{Domain: "mg.example.com", ApiKey: "key-123", Region: mailgunRegionEU})
+		w.baseUrl = server.URL
+
+		messageId, err := w.Send(testEmail())
+		server.Close()
+
+		if assert.NotNil(s.T(), request, testCase.Case) {
+			assert.Equal(s.T(), "POST", request.Method, testCase.Case)
+			assert.Equal(s.T(), "/v3/mg.example.com/messages", request.URL.Path, testCase.Case)
+			username, password, ok := request.BasicAuth()
+			assert.True(s.T(), ok, testCase.Case)
+			assert.Equal(s.T(), "api", username, testCase.Case)
+			assert.Equal(s.T(), "key-123", password, testCase.Case)
+			assert.Equal(s.T(), []string{"From Name <from@example.com>"}, form["from"], testCase.Case)
+			assert.Equal(s.T(), []string{"to@example.com"}, form["to"], testCase.Case)
+			assert.Equal(s.T(), []string{"Test subject"}, form["subject"], testCase.Case)
+			assert.Equal(s.T(), []string{"Test body\nSecond line"}, form["text"], testCase.Case)
+		}
+		if testCase.ExpectedError {
+			if assert.Error(s.T(), err, testCase.Case) {
+				assert.Equal(s.T(), testCase.ExpectedPermanent, isPermanent(err), testCase.Case)
+				assert.Contains(s.T(), err.Error(), testCase.ResponseBody, testCase.Case)
+				retryAfter, throttled := requestedRetryDelay(err)
+				assert.Equal(s.T(), testCase.ExpectedRetryAfter != 0, throttled, testCase.Case)
+				assert.Equal(s.T(), testCase.ExpectedRetryAfter, retryAfter, testCase.Case)
+			}
+		} else {
+			assert.NoError(s.T(), err, testCase.Case)
+			assert.Equal(s.T(), testCase.ExpectedMessageId, messageId, testCase.Case)
+		}
+	}
+}
+
+func (s *MailgunWorkerSuite) TestBaseUrl() {
+	us := newMailgunWorker(MailgunConfig{Domain: "mg.example.com", ApiKey: "key-123", Region: mailgunRegionUS})
+	eu := newMailgunWorker(MailgunConfig{Domain: "mg.example.com", ApiKey: "key-123", Region: mailgunRegionEU})
+	assert.Equal(s.T(), "https://api.mailgun.net", us.baseUrl)
+	assert.Equal(s.T(), "https://api.eu.mailgun.net", eu.baseUrl)
+}
+
+func (s *MailgunWorkerSuite) TestReplyToHeadersAndTags() {
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Write([]byte(`{"id":"<20170301120000.1.ABCDEF@mg.example.com>"}`))
+	}))
+	defer server.Close()
+	w := newMailgunWorker(MailgunConfig{Domain: "mg.example.com", ApiKey: "key-123", Region: mailgunRegionUS})
+	w.baseUrl = server.URL
+
+	email := testEmail()
+	email.ReplyTo = "support@example.com"
+	email.Headers = map[string]string{"List-Unsubscribe": "<mailto:unsubscribe@example.com>"}
+	email.Tags = map[string]string{"campaign": "spring-2017", "batch": "7"}
+	_, err := w.Send(email)
+	if assert.NoError(s.T(), err) {
+		assert.Equal(s.T(), []string{"support@example.com"}, form["h:Reply-To"])
+		assert.Equal(s.T(), []string{"<mailto:unsubscribe@example.com>"}, form["h:List-Unsubscribe"])
+		assert.Equal(s.T(), []string{"batch:7", "campaign:spring-2017"}, form["o:tag"])
+		assert.Equal(s.T(), []string{"7"}, form["v:batch"])
+		assert.Equal(s.T(), []string{"spring-2017"}, form["v:campaign"])
+	}
+}
+
+func (s *MailgunWorkerSuite) TestTagLimits() {
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Write([]byte(`{"id":"<20170301120000.1.ABCDEF@mg.example.com>"}`))
+	}))
+	defer server.Close()
+	w := newMailgunWorker(MailgunConfig{Domain: "mg.example.com", ApiKey: "key-123", Region: mailgunRegionUS})
+	w.baseUrl = server.URL
+
+	// Mailgun takes 3 tags of at most 128 characters, all of them are still variables
+	long := strings.Repeat("a", 130)
+	email := testEmail()
+	email.Tags = map[string]string{"a": "1", "b": long, "c": "3", "d": "4", "e": "5"}
+	_, err := w.Send(email)
+	if assert.NoError(s.T(), err) {
+		assert.Equal(s.T(), []string{"a:1", "c:3", "d:4"}, form["o:tag"])
+		assert.Equal(s.T(), []string{long}, form["v:b"])
+		assert.Equal(s.T(), []string{"5"}, form["v:e"])
+	}
+}
@@ -1,29 +1,44 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"gomail/queue"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/aws/aws-sdk-go/service/ses/sesiface"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
 var (
-	sqsClient sqsiface.SQSAPI
-	sesClient sesiface.SESAPI
+	queueBackend queue.Backend
+	sesClient    sesiface.SESAPI
+	deliveryLog  DeliveryLog = nopDeliveryLog{}
 
 	configFilePath = "config.yaml"
 	config         *Config
+
+	routeToEmail   string
+	routeFromEmail string
+	lookupId       string
 )
 
 func parseFlags() {
 	flag.StringVar(&configFilePath, "config", configFilePath, "path to config file (defaults to ./config.yaml)")
+	flag.StringVar(&routeToEmail, "route", "", "print which providers an email to this address would be sent through, and exit")
+	flag.StringVar(&routeFromEmail, "route-from", "", "sender address of the -route dry run")
+	flag.StringVar(&lookupId, "lookup", "", "print the deliveries with this queue or provider message id from the delivery log, and exit")
 	flag.Parse()
 }
 
@@ -38,17 +53,88 @@ func main() {
 		log.Fatal("Could not initialize config: ", err.Error())
 	}
 
-	// initialize sqs & ses clients
+	// dry run of the routing rules
+	if routeToEmail != "" {
+		description, err := describeRoute(routeToEmail, routeFromEmail)
+		if err != nil {
+			log.Fatal("Could not route email: ", err.Error())
+		}
+		fmt.Println(description)
+		return
+	}
+
+	deliveryLog, err = NewDeliveryLog(config.DeliveryLog)
+	if err != nil {
+		log.Fatal("Could not initialize delivery log: ", err.Error())
+	}
+	defer deliveryLog.Close()
+
+	// look deliveries up in the delivery log
+	if lookupId != "" {
+		if err := printDeliveries(lookupId); err != nil {
+			log.Fatal("Could not look up deliveries: ", err.Error())
+		}
+		return
+	}
+
+	// the send budgets are kept in the counter store
+	if config.HasSendBudgets() {
+		counterStore, err = NewCounterStore(config.CounterStore)
+		if err != nil {
+			log.Fatal("Could not initialize counter store: ", err.Error())
+		}
+		defer counterStore.Close()
+		log.Printf("[INFO] Keeping send budgets in %s counter store", config.CounterStore.Type)
+	}
+
+	// initialize the queue backend & ses client
 	awsConfig := aws.NewConfig().
 		WithHTTPClient(&http.Client{Timeout: time.Duration(config.AwsClientTimeoutSeconds) * time.Second}).
 		WithRegion(config.AwsRegion)
 	awsSession := session.New(awsConfig)
-	sqsClient = sqs.New(awsSession)
+	queueBackend, err = queue.New(config.QueueBackend, sqs.New(awsSession))
+	if err != nil {
+		log.Fatal("Could not initialize queue backend: ", err.Error())
+	}
+	log.Printf("[INFO] Using %s queue backend", config.QueueBackend.Type)
 	sesClient = ses.New(awsSession)
 
+	// setup signal handler, the pipeline stops gracefully once a signal is received
+	ctx, cancel := context.WithCancel(context.Background())
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signalChannel
+		log.Printf("Shutdown signal (%v) received, stopping pipeline", sig)
+		cancel()
+	}()
+
 	pipeline := NewPipeline()
+	if err := startAdmin(pipeline); err != nil {
+		log.Fatal("Could not start admin endpoint: ", err.Error())
+	}
+
 	log.Print("Starting pipeline!")
-	if err := pipeline.Run(); err != nil {
+	if err := pipeline.Run(ctx); err != nil {
 		log.Fatal("[ERROR] Pipeline stopped: ", err.Error())
 	}
 }
+
+// printDeliveries prints the deliveries with an id as JSON, one per line.
+func printDeliveries(id string) error {
+	deliveries, err := deliveryLog.Lookup(id)
+	if err != nil {
+		return err
+	}
+	if len(deliveries) == 0 {
+		return fmt.Errorf("no delivery of %s was recorded", id)
+	}
+	for _, delivery := range deliveries {
+		line, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(line))
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	// lines of a message must not be longer than 998 characters (RFC 5322), and should
+	// not be longer than 78
+	maxLineLength       = 998
+	maxHeaderLineLength = 78
+	// base64 lines are as long as quoted-printable ones
+	base64LineLength = 76
+)
+
+// mimeMessage is an email as rendered by a mimeBuilder.
+type mimeMessage struct {
+	From      mail.Address
+	To        []mail.Address
+	Subject   string
+	Date      time.Time
+	MessageId string
+	// further headers, e.g. List-Unsubscribe, written in this order after the standard
+	// ones
+	Headers []mimeHeader
+	Text    string
+	HTML    string
+	// images and other files the HTML body refers to as cid:<ContentId>
+	Inline      []mimeAttachment
+	Attachments []mimeAttachment
+}
+
+type mimeHeader struct {
+	Name  string
+	Value string
+}
+
+type mimeAttachment struct {
+	Filename    string
+	ContentType string
+	// identifies an inline file, without the angle brackets
+	ContentId string
+	Data      []byte
+}
+
+// mimePart is a part of a MIME message, with its body already encoded. A multipart has
+// parts instead of a body.
+type mimePart struct {
+	header   []mimeHeader
+	body     []byte
+	parts    []*mimePart
+	boundary string
+}
+
+// mimeBuilder renders emails as RFC 5322 messages, for SES and any SMTP-style worker.
+// Texts are sent as they are if they are 7 bit clean, and quoted-printable encoded
+// otherwise, files are base64 encoded. The body is the text, or a multipart/alternative
+// of the text and the HTML. Inline files go into a multipart/related with the HTML, and
+// attachments into a multipart/mixed around all of it.
+type mimeBuilder struct {
+	// creates the boundary of every multipart, random unless set
+	newBoundary func() string
+}
+
+// Build renders a message.
+func (b mimeBuilder) Build(message *mimeMessage) []byte {
+	var buf bytes.Buffer
+	writeHeader(&buf, "From", message.From.String())
+	to := make([]string, len(message.To))
+	for i, address := range message.To {
+		to[i] = address.String()
+	}
+	writeHeader(&buf, "To", strings.Join(to, ", "))
+	writeHeader(&buf, "Subject", encodeHeaderValue(message.Subject))
+	writeHeader(&buf, "Date", message.Date.Format(time.RFC1123Z))
+	if message.MessageId != "" {
+		writeHeader(&buf, "Message-ID", "<"+message.MessageId+">")
+	}
+	for _, header := range message.Headers {
+		writeHeader(&buf, header.Name, encodeHeaderValue(header.Value))
+	}
+	writeHeader(&buf, "MIME-Version", "1.0")
+	b.writePart(&buf, b.body(message))
+	return buf.Bytes()
+}
+
+func (b mimeBuilder) body(message *mimeMessage) *mimePart {
+	var body *mimePart
+	switch {
+	case message.HTML == "":
+		body = textPart("text/plain", message.Text)
+	case message.Text == "":
+		body = b.htmlPart(message)
+	default:
+		body = b.multipart("alternative", textPart("text/plain", message.Text), b.htmlPart(message))
+	}
+
+	if len(message.Attachments) == 0 {
+		return body
+	}
+	parts := []*mimePart{body}
+	for _, attachment := range message.Attachments {
+		parts = append(parts, filePart(attachment, "attachment"))
+	}
+	return b.multipart("mixed", parts...)
+}
+
+// htmlPart returns the HTML body, together with the inline files it refers to.
+func (b mimeBuilder) htmlPart(message *mimeMessage) *mimePart {
+	html := textPart("text/html", message.HTML)
+	if len(message.Inline) == 0 {
+		return html
+	}
+	parts := []*mimePart{html}
+	for _, inline := range message.Inline {
+		parts = append(parts, filePart(inline, "inline"))
+	}
+	return b.multipart("related", parts...)
+}
+
+func (b mimeBuilder) multipart(subtype string, parts ...*mimePart) *mimePart {
+	boundary := newRandomBoundary()
+	if b.newBoundary != nil {
+		boundary = b.newBoundary()
+	}
+	return &mimePart{
+		header: []mimeHeader{
+			{"Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary})},
+		},
+		parts:    parts,
+		boundary: boundary,
+	}
+}
+
+func (b mimeBuilder) writePart(buf *bytes.Buffer, part *mimePart) {
+	for _, header := range part.header {
+		writeHeader(buf, header.Name, header.Value)
+	}
+	buf.WriteString("\r\n")
+	if part.parts == nil {
+		buf.Write(part.body)
+		return
+	}
+	for _, child := range part.parts {
+		fmt.Fprintf(buf, "--%s\r\n", part.boundary)
+		b.writePart(buf, child)
+		buf.WriteString("\r\n")
+	}
+	fmt.Fprintf(buf, "--%s--\r\n", part.boundary)
+}
+
+// textPart encodes a text, with CRLF line endings and a final line break.
+func textPart(contentType, text string) *mimePart {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	text = strings.Replace(text, "\n", "\r\n", -1)
+
+	part := &mimePart{header: []mimeHeader{
+		{"Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"})},
+	}}
+	if is7Bit(text) {
+		part.header = append(part.header, mimeHeader{"Content-Transfer-Encoding", "7bit"})
+		part.body = []byte(text)
+		return part
+	}
+
+	var body bytes.Buffer
+	w := quotedprintable.NewWriter(&body)
+	w.Write([]byte(text))
+	w.Close()
+	part.header = append(part.header, mimeHeader{"Content-Transfer-Encoding", "quoted-printable"})
+	part.body = body.Bytes()
+	return part
+}
+
+// filePart base64 encodes an attachment or an inline file.
+func filePart(file mimeAttachment, disposition string) *mimePart {
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	part := &mimePart{header: []mimeHeader{
+		{"Content-Type", contentType},
+		{"Content-Transfer-Encoding", "base64"},
+	}}
+	if file.Filename != "" {
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": file.Filename})
+	}
+	part.header = append(part.header, mimeHeader{"Content-Disposition", disposition})
+	if file.ContentId != "" {
+		part.header = append(part.header, mimeHeader{"Content-ID", "<" + file.ContentId + ">"})
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(file.Data)
+	var body bytes.Buffer
+	for len(encoded) > base64LineLength {
+		body.WriteString(encoded[:base64LineLength] + "\r\n")
+		encoded = encoded[base64LineLength:]
+	}
+	if encoded != "" {
+		body.WriteString(encoded + "\r\n")
+	}
+	part.body = body.Bytes()
+	return part
+}
+
+// is7Bit reports whether a text with CRLF line endings can be sent without encoding.
+func is7Bit(text string) bool {
+	for _, line := range strings.Split(text, "\r\n") {
+		if len(line) > maxLineLength || strings.ContainsAny(line, "\r\n") {
+			return false
+		}
+		for i := 0; i < len(line); i++ {
+			if line[i] >= 0x80 || line[i] == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// encodeHeaderValue encodes the non-ASCII text of a header as RFC 2047 encoded-words,
+// which are split so that none is longer than 75 characters.
+func encodeHeaderValue(value string) string {
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+// writeHeader writes a header, folded at spaces so that its lines are no longer than 78
+// characters where possible. Line breaks within the value are replaced by spaces, so
+// that a value cannot add headers of its own.
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+	buf.WriteString(name + ":")
+	lineLength := len(name) + 1
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && lineLength+1+len(word) > maxHeaderLineLength {
+			buf.WriteString("\r\n")
+			lineLength = 0
+		}
+		buf.WriteString(" " + word)
+		lineLength += 1 + len(word)
+	}
+	buf.WriteString("\r\n")
+}
+
+func newRandomBoundary() string {
+	b := make([]byte, 15)
+	if _, err := rand.Read(b); err != nil {
+		// This should never happen
+		panic("Could not generate MIME boundary: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// newMimeMessage turns an email into the message the MIME builder renders. messageId
+// is left out of the message if it is empty. The custom headers of the email follow
+// Reply-To, in the order of their names.
+func newMimeMessage(email *Email, messageId string, date time.Time) *mimeMessage {
+	message := &mimeMessage{
+		From:      mail.Address{Name: email.FromName, Address: email.FromEmail},
+		To:        []mail.Address{{Name: email.ToName, Address: email.ToEmail}},
+		Subject:   email.Subject,
+		Date:      date,
+		MessageId: messageId,
+		Text:      email.Body,
+	}
+	if email.ReplyTo != "" {
+		message.Headers = append(message.Headers, mimeHeader{"Reply-To", (&mail.Address{Address: email.ReplyTo}).String()})
+	}
+	for _, name := range sortedKeys(email.Headers) {
+		message.Headers = append(message.Headers, mimeHeader{name, email.Headers[name]})
+	}
+	return message
+}
+
+// formatEmail renders an email as an RFC 5322 message.
+func formatEmail(email *Email, messageId string, date time.Time) []byte {
+	return mimeBuilder{}.Build(newMimeMessage(email, messageId, date))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden files of the MIME builder tests")
+
+type MIMESuite struct {
+	suite.Suite
+}
+
+func TestMIMESuite(t *testing.T) {
+	suite.Run(t, new(MIMESuite))
+}
+
+// testMimeBuilder numbers the boundaries of every message it builds, so that its
+// messages can be compared with golden files.
+func testMimeBuilder() mimeBuilder {
+	n := 0
+	return mimeBuilder{newBoundary: func() string {
+		n++
+		return fmt.Sprintf("gomail-boundary-%d", n)
+	}}
+}
+
+func testMimeMessage() *mimeMessage {
+	return &mimeMessage{
+		From:      mail.Address{Name: "From Name", Address: "from@example.com"},
+		To:        []mail.Address{{Address: "to@example.com"}},
+		Subject:   "Test subject",
+		Date:      time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC),
+		MessageId: "123abc@example.com",
+		Text:      "Test body\nSecond line",
+	}
+}
+
+// testPNG is the start of a PNG file, which is all the tests need.
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+
+func (s *MIMESuite) TestBuild() {
+	testCases := []struct {
+		Case   string
+		Golden string
+		Modify func(message *mimeMessage)
+	}{
+		{
+			Case:   "Plain text",
+			Golden: "plain.eml",
+			Modify: func(message *mimeMessage) {},
+		},
+		{
+			Case:   "Non-ASCII text and headers",
+			Golden: "non_ascii.eml",
+			Modify: func(message *mimeMessage) {
+				message.From.Name = "Jürgen Müller"
+				message.Subject = "Grüße aus Köln – Ihre Bestellung ist unterwegs und kommt bald bei Ihnen an"
+				message.Text = "Hallo,\r\n\r\nIhre Bestellung über 42 € ist unterwegs.\r\n"
+			},
+		},
+		{
+			Case:   "Line longer than 998 characters",
+			Golden: "long_line.eml",
+			Modify: func(message *mimeMessage) {
+				message.Text = strings.Repeat("0123456789", 100)
+			},
+		},
+		{
+			Case:   "Text and HTML",
+			Golden: "alternative.eml",
+			Modify: func(message *mimeMessage) {
+				message.HTML = "<p>Test body</p>\n<p>Second line</p>"
+			},
+		},
+		{
+			Case:   "HTML only",
+			Golden: "html.eml",
+			Modify: func(message *mimeMessage) {
+				message.Text = ""
+				message.HTML = "<p>Test body</p>"
+			},
+		},
+		{
+			Case:   "Inline image, attachment and custom headers",
+			Golden: "mixed.eml",
+			Modify: func(message *mimeMessage) {
+				message.To = append(message.To, mail.Address{Name: "Zoë", Address: "zoe@example.com"})
+				message.Headers = []mimeHeader{
+					{"List-Unsubscribe", "<mailto:unsubscribe@example.com?subject=unsubscribe>, <https://example.com/unsubscribe?user=0123456789abcdef>"},
+					{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+				}
+				message.HTML = `<p>Test body</p><img src="cid:logo@example.com">`
+				message.Inline = []mimeAttachment{
+					{Filename: "logo.png", ContentType: "image/png", ContentId: "logo@example.com", Data: testPNG},
+				}
+				message.Attachments = []mimeAttachment{
+					{Filename: "Rechnung März.txt", ContentType: "text/plain", Data: []byte(strings.Repeat("invoice line\n", 10))},
+				}
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		message := testMimeMessage()
+		testCase.Modify(message)
+		built := testMimeBuilder().Build(message)
+
+		path := filepath.Join("fixtures", "mime", testCase.Golden)
+		if *updateGolden {
+			s.Require().NoError(ioutil.WriteFile(path, built, 0644))
+		}
+		golden, err := ioutil.ReadFile(path)
+		if assert.NoError(s.T(), err, testCase.Case) {
+			assert.Equal(s.T(), string(golden), string(built), testCase.Case)
+		}
+
+		// every line ends with CRLF, and none is too long
+		assert.Equal(s.T(), strings.Count(string(built), "\n"), strings.Count(string(built), "\r\n"), testCase.Case)
+		for _, line := range strings.Split(string(built), "\r\n") {
+			assert.True(s.T(), len(line) <= maxLineLength, testCase.Case)
+		}
+	}
+}
+
+// readPart decodes the body of a part of a message, according to its transfer encoding.
+func readPart(s *MIMESuite, header mail.Header, body io.Reader) string {
+	if header.Get("Content-Transfer-Encoding") == "quoted-printable" {
+		body = quotedprintable.NewReader(body)
+	}
+	contents, err := ioutil.ReadAll(body)
+	s.Require().NoError(err)
+	return string(contents)
+}
+
+func (s *MIMESuite) TestReadBack() {
+	message := testMimeMessage()
+	message.Subject = "Grüße aus Köln – Ihre Bestellung ist unterwegs und kommt bald bei Ihnen an"
+	message.Text = "Ihre Bestellung über 42 € ist unterwegs."
+	message.HTML = `<p>Ihre Bestellung über 42 € ist unterwegs.</p><img src="cid:logo@example.com">`
+	message.Inline = []mimeAttachment{{Filename: "logo.png", ContentType: "image/png", ContentId: "logo@example.com", Data: testPNG}}
+	message.Attachments = []mimeAttachment{{Filename: "Rechnung März.pdf", ContentType: "application/pdf", Data: bytes.Repeat([]byte{0, 1, 2, 255}, 100)}}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(mimeBuilder{}.Build(message)))
+	s.Require().NoError(err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), message.Subject, subject)
+
+	// mixed: alternative (text, related (html, inline)), attachment
+	parts := map[string]string{}
+	var walk func(header mail.Header, body io.Reader)
+	walk = func(header mail.Header, body io.Reader) {
+		mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+		s.Require().NoError(err)
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			parts[mediaType] = readPart(s, header, body)
+			return
+		}
+		parts[mediaType] = ""
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return
+			}
+			s.Require().NoError(err)
+			walk(mail.Header(part.Header), part)
+		}
+	}
+	walk(parsed.Header, parsed.Body)
+
+	assert.Contains(s.T(), parts, "multipart/mixed")
+	assert.Contains(s.T(), parts, "multipart/alternative")
+	assert.Contains(s.T(), parts, "multipart/related")
+	assert.Equal(s.T(), message.Text+"\r\n", parts["text/plain"])
+	assert.Equal(s.T(), message.HTML+"\r\n", parts["text/html"])
+	assert.Contains(s.T(), parts, "image/png")
+	assert.Contains(s.T(), parts, "application/pdf")
+}
+
+func (s *MIMESuite) TestHeaderInjection() {
+	message := testMimeMessage()
+	message.Subject = "Hello\r\nBcc: victim@example.com"
+	message.Headers = []mimeHeader{{"X-Campaign", "spring\nBcc: victim@example.com"}}
+	message.From.Name = "From\r\nBcc: victim@example.com"
+
+	// line breaks cannot start headers of their own
+	built := string(testMimeBuilder().Build(message))
+	assert.NotContains(s.T(), built, "\nBcc:")
+	assert.Equal(s.T(), 1, strings.Count(built, "\r\nX-Campaign: "))
+}
+
+func (s *MIMESuite) TestFormatEmail() {
+	email := testEmail()
+	email.Subject = "Grüße"
+	email.Body = "Windows\r\nand Unix\nline endings"
+	message := string(formatEmail(email, "123abc@example.com", time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)))
+
+	assert.Contains(s.T(), message, "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n")
+	assert.Contains(s.T(), message, "Date: Wed, 01 Mar 2017 12:00:00 +0000\r\n")
+	assert.Contains(s.T(), message, "Message-ID: <123abc@example.com>\r\n")
+	assert.True(s.T(), strings.HasSuffix(message, "\r\n\r\nWindows\r\nand Unix\r\nline endings\r\n"))
+	assert.Equal(s.T(), strings.Count(message, "\n"), strings.Count(message, "\r\n"))
+
+	// without a message id, there is no Message-ID header
+	assert.NotContains(s.T(), string(formatEmail(email, "", time.Now())), "Message-ID")
+
+	// Reply-To comes before the custom headers, which are in the order of their names
+	email.ReplyTo = "support@example.com"
+	email.Headers = map[string]string{"X-Campaign": "spring", "List-Unsubscribe": "<mailto:unsubscribe@example.com>"}
+	message = string(formatEmail(email, "", time.Now()))
+	assert.Contains(s.T(), message, "\r\nReply-To: <support@example.com>\r\nList-Unsubscribe: <mailto:unsubscribe@example.com>\r\nX-Campaign: spring\r\nMIME-Version: 1.0\r\n")
+}
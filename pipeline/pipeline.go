@@ -1,20 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/sqs"
-)
-
-const (
-	maxNumberOfMessagesPerReceive = 10
-	maxNumberOfMessagesPerQueue   = 120000
+	"gomail/queue"
 )
 
 type MessageBody struct {
@@ -28,6 +23,11 @@ type Email struct {
 	ToName    string `json:"toName"`
 	Subject   string `json:"subject"`
 	Body      string `json:"body"`
+	ReplyTo   string `json:"replyTo,omitempty"`
+	// further headers, validated by the API
+	Headers map[string]string `json:"headers,omitempty"`
+	// passed to the providers for their analytics
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 func (e Email) From() string {
@@ -45,246 +45,461 @@ func (e Email) To() string {
 }
 
 type Message struct {
-	Message  *sqs.Message
+	Message  *queue.Message
 	QueueUrl string
+	Email    *Email
+	// priority of the queue the message was received from
+	Priority string
+
+	receivedAt time.Time
+	finishOnce sync.Once
+	// failed attempts, including the ones made before the message was requeued
+	history []failedAttempt
+	// attempts made before the message was requeued
+	requeuedAttempts int
 }
 
-func NewMessage(message *sqs.Message, queueUrl string) *Message {
-	return &Message{
-		Message:  message,
-		QueueUrl: queueUrl,
-	}
-}
-
-type Worker interface {
-	Send(emails []string, failures chan<- int)
+// finish marks the message as no longer held by the pipeline, which frees up its slot
+// of the in-flight budget.
+func (m *Message) finish() {
+	m.finishOnce.Do(func() {
+		heartbeats[m.QueueUrl].Untrack(m)
+		groups.Release(m)
+		if inFlight != nil {
+			inFlight.Release(m.QueueUrl, 1)
+		}
+	})
 }
 
-type worker struct {
-	isHealthy             bool
-	consecHealthyChecks   int
-	consecUnhealthyChecks int
+// Attempt returns the number of the current delivery attempt for this message.
+func (m *Message) Attempt() int {
+	if m.Message.ReceiveCount < 1 {
+		return m.requeuedAttempts + 1
+	}
+	return m.requeuedAttempts + m.Message.ReceiveCount
 }
 
-func (w *worker) UpdateHealthStatus(workerName string, failures int) {
-	if failures > 0 {
-		if w.isHealthy {
-			w.consecUnhealthyChecks++
-		} else {
-			w.consecHealthyChecks = 0
-		}
-	} else {
-		if w.isHealthy {
-			w.consecUnhealthyChecks = 0
-		} else {
-			w.consecHealthyChecks++
-		}
+func NewMessage(message *queue.Message, queueUrl string) *Message {
+	history := attemptHistory(message)
+	return &Message{
+		Message:          message,
+		QueueUrl:         queueUrl,
+		receivedAt:       time.Now(),
+		history:          history,
+		requeuedAttempts: len(history),
 	}
+}
 
-	if w.isHealthy && w.consecUnhealthyChecks >= config.UnhealthyThreshold {
-		log.Printf("[INFO] Setting worker %s health status to UNHEALTHY", workerName)
-		w.isHealthy = false
+func messageToEmail(message *queue.Message) (*Email, error) {
+	var messageBody MessageBody
+	body := []byte(message.Body)
+	if err := json.Unmarshal(body, &messageBody); err != nil {
+		log.Print("[ERROR] Could not convert SQS message body to email: ", err.Error())
+		return nil, err
 	}
-	if !w.isHealthy && w.consecHealthyChecks >= config.HealthyThreshold {
-		log.Printf("[INFO] Setting worker %s health status to HEALTHY", workerName)
-		w.isHealthy = true
+	if messageBody.Email == nil {
+		return nil, fmt.Errorf("message body has no email")
 	}
+
+	return messageBody.Email, nil
 }
 
 func NewPipeline() *Pipeline {
+	workers := make([]*worker, 0, len(config.Providers))
+	for _, provider := range config.Providers {
+		workers = append(workers, newProviderWorker(provider))
+	}
+
 	return &Pipeline{
-		SendgridWorker: &SendgridWorker{worker: &worker{isHealthy: true}},
-		SESWorker:      &SESWorker{worker: &worker{isHealthy: true}},
+		workers:  workers,
+		messages: newPriorityQueue(config.PriorityWeights, config.MessageBufferSize),
 	}
 }
 
-type Pipeline struct {
-	SendgridWorker *SendgridWorker
-	SESWorker      *SESWorker
+// newProviderWorker creates the worker of an enabled provider, with the provider's send
+// budget if it has one.
+func newProviderWorker(provider string) *worker {
+	var w *worker
+	limits := config.ProviderConfig(provider)
+	switch provider {
+	case providerSES:
+		w = newWorker("SES", newSESWorker(config.SES), limits)
+	case providerSendgrid:
+		w = newWorker("Sendgrid", newSendgridWorker(config.SendgridApiKey), limits)
+	case providerSMTP:
+		w = newWorker("SMTP", newSMTPWorker(config.SMTP), limits)
+	case providerMailgun:
+		w = newWorker("Mailgun", newMailgunWorker(config.Mailgun), limits)
+	case providerWebhook:
+		w = newWorker("Webhook", newWebhookWorker(config.Webhook), limits)
+	case providerFile:
+		w = newWorker("File", newFileWorker(config.File), limits)
+	default:
+		// unknown providers are rejected by NewConfig
+		panic("unknown provider " + provider)
+	}
+	w.budget = newSendBudget(provider, limits, counterStore)
+	return w
 }
 
-func Read() []*Message {
-	t := time.Now()
-	messages := make([]*Message, 0)
-	var wg sync.WaitGroup
+// Pipeline continuously receives messages from all queues through long-polling
+// consumers, and splits them between its workers based on each worker's health status.
+type Pipeline struct {
+	workers            []*worker
+	messages           *priorityQueue
+	queues             []*queueStats
+	visibilityTimeouts map[string]int64
+	stats              pipelineStats
+	pause              pauseSwitch
+
+	mu         sync.Mutex
+	nextWorker int
+}
 
-	for _, queueUrl := range config.QueueUrls {
-		resp, err := sqsClient.GetQueueAttributes(&sqs.GetQueueAttributesInput{
-			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
-			QueueUrl:       &queueUrl,
-		})
-		if err != nil {
-			log.Print("[ERROR] error retrieving queue attributes: %v", err.Error())
-			continue
-		}
+// pipelineStats counts what happened to the messages received since startup.
+type pipelineStats struct {
+	received   int64
+	sent       int64
+	failed     int64
+	expired    int64
+	throttled  int64
+	handedBack int64
+}
 
-		messageCountStr := resp.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]
-		messageCount, err := strconv.ParseInt(*messageCountStr, 10, 64)
+// Run starts consuming all queues and sending the received messages until ctx is done,
+// at which point the pipeline shuts down gracefully (see shutdown).
+func (p *Pipeline) Run(ctx context.Context) error {
+	p.visibilityTimeouts = make(map[string]int64, len(config.Queues))
+	p.queues = make([]*queueStats, 0, len(config.Queues))
+	weights := make(map[string]int, len(config.Queues))
+	for _, queue := range config.Queues {
+		p.queues = append(p.queues, &queueStats{url: queue.Url})
+		weights[queue.Url] = queue.Weight
+		visibilityTimeout, err := queueBackend.VisibilityTimeout(queue.Url)
 		if err != nil {
-			log.Print("[ERROR] error converting ApproximateNumberOfMessages to int")
-			continue
+			return fmt.Errorf("could not read visibility timeout of queue (%s): %v", queue.Url, err)
 		}
+		p.visibilityTimeouts[queue.Url] = visibilityTimeout
+		heartbeats[queue.Url] = newHeartbeat(queue.Url, visibilityTimeout)
+	}
 
-		// thresholding the maximum number of inflight messages
-		if messageCount > maxNumberOfMessagesPerQueue {
-			messageCount = maxNumberOfMessagesPerQueue
+	capacity := inFlightCapacity(p.workers, p.visibilityTimeouts)
+	log.Printf("[INFO] Holding up to %d in-flight messages", capacity)
+	inFlight = newBudget(capacity, weights)
+	groups = newSequencer()
+
+	var senders sync.WaitGroup
+	for _, w := range p.workers {
+		for i := 0; i < w.concurrency; i++ {
+			senders.Add(1)
+			go func(w *worker) {
+				defer senders.Done()
+				p.work(ctx, w)
+			}(w)
 		}
+	}
 
-		messagesC := make(chan *sqs.Message)
-		doneReading := make(chan struct{})
-		readersCount := (messageCount / maxNumberOfMessagesPerReceive) + 1
-		log.Printf("[INFO] Using %d readers to receive messages from queue (%s)", readersCount, queueUrl)
-		for i := int64(0); i < readersCount; i++ {
-			wg.Add(1)
-			go read(queueUrl, messagesC, &wg)
+	var consumers sync.WaitGroup
+	for _, stats := range p.queues {
+		queue := config.Queue(stats.url)
+		_, share := inFlight.Held(queue.Url)
+		log.Printf(
+			"[INFO] Using %d consumers to receive %s priority messages from queue (%s), holding at least %d of them while other queues are busy",
+			config.ConsumersPerQueue,
+			queue.Priority,
+			queue.Url,
+			share,
+		)
+		for i := 0; i < config.ConsumersPerQueue; i++ {
+			consumers.Add(1)
+			go func(stats *queueStats) {
+				defer consumers.Done()
+				p.consume(ctx, stats)
+			}(stats)
 		}
+	}
 
+	// heartbeats and acknowledgements are still needed while shutting down
+	background, stopBackground := context.WithCancel(context.Background())
+	var backgroundTasks sync.WaitGroup
+	runInBackground := func(task func()) {
+		backgroundTasks.Add(1)
 		go func() {
-			for {
-				message, ok := <-messagesC
-				if !ok {
-					doneReading <- struct{}{}
-					return
-				}
-				messages = append(messages, NewMessage(message, queueUrl))
-			}
+			defer backgroundTasks.Done()
+			task()
 		}()
-		wg.Wait()
-		close(messagesC)
-		<-doneReading
+	}
+	for _, h := range heartbeats {
+		h := h
+		runInBackground(func() { h.Run(background) })
+	}
+	runInBackground(func() { acks.Run(background) })
+	runInBackground(func() { p.checkHealth(ctx) })
+	for _, w := range p.workers {
+		if pacer, ok := w.Worker.(pacer); ok {
+			runInBackground(func() { pacer.pace(ctx) })
+		}
 	}
 
-	took := time.Since(t)
-	log.Printf("[INFO] Took %v to read %d messages", took, len(messages))
-	return messages
+	p.dispatch(ctx)
+	p.shutdown(&consumers, &senders)
+	stopBackground()
+	backgroundTasks.Wait()
+	return nil
 }
 
-func read(queueUrl string, messagesC chan<- *sqs.Message, wg *sync.WaitGroup) {
-	defer wg.Done()
+// dispatch hands every received message to the worker chosen by route, in the
+// weighted-fair order of their priorities, until ctx is done.
+func (p *Pipeline) dispatch(ctx context.Context) {
+	for {
+		message := p.messages.Pop(ctx)
+		if message == nil {
+			return
+		}
 
-	resp, err := sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
-		QueueUrl:            &queueUrl,
-		MaxNumberOfMessages: aws.Int64(10),
-	})
-	if err != nil {
-		log.Print("[ERROR] error retrieving messages: %v", err.Error())
-		return
-	}
+		email, err := messageToEmail(message.Message)
+		if err != nil {
+			go deadLetter(message, deadLetterReasonUnparseable, err)
+			continue
+		}
+		message.Email = email
 
-	for _, message := range resp.Messages {
-		messagesC <- message
-	}
-}
+		if groups.Overtakes(message) {
+			p.handBack(message)
+			continue
+		}
+		if groups.Join(message) != nil {
+			// sent by the worker of its group once the messages before it are done
+			continue
+		}
+		if p.expire(message) {
+			continue
+		}
 
-func messageToEmail(message *sqs.Message) (*Email, error) {
-	var messageBody MessageBody
-	body := []byte(*message.Body)
-	if err := json.Unmarshal(body, &messageBody); err != nil {
-		log.Print("[ERROR] Could not convert SQS message body to email: ", err.Error())
-		return nil, err
+		w := p.routeMessage(message)
+		if w == nil {
+			// try again once somebody enabled a worker
+			log.Printf("[ERROR] All workers are disabled, returning message %s to queue", message.Message.Id)
+			groups.Returned(message)
+			acks.ChangeVisibility(message, config.RetryBaseDelaySeconds, nil)
+			continue
+		}
+		groups.Start(message, w)
+		if !w.enqueue(ctx, message) {
+			p.handBack(message)
+		}
 	}
+}
 
-	return messageBody.Email, nil
+// route picks the worker the next message goes to. Messages are spread between healthy
+// workers according to how busy each of them is, while every unhealthy worker gets 1
+// message per health check window to see if it is still unhealthy. If all workers are
+// unhealthy, messages are spread between all of them until one of them becomes
+// healthy again. Throttled workers only get messages if all workers are throttled.
+// Disabled workers get no messages at all; route returns nil if all workers are
+// disabled.
+func (p *Pipeline) route() *worker {
+	return p.routeBetween(p.workers)
 }
 
-func (p *Pipeline) Run() error {
-	sendgridFailures := make(chan int)
-	sesFailures := make(chan int)
-	for {
-		t := time.Now()
-		log.Print("[INFO] Reading messages from queue(s)")
-		messages := Read()
-		p.run(messages, sendgridFailures, sesFailures)
-
-		minIterDuration := time.Duration(config.MinimumIterationDurationMilliseconds) * time.Millisecond
-		took := time.Since(t)
-		log.Printf("[INFO] Pipeline iteration took %v to execute", took)
-		if took < minIterDuration {
-			sleepDuration := minIterDuration - took
-			log.Printf("[INFO] Pipeline sleeping for %v", sleepDuration)
-			time.Sleep(sleepDuration)
+// routeBetween routes the next message to one of the given workers, like route.
+func (p *Pipeline) routeBetween(workers []*worker) *worker {
+	workers = unthrottled(workers)
+	availableWorkers := make([]*worker, 0, len(workers))
+	healthyWorkers := make([]*worker, 0, len(workers))
+	for _, w := range workers {
+		if !w.IsAvailable() {
+			continue
+		}
+		availableWorkers = append(availableWorkers, w)
+		if w.IsHealthy() {
+			healthyWorkers = append(healthyWorkers, w)
 		}
 	}
-
-	return fmt.Errorf("Execution stopped unexpectedly")
-}
-
-func (p *Pipeline) run(messages []*Message, sendgridFailures, sesFailures chan int) {
-	// Break early if no messages read
-	if len(messages) == 0 {
-		return
+	if len(availableWorkers) == 0 {
+		return nil
+	}
+	if len(healthyWorkers) == 0 {
+		return p.leastLoaded(availableWorkers)
 	}
 
-	splitPoint := p.calculateSplitPoint(len(messages))
-	sendgridMessages := messages[splitPoint:]
-	sesMessages := messages[:splitPoint]
-	runningWorkers := 0
-
-	if len(sendgridMessages) > 0 {
-		log.Printf("[INFO] Sendgrid dispatched with %d messages", len(sendgridMessages))
-		runningWorkers++
-		go p.SendgridWorker.Send(sendgridMessages, sendgridFailures)
+	for _, w := range availableWorkers {
+		if !w.IsHealthy() && w.claimProbe() {
+			return w
+		}
 	}
-	if len(sesMessages) > 0 {
-		log.Printf("[INFO] SES dispatched with %d messages", len(sesMessages))
-		runningWorkers++
-		go p.SESWorker.Send(sesMessages, sesFailures)
+	return p.leastLoaded(healthyWorkers)
+}
+
+// leastLoaded returns the least busy of the given workers. Ties are broken in a round
+// robin fashion so that idle workers share messages evenly.
+func (p *Pipeline) leastLoaded(workers []*worker) *worker {
+	p.mu.Lock()
+	p.nextWorker++
+	start := p.nextWorker
+	p.mu.Unlock()
+
+	var chosen *worker
+	minLoad := 0.0
+	for i := range workers {
+		w := workers[(start+i)%len(workers)]
+		if load := w.load(); chosen == nil || load < minLoad {
+			chosen, minLoad = w, load
+		}
 	}
+	return chosen
+}
 
-	for i := 0; i < runningWorkers; i++ {
+// work sends the messages routed to a worker, one at a time and no faster than the
+// worker's rate limit, until ctx is done. Each worker runs max_concurrency of these. The
+// messages of a FIFO message group are sent one after the other by the same sender.
+func (p *Pipeline) work(ctx context.Context, w *worker) {
+	for {
 		select {
-		case failures := <-sendgridFailures:
-			log.Printf("[INFO] Sendgrid finished with %d failures", failures)
-			p.SendgridWorker.UpdateHealthStatus("Sendgrid", failures)
-		case failures := <-sesFailures:
-			log.Printf("[INFO] SES finished with %d failures", failures)
-			p.SESWorker.UpdateHealthStatus("SES", failures)
+		case <-ctx.Done():
+			return
+		case message := <-w.jobs:
+			for message != nil {
+				// an expired message is done with, the rest of its group goes on
+				done := true
+				if p.expire(message) {
+					w.unassign()
+				} else {
+					w.limiter.Wait()
+					if ctx.Err() != nil {
+						// shutting down, the message has not been sent yet
+						p.handBack(message)
+						return
+					}
+					done = p.send(ctx, w, message)
+				}
+
+				var handBack []*Message
+				message, handBack = groups.Next(message, done)
+				for _, m := range handBack {
+					p.handBack(m)
+				}
+			}
 		}
 	}
 }
 
-func (p *Pipeline) calculateSplitPoint(size int) int {
-	// when only 1 message needs to be sent, prioritize a healthy worker - if any
-	if size == 1 {
-		if p.SendgridWorker.isHealthy {
-			return 0
-		} else {
-			return 1
+// send sends a message through a worker, and reports whether it was sent. A message
+// the provider throttled is held or rerouted (see holdThrottled).
+func (p *Pipeline) send(ctx context.Context, w *worker, message *Message) bool {
+	providerMessageId, err := w.Send(message.Email)
+	throttledSince := time.Now()
+	for isThrottled(err) {
+		if !p.holdThrottled(ctx, w, message, err, throttledSince) {
+			return false
 		}
+		w.limiter.Wait()
+		providerMessageId, err = w.Send(message.Email)
+	}
+	if err != nil {
+		log.Printf(
+			"[ERROR] %s: Could not send email (message %s, %s priority, attempt %d): %v",
+			w.name,
+			message.Message.Id,
+			message.Priority,
+			message.Attempt(),
+			err.Error(),
+		)
+		atomic.AddInt64(&p.stats.failed, 1)
+		p.messages.recordResult(message.Priority, false)
+		handleFailure(message, w.name, err)
+		// a rejected message says nothing about the health of the worker
+		w.recordResult(!isPermanent(err), err)
+		return false
 	}
 
-	switch {
-	case p.SendgridWorker.isHealthy && p.SESWorker.isHealthy ||
-		!p.SendgridWorker.isHealthy && !p.SESWorker.isHealthy:
-		return size / 2
-	case p.SendgridWorker.isHealthy: // Sendgrid healthy but SES not healthy
-		return 1
-	default: // SES healthy but Sendgrid not healthy
-		return size - 1
+	atomic.AddInt64(&p.stats.sent, 1)
+	p.messages.recordResult(message.Priority, true)
+	if err := deliveryLog.Record(newDelivery(message, w.name, providerMessageId, time.Now())); err != nil {
+		log.Printf("[ERROR] Could not record delivery of message %s by %s: %v", message.Message.Id, w.name, err)
 	}
-}
 
-func deleteFromQueue(message *Message) error {
-	_, err := sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
-		QueueUrl:      &message.QueueUrl,
-		ReceiptHandle: message.Message.ReceiptHandle,
+	deleteFromQueue(message, func(err error) {
+		if err != nil {
+			log.Printf("[ERROR] Message %s was sent by %s but stays in the queue, it will be sent again", message.Message.Id, w.name)
+		}
 	})
-	if err != nil {
-		log.Print("[ERROR] Could not delete message from queue: %v", err.Error())
-		return err
+	w.recordResult(false, nil)
+	return true
+}
+
+// checkHealth closes a health check window for all workers every
+// health_check_interval_milliseconds, and reports acknowledgements that failed during it.
+func (p *Pipeline) checkHealth(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.HealthCheckIntervalMilliseconds) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, w := range p.workers {
+			w.endWindow()
+		}
+
+		log.Printf("[INFO] %d messages in flight, dispatched by priority %s", inFlight.InFlight(), p.messages.endWindow())
+		log.Printf("[INFO] Messages received by queue during the last interval: %s", p.endReceiveWindow())
+
+		failedDeletes, failedVisibilityChanges := acks.Failures()
+		if failedDeletes > 0 || failedVisibilityChanges > 0 {
+			log.Printf(
+				"[ERROR] %d deletes and %d visibility changes failed during the last interval",
+				failedDeletes,
+				failedVisibilityChanges,
+			)
+		}
 	}
-	return nil
 }
 
-func returnToQueue(message *Message) error {
-	_, err := sqsClient.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
-		QueueUrl:          &message.QueueUrl,
-		ReceiptHandle:     message.Message.ReceiptHandle,
-		VisibilityTimeout: aws.Int64(0),
-	})
-	if err != nil {
-		log.Print("[ERROR] Could not set visibility timeout to zero: %v", err.Error())
-		return err
+// deleteFromQueue acknowledges a message that does not need to be processed again.
+func deleteFromQueue(message *Message, done func(error)) {
+	acks.Delete(message, done)
+}
+
+// returnToQueue retries a failed message after a backoff delay that grows with the
+// number of attempts, or after the delay a throttling provider asked for. Messages of
+// standard queues are requeued together with their attempt history, so that they can be
+// retried through a provider that did not fail them yet, and wait for at most 15
+// minutes. Messages of FIFO queues, which must keep their place in their group, are made
+// visible again instead. Once the message has been attempted max_attempts times, or all
+// providers failed it max_failures_per_provider times, it is moved to the dead letter
+// queue instead.
+func returnToQueue(message *Message, cause error) {
+	attempt := message.Attempt()
+	if attempt >= config.MaxAttempts {
+		log.Printf("[ERROR] Giving up on message %s after %d attempts", message.Message.Id, attempt)
+		deadLetter(message, deadLetterReasonExhausted, cause)
+		return
 	}
-	return nil
+	if failedEverywhere(message.history) {
+		log.Printf("[ERROR] Giving up on message %s, all providers failed it %d times", message.Message.Id, config.MaxFailuresPerProvider)
+		deadLetter(message, deadLetterReasonFailedEverywhere, cause)
+		return
+	}
+
+	visibilityTimeout := retryVisibilityTimeout(attempt, cause)
+	if !queue.IsFIFO(message.QueueUrl) {
+		if visibilityTimeout > queue.MaxDelaySeconds {
+			visibilityTimeout = queue.MaxDelaySeconds
+		}
+		if !requeue(message, visibilityTimeout) {
+			acks.ChangeVisibility(message, visibilityTimeout, nil)
+		}
+	} else {
+		acks.ChangeVisibility(message, visibilityTimeout, nil)
+	}
+	log.Printf(
+		"[INFO] Message %s will be retried in %ds (attempt %d/%d)",
+		message.Message.Id,
+		visibilityTimeout,
+		attempt+1,
+		config.MaxAttempts,
+	)
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"gomail/awsmock/mocks"
+	"gomail/queue"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type PipelineSuite struct {
+	suite.Suite
+}
+
+func TestPipelineSuite(t *testing.T) {
+	suite.Run(t, new(PipelineSuite))
+}
+
+type nopWorker struct{}
+
+func (w *nopWorker) Send(email *Email) (string, error) {
+	return "", nil
+}
+
+func routeCounts(p *Pipeline, messages int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < messages; i++ {
+		counts[p.route().name]++
+	}
+	return counts
+}
+
+func (s *PipelineSuite) TestRoute() {
+	testCases := []struct {
+		Case           string
+		Healthy        map[string]bool
+		Disabled       map[string]bool
+		ExpectedCounts map[string]int
+	}{
+		{
+			Case:           "All workers healthy",
+			Healthy:        map[string]bool{"A": true, "B": true},
+			ExpectedCounts: map[string]int{"A": 5, "B": 5},
+		},
+		{
+			Case:           "One worker unhealthy",
+			Healthy:        map[string]bool{"A": true, "B": false},
+			ExpectedCounts: map[string]int{"A": 9, "B": 1},
+		},
+		{
+			Case:           "All workers unhealthy",
+			Healthy:        map[string]bool{"A": false, "B": false},
+			ExpectedCounts: map[string]int{"A": 5, "B": 5},
+		},
+		{
+			Case:           "One worker disabled",
+			Healthy:        map[string]bool{"A": true, "B": true},
+			Disabled:       map[string]bool{"B": true},
+			ExpectedCounts: map[string]int{"A": 10},
+		},
+		{
+			Case:           "Only healthy worker disabled",
+			Healthy:        map[string]bool{"A": false, "B": true},
+			Disabled:       map[string]bool{"B": true},
+			ExpectedCounts: map[string]int{"A": 10},
+		},
+	}
+
+	for _, testCase := range testCases {
+		p := &Pipeline{}
+		for _, name := range []string{"A", "B"} {
+			w := newWorker(name, &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+			w.isHealthy = testCase.Healthy[name]
+			w.isDisabled = testCase.Disabled[name]
+			p.workers = append(p.workers, w)
+		}
+
+		assert.Equal(s.T(), testCase.ExpectedCounts, routeCounts(p, 10), testCase.Case)
+	}
+}
+
+func (s *PipelineSuite) TestRouteAllDisabled() {
+	w := newWorker("A", &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+	w.SetDisabled(true)
+	p := &Pipeline{workers: []*worker{w}}
+	assert.Nil(s.T(), p.route())
+
+	w.SetDisabled(false)
+	assert.Equal(s.T(), w, p.route())
+}
+
+func (s *PipelineSuite) TestRouteByLoad() {
+	busy := newWorker("A", &nopWorker{}, ProviderConfig{MaxConcurrency: 2})
+	idle := newWorker("B", &nopWorker{}, ProviderConfig{MaxConcurrency: 10})
+	p := &Pipeline{workers: []*worker{busy, idle}}
+
+	busy.pending, idle.pending = 2, 5
+	assert.Equal(s.T(), map[string]int{"B": 10}, routeCounts(p, 10))
+
+	busy.pending, idle.pending = 1, 5
+	assert.Equal(s.T(), map[string]int{"A": 5, "B": 5}, routeCounts(p, 10))
+}
+
+func (s *PipelineSuite) TestHealthStatus() {
+	config = &Config{HealthyThreshold: 2, UnhealthyThreshold: 2}
+	w := newWorker("A", &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+
+	// a window without sends is not a health check
+	w.endWindow()
+	w.endWindow()
+	assert.True(s.T(), w.IsHealthy())
+
+	w.recordResult(true, nil)
+	w.endWindow()
+	assert.True(s.T(), w.IsHealthy())
+	w.recordResult(true, nil)
+	w.endWindow()
+	assert.False(s.T(), w.IsHealthy())
+
+	// an unhealthy worker takes a single probe message per window
+	assert.True(s.T(), w.claimProbe())
+	assert.False(s.T(), w.claimProbe())
+
+	w.recordResult(false, nil)
+	w.endWindow()
+	assert.False(s.T(), w.IsHealthy())
+	assert.True(s.T(), w.claimProbe())
+	w.recordResult(false, nil)
+	w.endWindow()
+	assert.True(s.T(), w.IsHealthy())
+}
+
+type blockingWorker struct {
+	started chan string
+	release chan struct{}
+}
+
+func (w *blockingWorker) Send(email *Email) (string, error) {
+	w.started <- email.Subject
+	<-w.release
+	return "", nil
+}
+
+func (s *PipelineSuite) TestRunShutdown() {
+	config = &Config{
+		Queues:                          []QueueConfig{{Url: testQueueUrl}},
+		ConsumersPerQueue:               1,
+		WaitTimeSeconds:                 1,
+		MessageBufferSize:               10,
+		MaxInFlightMessages:             100,
+		HealthCheckIntervalMilliseconds: 1000,
+		AckFlushIntervalMilliseconds:    10,
+		AckMaxRetries:                   1,
+		ShutdownTimeoutSeconds:          5,
+	}
+	mockSQS := new(mocks.SQSAPI)
+	queueBackend = queue.NewSQS(mockSQS)
+
+	mockSQS.On("GetQueueAttributes", mock.AnythingOfType("*sqs.GetQueueAttributesInput")).
+		Return(&sqs.GetQueueAttributesOutput{
+			Attributes: map[string]*string{sqs.QueueAttributeNameVisibilityTimeout: aws.String("30")},
+		}, nil)
+	messages := make([]*sqs.Message, 3)
+	for i := range messages {
+		messages[i] = &sqs.Message{
+			MessageId:     aws.String(strconv.Itoa(i)),
+			ReceiptHandle: aws.String("receipt-" + strconv.Itoa(i)),
+			Body:          aws.String(fmt.Sprintf(`{"email":{"subject":"%d"}}`, i)),
+		}
+	}
+	mockSQS.On("ReceiveMessage", mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+		Return(&sqs.ReceiveMessageOutput{Messages: messages}, nil).Once()
+	mockSQS.On("ReceiveMessage", mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+		Run(func(mock.Arguments) { time.Sleep(10 * time.Millisecond) }).
+		Return(&sqs.ReceiveMessageOutput{}, nil)
+
+	acked := make(chan string, 10)
+	mockSQS.On("DeleteMessageBatch", mock.AnythingOfType("*sqs.DeleteMessageBatchInput")).
+		Run(func(args mock.Arguments) {
+			for _, entry := range args.Get(0).(*sqs.DeleteMessageBatchInput).Entries {
+				acked <- "delete " + *entry.ReceiptHandle
+			}
+		}).
+		Return(&sqs.DeleteMessageBatchOutput{}, nil)
+	mockSQS.On("ChangeMessageVisibilityBatch", mock.AnythingOfType("*sqs.ChangeMessageVisibilityBatchInput")).
+		Run(func(args mock.Arguments) {
+			for _, entry := range args.Get(0).(*sqs.ChangeMessageVisibilityBatchInput).Entries {
+				acked <- fmt.Sprintf("visibility %s %d", *entry.ReceiptHandle, *entry.VisibilityTimeout)
+			}
+		}).
+		Return(&sqs.ChangeMessageVisibilityBatchOutput{}, nil)
+
+	w := &blockingWorker{started: make(chan string), release: make(chan struct{})}
+	p := &Pipeline{
+		workers:  []*worker{newWorker("A", w, ProviderConfig{MaxConcurrency: 1})},
+		messages: newPriorityQueue(config.PriorityWeights, config.MessageBufferSize),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- p.Run(ctx)
+	}()
+
+	// the worker is busy with the first message when the pipeline is stopped
+	assert.Equal(s.T(), "0", <-w.started)
+	cancel()
+	close(w.release)
+	assert.NoError(s.T(), <-stopped)
+
+	close(acked)
+	acks := make([]string, 0)
+	for ack := range acked {
+		acks = append(acks, ack)
+	}
+	sort.Strings(acks)
+	assert.Equal(s.T(), []string{
+		"delete receipt-0",
+		"visibility receipt-1 0",
+		"visibility receipt-2 0",
+	}, acks)
+	assert.Equal(s.T(), int64(3), p.stats.received)
+	assert.Equal(s.T(), int64(1), p.stats.sent)
+	assert.Equal(s.T(), int64(2), p.stats.handedBack)
+	assert.Equal(s.T(), 0, inFlight.InFlight())
+}
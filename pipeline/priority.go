@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// priorities a queue can be given through its priority setting, from highest to lowest
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+var priorities = []string{priorityHigh, priorityNormal, priorityLow}
+
+// PriorityWeights sets how many messages of each priority are dispatched for every
+// message of the others while all of them have messages waiting.
+type PriorityWeights struct {
+	High   int `yaml:"high"`
+	Normal int `yaml:"normal"`
+	Low    int `yaml:"low"`
+}
+
+func (w PriorityWeights) weight(priority string) int {
+	switch priority {
+	case priorityHigh:
+		return w.High
+	case priorityLow:
+		return w.Low
+	}
+	return w.Normal
+}
+
+var defaultPriorityWeights = PriorityWeights{
+	High:   6,
+	Normal: 3,
+	Low:    1,
+}
+
+func isPriority(priority string) bool {
+	for _, p := range priorities {
+		if p == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// lane buffers the received messages of one priority until they are dispatched.
+type lane struct {
+	priority string
+	weight   int
+	messages chan *Message
+	// smooth weighted round robin state, only used by the dispatcher
+	current int
+
+	received   int64
+	sent       int64
+	failed     int64
+	dispatched int64
+}
+
+// priorityQueue buffers received messages in one lane per priority, and hands them out
+// in a weighted-fair order: while several lanes have messages waiting, each of them gets
+// a share of the messages dispatched that matches its weight, so that a backlog of high
+// priority messages slows low priority ones down without starving them.
+type priorityQueue struct {
+	lanes []*lane
+	// holds a token for every buffered message, so that Pop can wait on all lanes at once
+	ready chan struct{}
+}
+
+// newPriorityQueue creates a queue that buffers up to bufferSize messages per priority.
+func newPriorityQueue(weights PriorityWeights, bufferSize int) *priorityQueue {
+	q := &priorityQueue{ready: make(chan struct{}, bufferSize*len(priorities))}
+	for _, priority := range priorities {
+		weight := weights.weight(priority)
+		if weight < 1 {
+			// every lane gets its turn eventually
+			weight = 1
+		}
+		q.lanes = append(q.lanes, &lane{
+			priority: priority,
+			weight:   weight,
+			messages: make(chan *Message, bufferSize),
+		})
+	}
+	return q
+}
+
+// lane returns the lane of a priority. Messages without a known priority are normal.
+func (q *priorityQueue) lane(priority string) *lane {
+	for _, l := range q.lanes {
+		if l.priority == priority {
+			return l
+		}
+	}
+	return q.lane(priorityNormal)
+}
+
+// Push buffers a message in the lane of its priority, blocking while the lane is full.
+// It returns false if ctx is done first.
+func (q *priorityQueue) Push(ctx context.Context, message *Message) bool {
+	l := q.lane(message.Priority)
+	select {
+	case l.messages <- message:
+	case <-ctx.Done():
+		return false
+	}
+	atomic.AddInt64(&l.received, 1)
+	q.ready <- struct{}{}
+	return true
+}
+
+// Pop blocks until a message is buffered, and returns the next message in weighted-fair
+// order. It returns nil if ctx is done first. Pop must not be called concurrently.
+func (q *priorityQueue) Pop(ctx context.Context) *Message {
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-q.ready:
+	}
+
+	// smooth weighted round robin between the lanes that have messages waiting
+	var chosen *lane
+	total := 0
+	for _, l := range q.lanes {
+		if len(l.messages) == 0 {
+			continue
+		}
+		l.current += l.weight
+		total += l.weight
+		if chosen == nil || l.current > chosen.current {
+			chosen = l
+		}
+	}
+	chosen.current -= total
+	atomic.AddInt64(&chosen.dispatched, 1)
+	return <-chosen.messages
+}
+
+// Drain removes all buffered messages, when shutting down.
+func (q *priorityQueue) Drain() []*Message {
+	var drained []*Message
+	for _, l := range q.lanes {
+		for done := false; !done; {
+			select {
+			case message := <-l.messages:
+				drained = append(drained, message)
+			default:
+				done = true
+			}
+		}
+	}
+	return drained
+}
+
+// recordResult counts a message of the given priority that was sent or failed.
+func (q *priorityQueue) recordResult(priority string, sent bool) {
+	if q == nil {
+		return
+	}
+	l := q.lane(priority)
+	if sent {
+		atomic.AddInt64(&l.sent, 1)
+	} else {
+		atomic.AddInt64(&l.failed, 1)
+	}
+}
+
+// endWindow returns a summary of the messages dispatched per priority since the last
+// call, e.g. "high: 12, normal: 30, low: 5".
+func (q *priorityQueue) endWindow() string {
+	counts := make([]string, 0, len(q.lanes))
+	for _, l := range q.lanes {
+		counts = append(counts, fmt.Sprintf("%s: %d", l.priority, atomic.SwapInt64(&l.dispatched, 0)))
+	}
+	return strings.Join(counts, ", ")
+}
+
+// priorityStatus is part of the response of GET /status.
+type priorityStatus struct {
+	Priority string `json:"priority"`
+	Weight   int    `json:"weight"`
+	Buffered int    `json:"buffered"`
+	Received int64  `json:"received"`
+	Sent     int64  `json:"sent"`
+	Failed   int64  `json:"failed"`
+}
+
+func (q *priorityQueue) status() []priorityStatus {
+	if q == nil {
+		return nil
+	}
+	statuses := make([]priorityStatus, 0, len(q.lanes))
+	for _, l := range q.lanes {
+		statuses = append(statuses, priorityStatus{
+			Priority: l.priority,
+			Weight:   l.weight,
+			Buffered: len(l.messages),
+			Received: atomic.LoadInt64(&l.received),
+			Sent:     atomic.LoadInt64(&l.sent),
+			Failed:   atomic.LoadInt64(&l.failed),
+		})
+	}
+	return statuses
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type PrioritySuite struct {
+	suite.Suite
+}
+
+func TestPrioritySuite(t *testing.T) {
+	suite.Run(t, new(PrioritySuite))
+}
+
+func testPriorityMessage(id int, priority string) *Message {
+	message := testMessage(id)
+	message.Priority = priority
+	return message
+}
+
+func (s *PrioritySuite) TestPop() {
+	testCases := []struct {
+		Case     string
+		Weights  PriorityWeights
+		Buffered map[string]int
+		Expected string
+	}{
+		{
+			Case:     "All priorities have messages waiting",
+			Weights:  PriorityWeights{High: 3, Normal: 2, Low: 1},
+			Buffered: map[string]int{priorityHigh: 10, priorityNormal: 10, priorityLow: 10},
+			Expected: "HNHLNH HNHLNH",
+		},
+		{
+			Case:     "Low priority is not starved by a high priority backlog",
+			Weights:  PriorityWeights{High: 4, Normal: 1, Low: 1},
+			Buffered: map[string]int{priorityHigh: 20, priorityLow: 10},
+			Expected: "HHLHH HHLHH",
+		},
+		{
+			Case:     "Lanes without messages are skipped",
+			Weights:  PriorityWeights{High: 3, Normal: 2, Low: 1},
+			Buffered: map[string]int{priorityLow: 3},
+			Expected: "LLL",
+		},
+		{
+			Case:     "Messages without a priority are normal",
+			Weights:  PriorityWeights{High: 1, Normal: 1, Low: 1},
+			Buffered: map[string]int{"": 2},
+			Expected: "NN",
+		},
+	}
+
+	for _, testCase := range testCases {
+		q := newPriorityQueue(testCase.Weights, 20)
+		for _, priority := range append([]string{""}, priorities...) {
+			for i := 0; i < testCase.Buffered[priority]; i++ {
+				q.Push(context.Background(), testPriorityMessage(i, priority))
+			}
+		}
+
+		expected := strings.Replace(testCase.Expected, " ", "", -1)
+		popped := make([]string, 0, len(expected))
+		for range expected {
+			message := q.Pop(context.Background())
+			if message.Priority == "" {
+				popped = append(popped, "N")
+			} else {
+				popped = append(popped, strings.ToUpper(message.Priority[:1]))
+			}
+		}
+		assert.Equal(s.T(), expected, strings.Join(popped, ""), testCase.Case)
+	}
+}
+
+func (s *PrioritySuite) TestStatus() {
+	q := newPriorityQueue(defaultPriorityWeights, 10)
+	q.Push(context.Background(), testPriorityMessage(1, priorityHigh))
+	q.Push(context.Background(), testPriorityMessage(2, priorityLow))
+	q.Push(context.Background(), testPriorityMessage(3, priorityLow))
+	q.Pop(context.Background())
+	q.recordResult(priorityHigh, true)
+
+	assert.Equal(s.T(), []priorityStatus{
+		{Priority: priorityHigh, Weight: 6, Received: 1, Sent: 1},
+		{Priority: priorityNormal, Weight: 3},
+		{Priority: priorityLow, Weight: 1, Buffered: 2, Received: 2},
+	}, q.status())
+	assert.Equal(s.T(), "high: 1, normal: 0, low: 0", q.endWindow())
+	assert.Equal(s.T(), "high: 0, normal: 0, low: 0", q.endWindow())
+	assert.Len(s.T(), q.Drain(), 2)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RateLimitSuite struct {
+	suite.Suite
+}
+
+func TestRateLimitSuite(t *testing.T) {
+	suite.Run(t, new(RateLimitSuite))
+}
+
+func (s *RateLimitSuite) TestWait() {
+	l := newRateLimiter(100)
+	t := time.Now()
+	for i := 0; i < 11; i++ {
+		l.Wait()
+	}
+	// the first event goes through right away, the other 10 are 10ms apart
+	assert.True(s.T(), time.Since(t) >= 100*time.Millisecond)
+}
+
+func (s *RateLimitSuite) TestUnlimited() {
+	var l *rateLimiter = newRateLimiter(0)
+	t := time.Now()
+	for i := 0; i < 1000; i++ {
+		l.Wait()
+	}
+	assert.True(s.T(), time.Since(t) < 100*time.Millisecond)
+}
+
+func (s *RateLimitSuite) TestSetRate() {
+	l := newRateLimiter(1)
+	l.SetRate(100)
+	assert.Equal(s.T(), float64(100), l.Rate())
+	// a rate the provider did not tell is ignored
+	l.SetRate(0)
+	assert.Equal(s.T(), float64(100), l.Rate())
+
+	l.Wait()
+	t := time.Now()
+	for i := 0; i < 10; i++ {
+		l.Wait()
+	}
+	assert.True(s.T(), time.Since(t) >= 90*time.Millisecond)
+	assert.True(s.T(), time.Since(t) < time.Second)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// backoffVisibilityTimeout calculates how long (in seconds) a message that failed its
+// n-th attempt stays invisible before being retried. The delay grows exponentially
+// from retry_base_delay_seconds up to retry_max_delay_seconds, and half of it is
+// randomized so that messages failing together do not come back together.
+func backoffVisibilityTimeout(attempt int) int64 {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := config.RetryBaseDelaySeconds
+	for i := 1; i < attempt && delay < config.RetryMaxDelaySeconds; i++ {
+		delay *= 2
+	}
+	if delay > config.RetryMaxDelaySeconds {
+		delay = config.RetryMaxDelaySeconds
+	}
+
+	half := delay / 2
+	return delay - half + rand.Int63n(half+1)
+}
+
+// retryVisibilityTimeout calculates how long (in seconds) a message whose n-th attempt
+// failed with cause stays invisible. If the provider throttled us, the message is not
+// retried before the provider asked for (as long as that is within
+// retry_max_delay_seconds).
+func retryVisibilityTimeout(attempt int, cause error) int64 {
+	visibilityTimeout := backoffVisibilityTimeout(attempt)
+	retryAfter, ok := requestedRetryDelay(cause)
+	if !ok {
+		return visibilityTimeout
+	}
+
+	requested := int64(math.Ceil(retryAfter.Seconds()))
+	if requested > config.RetryMaxDelaySeconds {
+		requested = config.RetryMaxDelaySeconds
+	}
+	if requested > visibilityTimeout {
+		return requested
+	}
+	return visibilityTimeout
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RetrySuite struct {
+	suite.Suite
+}
+
+func TestRetrySuite(t *testing.T) {
+	suite.Run(t, new(RetrySuite))
+}
+
+func (s *RetrySuite) TestBackoffVisibilityTimeout() {
+	config = &Config{
+		RetryBaseDelaySeconds: 10,
+		RetryMaxDelaySeconds:  100,
+	}
+	testCases := []struct {
+		Attempt     int
+		ExpectedMin int64
+		ExpectedMax int64
+	}{
+		{Attempt: 0, ExpectedMin: 5, ExpectedMax: 10},
+		{Attempt: 1, ExpectedMin: 5, ExpectedMax: 10},
+		{Attempt: 2, ExpectedMin: 10, ExpectedMax: 20},
+		{Attempt: 4, ExpectedMin: 40, ExpectedMax: 80},
+		{Attempt: 5, ExpectedMin: 50, ExpectedMax: 100},
+		{Attempt: 50, ExpectedMin: 50, ExpectedMax: 100},
+	}
+
+	for _, testCase := range testCases {
+		for i := 0; i < 20; i++ {
+			timeout := backoffVisibilityTimeout(testCase.Attempt)
+			assert.True(s.T(), timeout >= testCase.ExpectedMin && timeout <= testCase.ExpectedMax,
+				"attempt %d: %d not in [%d, %d]", testCase.Attempt, timeout, testCase.ExpectedMin, testCase.ExpectedMax)
+		}
+	}
+}
+
+func (s *RetrySuite) TestRetryVisibilityTimeout() {
+	config = &Config{
+		RetryBaseDelaySeconds: 10,
+		RetryMaxDelaySeconds:  100,
+	}
+	testCases := []struct {
+		Case        string
+		Cause       error
+		ExpectedMin int64
+		ExpectedMax int64
+	}{
+		{
+			Case:        "Not throttled",
+			Cause:       fmt.Errorf("failed"),
+			ExpectedMin: 5,
+			ExpectedMax: 10,
+		},
+		{
+			Case:        "Throttled for longer than the backoff",
+			Cause:       newThrottledError(fmt.Errorf("throttled"), 30500*time.Millisecond),
+			ExpectedMin: 31,
+			ExpectedMax: 31,
+		},
+		{
+			Case:        "Throttled for shorter than the backoff",
+			Cause:       newThrottledError(fmt.Errorf("throttled"), time.Second),
+			ExpectedMin: 5,
+			ExpectedMax: 10,
+		},
+		{
+			Case:        "Throttled for longer than the maximum delay",
+			Cause:       newThrottledError(fmt.Errorf("throttled"), time.Hour),
+			ExpectedMin: 100,
+			ExpectedMax: 100,
+		},
+	}
+
+	for _, testCase := range testCases {
+		timeout := retryVisibilityTimeout(1, testCase.Cause)
+		assert.True(s.T(), timeout >= testCase.ExpectedMin && timeout <= testCase.ExpectedMax,
+			"%s: %d not in [%d, %d]", testCase.Case, timeout, testCase.ExpectedMin, testCase.ExpectedMax)
+	}
+}
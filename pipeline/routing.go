@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RoutingRule sends the emails it matches through its providers rather than splitting
+// them between all workers.
+type RoutingRule struct {
+	// patterns of the recipient domains the rule matches: a domain (gmail.com), all of its
+	// subdomains (*.outlook.com), or any domain (*)
+	RecipientDomains []string `yaml:"recipient_domains"`
+	// if set, the rule only matches emails sent from one of these domains as well
+	SenderDomains []string `yaml:"sender_domains"`
+	// the preferred provider, followed by its fallbacks
+	Providers []string `yaml:"providers"`
+}
+
+// Matches reports whether the rule applies to an email.
+func (r RoutingRule) Matches(email *Email) bool {
+	if !matchAnyDomain(r.RecipientDomains, emailDomain(email.ToEmail)) {
+		return false
+	}
+	return len(r.SenderDomains) == 0 || matchAnyDomain(r.SenderDomains, emailDomain(email.FromEmail))
+}
+
+func (r RoutingRule) validate(name string, c Config) error {
+	if len(r.RecipientDomains) == 0 {
+		return fmt.Errorf("%s.recipient_domains must contain at least one value", name)
+	}
+	for _, patterns := range [][]string{r.RecipientDomains, r.SenderDomains} {
+		for _, pattern := range patterns {
+			if !validDomainPattern(pattern) {
+				return fmt.Errorf("%s contains invalid domain pattern %s", name, pattern)
+			}
+		}
+	}
+	if len(r.Providers) == 0 {
+		return fmt.Errorf("%s.providers must contain at least one value", name)
+	}
+	seen := make(map[string]bool, len(r.Providers))
+	for _, provider := range r.Providers {
+		if !c.ProviderEnabled(provider) {
+			return fmt.Errorf("%s.providers contains %s which is not enabled in providers", name, provider)
+		}
+		if seen[provider] {
+			return fmt.Errorf("%s.providers contains %s more than once", name, provider)
+		}
+		seen[provider] = true
+	}
+	return nil
+}
+
+// emailDomain returns the lower case domain of an email address.
+func emailDomain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(address[at+1:])
+}
+
+func matchAnyDomain(patterns []string, domain string) bool {
+	for _, pattern := range patterns {
+		if matchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(pattern, domain string) bool {
+	if domain == "" {
+		return false
+	}
+	pattern = strings.ToLower(pattern)
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+	return domain == pattern
+}
+
+// validDomainPattern reports whether a pattern is a domain, optionally preceded by a
+// wildcard label, or a lone wildcard.
+func validDomainPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	domain := strings.TrimPrefix(pattern, "*.")
+	return domain != "" && !strings.ContainsAny(domain, "*@ ")
+}
+
+// matchRule returns the first routing rule that applies to an email, and its position in
+// routing_rules starting at 1. It returns nil if no rule applies.
+func (c Config) matchRule(email *Email) (int, *RoutingRule) {
+	for i := range c.RoutingRules {
+		if c.RoutingRules[i].Matches(email) {
+			return i + 1, &c.RoutingRules[i]
+		}
+	}
+	return 0, nil
+}
+
+// routeMessage picks the worker a message goes to. A message that failed before is
+// retried through the workers that failed it the least (see leastFailed). The first
+// routing rule matching the email decides which of the workers are preferred: the first
+// of them that is enabled, healthy and not throttled gets the message. If none of them is, or no rule
+// applies, the message is routed like any other (see route).
+func (p *Pipeline) routeMessage(message *Message) *worker {
+	workers := p.workers
+	if len(message.history) > 0 {
+		workers = leastFailed(workers, message.history)
+	}
+
+	if _, rule := config.matchRule(message.Email); rule != nil {
+		for _, provider := range rule.Providers {
+			for _, w := range workers {
+				if strings.EqualFold(w.name, provider) && w.IsAvailable() && w.IsHealthy() && !w.IsThrottled() {
+					return w
+				}
+			}
+		}
+	}
+	return p.routeBetween(workers)
+}
+
+// describeRoute explains which providers an email from one address to another would be
+// sent through, for the -route dry run. It does not know the health of the providers.
+func describeRoute(toEmail, fromEmail string) (string, error) {
+	if emailDomain(toEmail) == "" {
+		return "", fmt.Errorf("%s is not an email address", toEmail)
+	}
+	if fromEmail != "" && emailDomain(fromEmail) == "" {
+		return "", fmt.Errorf("%s is not an email address", fromEmail)
+	}
+
+	split := fmt.Sprintf("the health-based split between %s", strings.Join(config.Providers, ", "))
+	n, rule := config.matchRule(&Email{ToEmail: toEmail, FromEmail: fromEmail})
+	if rule == nil {
+		return fmt.Sprintf("%s matches no routing rule: %s", toEmail, split), nil
+	}
+
+	description := fmt.Sprintf("%s matches routing rule %d: %s", toEmail, n, rule.Providers[0])
+	for _, provider := range rule.Providers[1:] {
+		description += fmt.Sprintf(", falling back to %s", provider)
+	}
+	return description + fmt.Sprintf(" if unhealthy or disabled, then %s", split), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RoutingSuite struct {
+	suite.Suite
+}
+
+func TestRoutingSuite(t *testing.T) {
+	suite.Run(t, new(RoutingSuite))
+}
+
+var testRoutingRules = []RoutingRule{
+	{
+		RecipientDomains: []string{"outlook.com", "hotmail.com", "*.microsoft.com"},
+		Providers:        []string{providerSES, providerSendgrid},
+	},
+	{
+		RecipientDomains: []string{"gmail.com"},
+		SenderDomains:    []string{"news.example.com"},
+		Providers:        []string{providerSES},
+	},
+	{
+		RecipientDomains: []string{"gmail.com"},
+		Providers:        []string{providerSendgrid},
+	},
+}
+
+func (s *RoutingSuite) TestMatchRule() {
+	testCases := []struct {
+		Case         string
+		ToEmail      string
+		FromEmail    string
+		ExpectedRule int
+	}{
+		{
+			Case:         "Recipient domain",
+			ToEmail:      "to@hotmail.com",
+			ExpectedRule: 1,
+		},
+		{
+			Case:         "Recipient domain in a different case",
+			ToEmail:      "to@Outlook.COM",
+			ExpectedRule: 1,
+		},
+		{
+			Case:         "Recipient subdomain",
+			ToEmail:      "to@eu.microsoft.com",
+			ExpectedRule: 1,
+		},
+		{
+			Case:         "Wildcards do not match the domain itself",
+			ToEmail:      "to@microsoft.com",
+			ExpectedRule: 0,
+		},
+		{
+			Case:         "Recipient and sender domain",
+			ToEmail:      "to@gmail.com",
+			FromEmail:    "from@news.example.com",
+			ExpectedRule: 2,
+		},
+		{
+			Case:         "Recipient domain of a rule with another sender domain",
+			ToEmail:      "to@gmail.com",
+			FromEmail:    "from@example.com",
+			ExpectedRule: 3,
+		},
+		{
+			Case:         "No rule",
+			ToEmail:      "to@example.com",
+			ExpectedRule: 0,
+		},
+	}
+
+	config = &Config{RoutingRules: testRoutingRules}
+	for _, testCase := range testCases {
+		n, rule := config.matchRule(&Email{ToEmail: testCase.ToEmail, FromEmail: testCase.FromEmail})
+		assert.Equal(s.T(), testCase.ExpectedRule, n, testCase.Case)
+		assert.Equal(s.T(), testCase.ExpectedRule == 0, rule == nil, testCase.Case)
+	}
+}
+
+func (s *RoutingSuite) TestRouteMessage() {
+	testCases := []struct {
+		Case           string
+		ToEmail        string
+		Healthy        map[string]bool
+		Disabled       map[string]bool
+		ExpectedCounts map[string]int
+	}{
+		{
+			Case:           "Preferred provider",
+			ToEmail:        "to@outlook.com",
+			Healthy:        map[string]bool{"SES": true, "Sendgrid": true, "SMTP": true},
+			ExpectedCounts: map[string]int{"SES": 10},
+		},
+		{
+			Case:           "Unhealthy preferred provider",
+			ToEmail:        "to@outlook.com",
+			Healthy:        map[string]bool{"SES": false, "Sendgrid": true, "SMTP": true},
+			ExpectedCounts: map[string]int{"Sendgrid": 10},
+		},
+		{
+			Case:           "Disabled preferred provider",
+			ToEmail:        "to@outlook.com",
+			Healthy:        map[string]bool{"SES": true, "Sendgrid": true, "SMTP": true},
+			Disabled:       map[string]bool{"SES": true},
+			ExpectedCounts: map[string]int{"Sendgrid": 10},
+		},
+		{
+			Case:           "All preferred providers unhealthy",
+			ToEmail:        "to@outlook.com",
+			Healthy:        map[string]bool{"SES": false, "Sendgrid": false, "SMTP": true},
+			ExpectedCounts: map[string]int{"SES": 1, "Sendgrid": 1, "SMTP": 8},
+		},
+		{
+			Case:           "No rule",
+			ToEmail:        "to@example.com",
+			Healthy:        map[string]bool{"SES": true, "Sendgrid": true, "SMTP": true},
+			ExpectedCounts: map[string]int{"SES": 3, "Sendgrid": 4, "SMTP": 3},
+		},
+	}
+
+	config = &Config{RoutingRules: testRoutingRules}
+	for _, testCase := range testCases {
+		p := &Pipeline{}
+		for _, name := range []string{"SES", "Sendgrid", "SMTP"} {
+			w := newWorker(name, &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+			w.isHealthy = testCase.Healthy[name]
+			w.isDisabled = testCase.Disabled[name]
+			p.workers = append(p.workers, w)
+		}
+
+		message := testMessage(1)
+		message.Email = &Email{ToEmail: testCase.ToEmail}
+		counts := make(map[string]int)
+		for i := 0; i < 10; i++ {
+			counts[p.routeMessage(message).name]++
+		}
+		assert.Equal(s.T(), testCase.ExpectedCounts, counts, testCase.Case)
+	}
+}
+
+func (s *RoutingSuite) TestDescribeRoute() {
+	config = &Config{
+		Providers:    []string{providerSES, providerSendgrid},
+		RoutingRules: testRoutingRules,
+	}
+
+	description, err := describeRoute("to@outlook.com", "")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "to@outlook.com matches routing rule 1: ses, falling back to sendgrid if unhealthy or disabled, then the health-based split between ses, sendgrid", description)
+
+	description, err = describeRoute("to@gmail.com", "from@news.example.com")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "to@gmail.com matches routing rule 2: ses if unhealthy or disabled, then the health-based split between ses, sendgrid", description)
+
+	description, err = describeRoute("to@example.com", "")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "to@example.com matches no routing rule: the health-based split between ses, sendgrid", description)
+
+	_, err = describeRoute("example.com", "")
+	assert.EqualError(s.T(), err, "example.com is not an email address")
+}
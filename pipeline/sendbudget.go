@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	budgetPeriodDaily   = "daily"
+	budgetPeriodMonthly = "monthly"
+
+	// how long the counter of a period is kept after the period ended
+	budgetCounterRetention = 24 * time.Hour
+)
+
+// counterStore keeps the send budgets of all pipeline nodes, nil if no provider has a
+// budget.
+var counterStore CounterStore
+
+// budgetPeriod is a UTC day or a UTC calendar month in which a provider may send up to
+// limit emails.
+type budgetPeriod struct {
+	name  string
+	limit int64
+}
+
+// bounds returns the start and the end of the period that now is in.
+func (p budgetPeriod) bounds(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	if p.name == budgetPeriodMonthly {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// counter returns the name of the counter of the period starting at start.
+func (p budgetPeriod) counter(provider string, start time.Time) string {
+	if p.name == budgetPeriodMonthly {
+		return fmt.Sprintf("budget:%s:monthly:%s", provider, start.Format("2006-01"))
+	}
+	return fmt.Sprintf("budget:%s:daily:%s", provider, start.Format("2006-01-02"))
+}
+
+// sendBudget caps the number of emails a provider sends per day and per month, counted
+// in the counter store shared by all pipeline nodes. Every email is counted before it is
+// sent, so that nodes sending at the same time cannot overspend the budget together, and
+// taken back if the provider did not send it. If the counter store cannot be reached,
+// emails are sent without being counted rather than not at all.
+type sendBudget struct {
+	provider string
+	periods  []budgetPeriod
+	store    CounterStore
+
+	mu sync.Mutex
+	// last count read from the store, per counter name
+	sent map[string]int64
+}
+
+// budgetStatus is part of a worker's status, as reported by the admin endpoint.
+type budgetStatus struct {
+	Period    string    `json:"period"`
+	Limit     int64     `json:"limit"`
+	Sent      int64     `json:"sent"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resetsAt"`
+}
+
+// newSendBudget creates the budget of a provider, or returns nil if the provider has
+// none.
+func newSendBudget(provider string, limits ProviderConfig, store CounterStore) *sendBudget {
+	var periods []budgetPeriod
+	if limits.DailyBudget > 0 {
+		periods = append(periods, budgetPeriod{budgetPeriodDaily, limits.DailyBudget})
+	}
+	if limits.MonthlyBudget > 0 {
+		periods = append(periods, budgetPeriod{budgetPeriodMonthly, limits.MonthlyBudget})
+	}
+	if len(periods) == 0 || store == nil {
+		return nil
+	}
+	return &sendBudget{provider: provider, periods: periods, store: store, sent: make(map[string]int64)}
+}
+
+// Reserve counts an email against every period of the budget, and returns the function
+// that takes it back. If the budget of a period is used up, nothing is counted and a
+// throttled error asks to try again once the period is over.
+func (b *sendBudget) Reserve(now time.Time) (func(), error) {
+	if b == nil {
+		return func() {}, nil
+	}
+
+	// counters the email was counted in, and when they expire
+	reserved := make(map[string]time.Time, len(b.periods))
+	release := func() {
+		for counter, expiresAt := range reserved {
+			if _, err := b.store.Add(counter, -1, expiresAt); err != nil {
+				log.Printf("[ERROR] %s: Could not take an email back from send budget %s: %v", b.provider, counter, err)
+			}
+		}
+	}
+	for _, period := range b.periods {
+		start, end := period.bounds(now)
+		counter := period.counter(b.provider, start)
+		expiresAt := end.Add(budgetCounterRetention)
+		sent, err := b.store.Add(counter, 1, expiresAt)
+		if err != nil {
+			log.Printf("[ERROR] %s: Could not count email against send budget %s, sending it anyway: %v", b.provider, counter, err)
+			continue
+		}
+		reserved[counter] = expiresAt
+		if sent > period.limit {
+			release()
+			b.remember(counter, period.limit)
+			return nil, newThrottledError(
+				fmt.Errorf("%s send budget of %d emails is used up", period.name, period.limit),
+				end.Sub(now),
+			)
+		}
+		b.remember(counter, sent)
+	}
+	return release, nil
+}
+
+func (b *sendBudget) remember(counter string, sent int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent[counter] = sent
+}
+
+// Status reads how much of every period of the budget is left. If the counter store
+// cannot be reached, the last count this node read is reported.
+func (b *sendBudget) Status(now time.Time) []budgetStatus {
+	if b == nil {
+		return nil
+	}
+
+	statuses := make([]budgetStatus, 0, len(b.periods))
+	for _, period := range b.periods {
+		start, end := period.bounds(now)
+		counter := period.counter(b.provider, start)
+		sent, err := b.store.Get(counter)
+		if err != nil {
+			log.Printf("[ERROR] %s: Could not read send budget %s: %v", b.provider, counter, err)
+			b.mu.Lock()
+			sent = b.sent[counter]
+			b.mu.Unlock()
+		}
+		if sent > period.limit {
+			sent = period.limit
+		}
+		statuses = append(statuses, budgetStatus{
+			Period:    period.name,
+			Limit:     period.limit,
+			Sent:      sent,
+			Remaining: period.limit - sent,
+			ResetsAt:  end,
+		})
+	}
+	return statuses
+}
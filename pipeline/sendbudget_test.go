@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gomail/queue"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SendBudgetSuite struct {
+	suite.Suite
+	dir   string
+	store CounterStore
+}
+
+func TestSendBudgetSuite(t *testing.T) {
+	suite.Run(t, new(SendBudgetSuite))
+}
+
+func (s *SendBudgetSuite) SetupTest() {
+	config = &Config{UnhealthyThreshold: 1, HealthyThreshold: 1, RetryMaxDelaySeconds: 900, AckMaxRetries: 1}
+	queueBackend = queue.NewMemory(30)
+	dir, err := ioutil.TempDir("", "gomail-send-budget")
+	s.Require().NoError(err)
+	s.dir = dir
+	s.store = newFileCounterStore(filepath.Join(dir, "counters.json"))
+	acks = newAcknowledger()
+}
+
+func (s *SendBudgetSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+	acks = newAcknowledger()
+}
+
+func (s *SendBudgetSuite) TestPeriods() {
+	testCases := []struct {
+		Case   string
+		Period string
+		Now    time.Time
+
+		ExpectedStart   time.Time
+		ExpectedEnd     time.Time
+		ExpectedCounter string
+	}{
+		{
+			Case:            "Daily",
+			Period:          budgetPeriodDaily,
+			Now:             time.Date(2017, 3, 31, 23, 59, 0, 0, time.UTC),
+			ExpectedStart:   time.Date(2017, 3, 31, 0, 0, 0, 0, time.UTC),
+			ExpectedEnd:     time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC),
+			ExpectedCounter: "budget:sendgrid:daily:2017-03-31",
+		},
+		{
+			Case:            "Daily in another time zone",
+			Period:          budgetPeriodDaily,
+			Now:             time.Date(2017, 4, 1, 1, 0, 0, 0, time.FixedZone("CEST", 2*60*60)),
+			ExpectedStart:   time.Date(2017, 3, 31, 0, 0, 0, 0, time.UTC),
+			ExpectedEnd:     time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC),
+			ExpectedCounter: "budget:sendgrid:daily:2017-03-31",
+		},
+		{
+			Case:            "Monthly",
+			Period:          budgetPeriodMonthly,
+			Now:             time.Date(2017, 12, 15, 12, 0, 0, 0, time.UTC),
+			ExpectedStart:   time.Date(2017, 12, 1, 0, 0, 0, 0, time.UTC),
+			ExpectedEnd:     time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+			ExpectedCounter: "budget:sendgrid:monthly:2017-12",
+		},
+	}
+
+	for _, testCase := range testCases {
+		period := budgetPeriod{name: testCase.Period, limit: 1}
+		start, end := period.bounds(testCase.Now)
+		assert.Equal(s.T(), testCase.ExpectedStart, start, testCase.Case)
+		assert.Equal(s.T(), testCase.ExpectedEnd, end, testCase.Case)
+		assert.Equal(s.T(), testCase.ExpectedCounter, period.counter("sendgrid", start), testCase.Case)
+	}
+}
+
+func (s *SendBudgetSuite) TestNoBudget() {
+	assert.Nil(s.T(), newSendBudget("sendgrid", ProviderConfig{MaxConcurrency: 1}, s.store))
+
+	var b *sendBudget
+	release, err := b.Reserve(time.Now())
+	assert.NoError(s.T(), err)
+	release()
+	assert.Nil(s.T(), b.Status(time.Now()))
+}
+
+func (s *SendBudgetSuite) TestReserve() {
+	b := newSendBudget("sendgrid", ProviderConfig{DailyBudget: 2, MonthlyBudget: 3}, s.store)
+	// the counters of periods in the future do not expire while the test runs
+	now := time.Date(2040, 3, 31, 18, 0, 0, 0, time.UTC)
+
+	_, err := b.Reserve(now)
+	assert.NoError(s.T(), err)
+	release, err := b.Reserve(now)
+	assert.NoError(s.T(), err)
+
+	// the daily budget is used up until midnight
+	_, err = b.Reserve(now)
+	if assert.True(s.T(), isThrottled(err)) {
+		assert.Contains(s.T(), err.Error(), "daily send budget of 2 emails is used up")
+		retryAfter, _ := requestedRetryDelay(err)
+		assert.Equal(s.T(), 6*time.Hour, retryAfter)
+	}
+	assert.Equal(s.T(), []budgetStatus{
+		{Period: budgetPeriodDaily, Limit: 2, Sent: 2, Remaining: 0, ResetsAt: time.Date(2040, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{Period: budgetPeriodMonthly, Limit: 3, Sent: 2, Remaining: 1, ResetsAt: time.Date(2040, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}, b.Status(now))
+
+	// an email that was not sent does not count
+	release()
+	_, err = b.Reserve(now)
+	assert.NoError(s.T(), err)
+
+	// the next day, which is in the next month, both budgets start over
+	nextDay := now.Add(7 * time.Hour)
+	for i := 0; i < 2; i++ {
+		_, err = b.Reserve(nextDay)
+		assert.NoError(s.T(), err)
+	}
+
+	// until the monthly budget is used up before the daily one
+	_, err = b.Reserve(nextDay.Add(24 * time.Hour))
+	assert.NoError(s.T(), err)
+	_, err = b.Reserve(nextDay.Add(24 * time.Hour))
+	if assert.True(s.T(), isThrottled(err)) {
+		assert.Contains(s.T(), err.Error(), "monthly send budget of 3 emails is used up")
+	}
+}
+
+func (s *SendBudgetSuite) TestSharedBudget() {
+	// pipeline nodes sharing the counter store share the budget
+	limits := ProviderConfig{DailyBudget: 3}
+	nodes := []*sendBudget{
+		newSendBudget("ses", limits, newFileCounterStore(filepath.Join(s.dir, "counters.json"))),
+		newSendBudget("ses", limits, newFileCounterStore(filepath.Join(s.dir, "counters.json"))),
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := nodes[i%2].Reserve(now)
+		assert.NoError(s.T(), err)
+	}
+	for _, node := range nodes {
+		_, err := node.Reserve(now)
+		assert.True(s.T(), isThrottled(err))
+	}
+}
+
+func (s *SendBudgetSuite) TestExhaustedBudget() {
+	budgeted := newWorker("SES", &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+	budgeted.budget = newSendBudget("ses", ProviderConfig{DailyBudget: 1}, s.store)
+	other := newWorker("Sendgrid", &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+	p := &Pipeline{workers: []*worker{budgeted, other}}
+
+	// a send the provider throttled is taken back from the budget
+	throttled := newWorker("SES", &throttlingWorker{throttled: 1}, ProviderConfig{MaxConcurrency: 1})
+	throttled.budget = budgeted.budget
+	_, err := throttled.Send(&Email{})
+	assert.True(s.T(), isThrottled(err))
+
+	budgeted.assign()
+	assert.True(s.T(), p.send(context.Background(), budgeted, testMessage(1)))
+
+	// once the budget is used up, messages go elsewhere until the end of the day
+	message := testMessage(2)
+	budgeted.assign()
+	assert.False(s.T(), p.send(context.Background(), budgeted, message))
+	select {
+	case rerouted := <-other.jobs:
+		assert.Equal(s.T(), message, rerouted)
+	default:
+		s.T().Error("message was not rerouted")
+	}
+	assert.Equal(s.T(), int64(0), p.stats.failed)
+	assert.True(s.T(), budgeted.IsThrottled())
+	assert.Equal(s.T(), map[string]int{"Sendgrid": 10}, routeCounts(p, 10))
+
+	status := budgeted.status()
+	if assert.NotNil(s.T(), status.ThrottledUntil) {
+		_, end := budgetPeriod{name: budgetPeriodDaily}.bounds(time.Now())
+		assert.WithinDuration(s.T(), end, *status.ThrottledUntil, time.Second)
+	}
+	if assert.Len(s.T(), status.Budgets, 1) {
+		assert.Equal(s.T(), int64(1), status.Budgets[0].Sent)
+		assert.Equal(s.T(), int64(0), status.Budgets[0].Remaining)
+	}
+}
+
+func (s *SendBudgetSuite) TestHeldUntilBudgetResets() {
+	// a message throttled for longer than this is held in its queue, and a message that
+	// is returned to its queue is dead-lettered right away
+	config = &Config{
+		UnhealthyThreshold: 1,
+		HealthyThreshold:   1,
+		AckMaxRetries:      1,
+		MaxAttempts:        1,
+		Queues:             []QueueConfig{{Url: testQueueUrl, DeadLetterQueueUrl: "gomail-dead"}},
+	}
+	_, err := queueBackend.Send(testQueueUrl, queue.SendInput{Body: `{"email":{}}`})
+	s.Require().NoError(err)
+	received, err := queueBackend.Receive(testQueueUrl, 1, 0)
+	s.Require().NoError(err)
+	s.Require().Len(received, 1)
+	message := NewMessage(received[0], testQueueUrl)
+	message.Email = &Email{}
+
+	// the only provider has used up its budget until the end of the day
+	budgeted := newWorker("SES", &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+	budgeted.budget = newSendBudget("ses", ProviderConfig{DailyBudget: 1}, s.store)
+	_, err = budgeted.budget.Reserve(time.Now())
+	s.Require().NoError(err)
+	p := &Pipeline{workers: []*worker{budgeted}}
+	budgeted.assign()
+	assert.False(s.T(), p.send(context.Background(), budgeted, message))
+	acks.Flush()
+
+	// the message waits in its queue instead of being dead-lettered
+	depth, err := queueBackend.Depth("gomail-dead")
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(0), depth)
+	assert.Equal(s.T(), int64(0), p.stats.failed)
+	received, err = queueBackend.Receive(testQueueUrl, 1, 0)
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), received)
+
+}
+
+func (s *SendBudgetSuite) TestHoldInQueue() {
+	config = &Config{AckMaxRetries: 1, Queues: []QueueConfig{{Url: testQueueUrl}}}
+	_, err := queueBackend.Send(testQueueUrl, queue.SendInput{Body: `{"email":{}}`})
+	s.Require().NoError(err)
+	received, err := queueBackend.Receive(testQueueUrl, 1, 0)
+	s.Require().NoError(err)
+	s.Require().Len(received, 1)
+	message := NewMessage(received[0], testQueueUrl)
+
+	holdInQueue(message, time.Now())
+	acks.Flush()
+
+	// the message is replaced by a copy, whose receive is not another delivery attempt
+	received, err = queueBackend.Receive(testQueueUrl, 10, 0)
+	s.Require().NoError(err)
+	if assert.Len(s.T(), received, 1) {
+		held := NewMessage(received[0], testQueueUrl)
+		assert.NotEqual(s.T(), message.Message.Id, held.Message.Id)
+		assert.Equal(s.T(), message.Message.Id, held.OriginalId())
+		assert.Equal(s.T(), 1, held.Attempt())
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
@@ -12,63 +15,101 @@ const (
 	sendgridEndpoint = "/v3/mail/send"
 	sendgridUrl      = "https://api.sendgrid.com"
 	sendgridMethod   = "POST"
+	// response header carrying the id Sendgrid gave the message
+	sendgridMessageIdHeader = "X-Message-Id"
+	// response headers telling how many requests are left until the rate limit resets, and
+	// when it resets (in unix seconds)
+	sendgridRateLimitRemainingHeader = "X-RateLimit-Remaining"
+	sendgridRateLimitResetHeader     = "X-RateLimit-Reset"
 )
 
-type SendgridWorker struct {
-	*worker
+// sendgridRateLimitReset returns how long it is until the rate limit resets, if a
+// response says that it is used up.
+func sendgridRateLimitReset(headers http.Header, now time.Time) (time.Duration, bool) {
+	remaining, err := strconv.Atoi(headers.Get(sendgridRateLimitRemainingHeader))
+	if err != nil || remaining > 0 {
+		return 0, false
+	}
+	reset, err := strconv.ParseInt(headers.Get(sendgridRateLimitResetHeader), 10, 64)
+	if err != nil {
+		return 0, true
+	}
+	if resetAt := time.Unix(reset, 0); resetAt.After(now) {
+		return resetAt.Sub(now), true
+	}
+	return 0, true
 }
 
-func (w *SendgridWorker) Send(messages []*Message, failures chan<- int) {
-	emailStatus := make(chan bool)
-	for _, message := range messages {
-		go w.send(message, emailStatus)
+// classifySendgridResponse turns an unsuccessful Sendgrid response into an error. Rate
+// limited sends are retried once the rate limit resets.
+func classifySendgridResponse(statusCode int, headers http.Header, body string, now time.Time) error {
+	err := fmt.Errorf("sendgrid responded with status code %d: %s", statusCode, body)
+	if statusCode == http.StatusTooManyRequests {
+		resetIn, _ := sendgridRateLimitReset(headers, now)
+		return newThrottledError(err, resetIn)
 	}
+	return classifyHTTPStatus(statusCode, err)
+}
 
-	var failedEmails int
-	for i := 0; i < len(messages); i++ {
-		success := <-emailStatus
-		if !success {
-			failedEmails++
-		}
-	}
-	close(emailStatus)
+// SendgridWorker sends emails through the v3 mail send API of Sendgrid. Once a response
+// says that the rate limit is used up, nothing is sent until it resets.
+type SendgridWorker struct {
+	apiKey  string
+	baseUrl string
 
-	failures <- failedEmails
+	mu             sync.Mutex
+	rateLimitReset time.Time
 }
 
-func (w *SendgridWorker) send(message *Message, status chan<- bool) {
-	email, err := messageToEmail(message.Message)
-	if err != nil {
-		log.Print("[ERROR] Could not convert sqs message to email: ", err.Error())
-		deleteFromQueue(message)
-		status <- true
-		// TODO push message to dead letter queue
+func newSendgridWorker(apiKey string) *SendgridWorker {
+	return &SendgridWorker{apiKey: apiKey, baseUrl: sendgridUrl}
+}
 
-		return
+func (w *SendgridWorker) Send(email *Email) (string, error) {
+	if resetIn := w.untilRateLimitReset(); resetIn > 0 {
+		return "", newThrottledError(fmt.Errorf("sendgrid rate limit is used up"), resetIn)
 	}
 
 	from := mail.NewEmail(email.FromName, email.FromEmail)
 	to := mail.NewEmail(email.ToName, email.ToEmail)
 	content := mail.NewContent("text/plain", email.Body)
 	m := mail.NewV3MailInit(from, email.Subject, to, content)
+	if email.ReplyTo != "" {
+		m.SetReplyTo(mail.NewEmail("", email.ReplyTo))
+	}
+	for _, name := range sortedKeys(email.Headers) {
+		m.SetHeader(name, email.Headers[name])
+	}
+	// tags are both categories, which the statistics of Sendgrid are grouped by, and
+	// custom args, which its event webhook passes back
+	m.AddCategories(providerTags("Sendgrid", email.Tags, sendgridMaxCategories, sendgridMaxCategoryLength)...)
+	for _, name := range sortedKeys(email.Tags) {
+		m.SetCustomArg(name, email.Tags[name])
+	}
 
-	request := sendgrid.GetRequest(config.SendgridApiKey, sendgridEndpoint, sendgridUrl)
+	request := sendgrid.GetRequest(w.apiKey, sendgridEndpoint, w.baseUrl)
 	request.Method = sendgridMethod
 	request.Body = mail.GetRequestBody(m)
 	resp, err := sendgrid.API(request)
-	if err != nil || resp.StatusCode != http.StatusAccepted {
-		log.Printf(
-			"[ERROR] Sendgrid: Could not send email: status code=%v, body=%v, headers=%v, err=%v",
-			resp.StatusCode,
-			resp.Body,
-			resp.Headers,
-			err,
-		)
-		returnToQueue(message)
-		status <- false
-		return
+	if err != nil {
+		return "", err
 	}
 
-	deleteFromQueue(message)
-	status <- true
+	now := time.Now()
+	headers := http.Header(resp.Headers)
+	if resetIn, limited := sendgridRateLimitReset(headers, now); limited {
+		w.mu.Lock()
+		w.rateLimitReset = now.Add(resetIn)
+		w.mu.Unlock()
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return "", classifySendgridResponse(resp.StatusCode, headers, resp.Body, now)
+	}
+	return headers.Get(sendgridMessageIdHeader), nil
+}
+
+func (w *SendgridWorker) untilRateLimitReset() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rateLimitReset.Sub(time.Now())
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SendgridWorkerSuite struct {
+	suite.Suite
+}
+
+func TestSendgridWorkerSuite(t *testing.T) {
+	suite.Run(t, new(SendgridWorkerSuite))
+}
+
+func (s *SendgridWorkerSuite) TestSend() {
+	reset := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	testCases := []struct {
+		Case       string
+		StatusCode int
+		Headers    map[string]string
+
+		ExpectedMessageId   string
+		ExpectedError       bool
+		ExpectedPermanent   bool
+		ExpectedThrottled   bool
+		ExpectedRateLimited bool
+	}{
+		{
+			Case:              "Accepted",
+			StatusCode:        http.StatusAccepted,
+			Headers:           map[string]string{sendgridMessageIdHeader: "sendgrid-1", sendgridRateLimitRemainingHeader: "599"},
+			ExpectedMessageId: "sendgrid-1",
+		},
+		{
+			Case:                "Accepted, using up the rate limit",
+			StatusCode:          http.StatusAccepted,
+			Headers:             map[string]string{sendgridMessageIdHeader: "sendgrid-1", sendgridRateLimitRemainingHeader: "0", sendgridRateLimitResetHeader: reset},
+			ExpectedMessageId:   "sendgrid-1",
+			ExpectedRateLimited: true,
+		},
+		{
+			Case:                "Rate limited",
+			StatusCode:          http.StatusTooManyRequests,
+			Headers:             map[string]string{sendgridRateLimitRemainingHeader: "0", sendgridRateLimitResetHeader: reset},
+			ExpectedError:       true,
+			ExpectedThrottled:   true,
+			ExpectedRateLimited: true,
+		},
+		{
+			Case:              "Rate limited without headers",
+			StatusCode:        http.StatusTooManyRequests,
+			ExpectedError:     true,
+			ExpectedThrottled: true,
+		},
+		{
+			Case:              "Bad request",
+			StatusCode:        http.StatusBadRequest,
+			ExpectedError:     true,
+			ExpectedPermanent: true,
+		},
+		{
+			Case:          "Server error",
+			StatusCode:    http.StatusInternalServerError,
+			ExpectedError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			for name, value := range testCase.Headers {
+				w.Header().Set(name, value)
+			}
+			w.WriteHeader(testCase.StatusCode)
+		}))
+		w := newSendgridWorker("SG.key")
+		w.baseUrl = server.URL
+
+		messageId, err := w.Send(testEmail())
+		if testCase.ExpectedError {
+			if assert.Error(s.T(), err, testCase.Case) {
+				assert.Equal(s.T(), testCase.ExpectedPermanent, isPermanent(err), testCase.Case)
+				assert.Equal(s.T(), testCase.ExpectedThrottled, isThrottled(err), testCase.Case)
+			}
+		} else {
+			assert.NoError(s.T(), err, testCase.Case)
+			assert.Equal(s.T(), testCase.ExpectedMessageId, messageId, testCase.Case)
+		}
+
+		// once the rate limit is used up, nothing is sent until it resets
+		_, err = w.Send(testEmail())
+		server.Close()
+		if testCase.ExpectedRateLimited {
+			assert.Equal(s.T(), 1, requests, testCase.Case)
+			if assert.True(s.T(), isThrottled(err), testCase.Case) {
+				retryAfter, _ := requestedRetryDelay(err)
+				assert.True(s.T(), retryAfter > 0 && retryAfter <= time.Minute, testCase.Case)
+			}
+		} else {
+			assert.Equal(s.T(), 2, requests, testCase.Case)
+		}
+	}
+}
+
+func (s *SendgridWorkerSuite) TestReplyToHeadersAndTags() {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contents, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(contents, &body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	w := newSendgridWorker("SG.key")
+	w.baseUrl = server.URL
+
+	email := testEmail()
+	email.ReplyTo = "support@example.com"
+	email.Headers = map[string]string{"List-Unsubscribe": "<mailto:unsubscribe@example.com>"}
+	email.Tags = map[string]string{"campaign": "spring-2017", "batch": "7"}
+	_, err := w.Send(email)
+	if assert.NoError(s.T(), err) {
+		assert.Equal(s.T(), map[string]interface{}{"email": "support@example.com"}, body["reply_to"])
+		assert.Equal(s.T(), map[string]interface{}{"List-Unsubscribe": "<mailto:unsubscribe@example.com>"}, body["headers"])
+		assert.Equal(s.T(), []interface{}{"batch:7", "campaign:spring-2017"}, body["categories"])
+		assert.Equal(s.T(), map[string]interface{}{"batch": "7", "campaign": "spring-2017"}, body["custom_args"])
+	}
+}
+
+func (s *SendgridWorkerSuite) TestTagLimits() {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contents, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(contents, &body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	w := newSendgridWorker("SG.key")
+	w.baseUrl = server.URL
+
+	// a category is at most 255 characters, but a custom arg can be longer
+	long := strings.Repeat("a", 250)
+	email := testEmail()
+	email.Tags = map[string]string{"campaign": "spring-2017", "segment": long}
+	_, err := w.Send(email)
+	if assert.NoError(s.T(), err) {
+		assert.Equal(s.T(), []interface{}{"campaign:spring-2017"}, body["categories"])
+		assert.Equal(s.T(), map[string]interface{}{"campaign": "spring-2017", "segment": long}, body["custom_args"])
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// groups keeps the messages received from FIFO queues in order, it is set up by Run.
+var groups *sequencer
+
+type groupKey struct {
+	queueUrl string
+	groupId  string
+}
+
+// messageGroup is what the pipeline knows about a message group it holds messages of.
+type messageGroup struct {
+	// number of messages of the group received but not acknowledged yet
+	held int
+	// worker the group is pinned to while one of its messages is being sent
+	worker *worker
+	// messages waiting for the one being sent, in the order they were received
+	waiting []*Message
+	// when a message of the group last went back to its queue
+	returnedAt time.Time
+}
+
+// sequencer makes sure that the messages of a FIFO message group are sent one at a time,
+// in the order they were received, and all by the same worker. SQS does not hand out
+// further messages of a group while one of them is in flight, but a single receive can
+// return several messages of the same group.
+//
+// Once a message of a group goes back to its queue, the messages of the group that were
+// received before that go back too instead of overtaking it. SQS hands them out again,
+// in order, once the returned message becomes visible.
+type sequencer struct {
+	mu     sync.Mutex
+	groups map[groupKey]*messageGroup
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{groups: make(map[groupKey]*messageGroup)}
+}
+
+func groupOf(message *Message) (groupKey, bool) {
+	if message.Message.GroupId == "" {
+		return groupKey{}, false
+	}
+	return groupKey{queueUrl: message.QueueUrl, groupId: message.Message.GroupId}, true
+}
+
+// Hold starts keeping track of a message that was just received.
+func (s *sequencer) Hold(message *Message) {
+	key, ok := groupOf(message)
+	if s == nil || !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[key]
+	if !ok {
+		g = &messageGroup{}
+		s.groups[key] = g
+	}
+	g.held++
+}
+
+// Release stops keeping track of a message that was acknowledged.
+func (s *sequencer) Release(message *Message) {
+	key, ok := groupOf(message)
+	if s == nil || !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[key]
+	if !ok {
+		return
+	}
+	g.held--
+	if g.held <= 0 && g.worker == nil {
+		delete(s.groups, key)
+	}
+}
+
+// Overtakes reports whether a message was received before a message of its group went
+// back to the queue, in which case it must go back as well.
+func (s *sequencer) Overtakes(message *Message) bool {
+	key, ok := groupOf(message)
+	if s == nil || !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[key]
+	return ok && message.receivedAt.Before(g.returnedAt)
+}
+
+// Join queues a message behind the message of its group that is being sent, and returns
+// the worker the group is pinned to. It returns nil if no message of the group is being
+// sent, in which case the message is routed like any other and passed to Start.
+func (s *sequencer) Join(message *Message) *worker {
+	key, ok := groupOf(message)
+	if s == nil || !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[key]
+	if !ok || g.worker == nil {
+		return nil
+	}
+	g.waiting = append(g.waiting, message)
+	g.worker.assign()
+	return g.worker
+}
+
+// Start pins the group of a message to the worker it was routed to.
+func (s *sequencer) Start(message *Message, w *worker) {
+	key, ok := groupOf(message)
+	if s == nil || !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g, ok := s.groups[key]; ok {
+		g.worker = w
+	}
+}
+
+// Returned records that a message went back to its queue without being sent.
+func (s *sequencer) Returned(message *Message) {
+	key, ok := groupOf(message)
+	if s == nil || !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g, ok := s.groups[key]; ok {
+		g.returnedAt = time.Now()
+	}
+}
+
+// Next is called once the worker of a group is done with one of its messages, and
+// returns the message of the group it sends next, if any. If the message was not sent,
+// the messages waiting behind it are returned to be handed back instead.
+func (s *sequencer) Next(message *Message, sent bool) (next *Message, handBack []*Message) {
+	key, ok := groupOf(message)
+	if s == nil || !ok {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[key]
+	if !ok {
+		return nil, nil
+	}
+
+	if !sent {
+		g.returnedAt = time.Now()
+		handBack, g.waiting = g.waiting, nil
+		for range handBack {
+			g.worker.unassign()
+		}
+	} else if len(g.waiting) > 0 {
+		next, g.waiting = g.waiting[0], g.waiting[1:]
+		return next, nil
+	}
+
+	g.worker = nil
+	if g.held <= 0 {
+		delete(s.groups, key)
+	}
+	return nil, handBack
+}
+
+// Drain removes all messages still waiting for their group, when shutting down.
+func (s *sequencer) Drain() []*Message {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var drained []*Message
+	for _, g := range s.groups {
+		for range g.waiting {
+			g.worker.unassign()
+		}
+		drained = append(drained, g.waiting...)
+		g.waiting = nil
+	}
+	return drained
+}
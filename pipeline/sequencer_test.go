@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gomail/queue"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SequencerSuite struct {
+	suite.Suite
+}
+
+func TestSequencerSuite(t *testing.T) {
+	suite.Run(t, new(SequencerSuite))
+}
+
+func testGroupMessage(id int, groupId string) *Message {
+	message := testMessage(id)
+	message.Message.GroupId = groupId
+	return message
+}
+
+func (s *SequencerSuite) TestNext() {
+	seq := newSequencer()
+	w := newWorker("A", &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+	first, second, third := testGroupMessage(1, "a"), testGroupMessage(2, "a"), testGroupMessage(3, "a")
+	other := testGroupMessage(4, "b")
+	for _, message := range []*Message{first, second, third, other} {
+		seq.Hold(message)
+	}
+
+	// the first message of a group is routed, the following ones wait for it
+	assert.Nil(s.T(), seq.Join(first))
+	seq.Start(first, w)
+	assert.Equal(s.T(), w, seq.Join(second))
+	assert.Equal(s.T(), w, seq.Join(third))
+	assert.Nil(s.T(), seq.Join(other))
+	assert.Equal(s.T(), 2, w.pending)
+
+	next, handBack := seq.Next(first, true)
+	assert.Equal(s.T(), second, next)
+	assert.Empty(s.T(), handBack)
+
+	// once a message goes back to the queue, the ones behind it follow
+	next, handBack = seq.Next(second, false)
+	assert.Nil(s.T(), next)
+	assert.Equal(s.T(), []*Message{third}, handBack)
+	assert.Equal(s.T(), 1, w.pending)
+
+	// and so do messages of the group received before that
+	assert.True(s.T(), seq.Overtakes(third))
+	assert.False(s.T(), seq.Overtakes(other))
+	late := testGroupMessage(5, "a")
+	assert.False(s.T(), seq.Overtakes(late))
+
+	// the group is forgotten once all of its messages were acknowledged
+	for _, message := range []*Message{first, second, third} {
+		seq.Release(message)
+	}
+	assert.Len(s.T(), seq.groups, 1)
+}
+
+// sendRecorder records which worker sent which subject, and fails every subject listed
+// in failures once.
+type sendRecorder struct {
+	mu       sync.Mutex
+	sends    []string
+	workers  map[string]string
+	failures map[string]bool
+}
+
+func (r *sendRecorder) record(worker string, email *Email) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sends = append(r.sends, email.Subject)
+	r.workers[email.Subject] = worker
+	if r.failures[email.Subject] {
+		delete(r.failures, email.Subject)
+		return fmt.Errorf("failed to send %s", email.Subject)
+	}
+	return nil
+}
+
+func (r *sendRecorder) Sends() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.sends...)
+}
+
+type recordingWorker struct {
+	name     string
+	recorder *sendRecorder
+}
+
+func (w *recordingWorker) Send(email *Email) (string, error) {
+	return "", w.recorder.record(w.name, email)
+}
+
+func (s *SequencerSuite) TestRunFIFO() {
+	const fifoQueueUrl = "gomail-mails.fifo"
+	config = &Config{
+		Queues:                          []QueueConfig{{Url: fifoQueueUrl}},
+		ConsumersPerQueue:               1,
+		WaitTimeSeconds:                 1,
+		MessageBufferSize:               10,
+		MaxInFlightMessages:             100,
+		HealthCheckIntervalMilliseconds: 1000,
+		AckFlushIntervalMilliseconds:    10,
+		AckMaxRetries:                   1,
+		ShutdownTimeoutSeconds:          5,
+		RetryBaseDelaySeconds:           1,
+		RetryMaxDelaySeconds:            1,
+		MaxAttempts:                     defaultMaxAttempts,
+	}
+	queueBackend = queue.NewMemory(30)
+	for _, subject := range []string{"a1", "b1", "a2", "a3", "b2", "a4"} {
+		queueBackend.Send(fifoQueueUrl, queue.SendInput{
+			Body:    fmt.Sprintf(`{"email":{"subject":"%s"}}`, subject),
+			GroupId: subject[:1],
+		})
+	}
+
+	// a2 fails once, a3 and a4 must not overtake it
+	recorder := &sendRecorder{workers: map[string]string{}, failures: map[string]bool{"a2": true}}
+	p := &Pipeline{
+		messages: newPriorityQueue(config.PriorityWeights, config.MessageBufferSize),
+	}
+	for _, name := range []string{"A", "B"} {
+		w := &recordingWorker{name: name, recorder: recorder}
+		p.workers = append(p.workers, newWorker(name, w, ProviderConfig{MaxConcurrency: 3}))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- p.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.Sends()) < 7 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	assert.NoError(s.T(), <-stopped)
+
+	sends := map[string][]string{}
+	for _, subject := range recorder.Sends() {
+		sends[subject[:1]] = append(sends[subject[:1]], subject)
+	}
+	assert.Equal(s.T(), []string{"a1", "a2", "a2", "a3", "a4"}, sends["a"])
+	assert.Equal(s.T(), []string{"b1", "b2"}, sends["b"])
+	// messages of a group received together are sent by the same worker
+	assert.Equal(s.T(), recorder.workers["b1"], recorder.workers["b2"])
+}
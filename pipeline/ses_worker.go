@@ -1,64 +1,218 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ses"
 )
 
-type SESWorker struct {
-	*worker
+const (
+	// how often the sending limits of the SES account are read
+	sesQuotaPollInterval = time.Minute
+
+	sesThrottlingErrorCode = "Throttling"
+	// message of the Throttling error returned once the 24 hour quota is used up
+	sesDailyQuotaExceeded = "Daily message quota exceeded"
+)
+
+// SES error codes caused by the message itself rather than by the service
+var sesPermanentErrorCodes = map[string]bool{
+	"InvalidParameterValue": true,
 }
 
-func (w *SESWorker) Send(messages []*Message, failures chan<- int) {
-	emailStatus := make(chan bool)
-	for _, message := range messages {
-		go w.send(message, emailStatus)
-	}
+// SES returns MessageRejected for problems of the account as well, e.g. a recipient that
+// is not verified while the account is in the sandbox, or sending that was paused. Only
+// these messages say that the content of the message itself was rejected.
+var sesRejectedContentMessages = []string{
+	"virus",
+	"content",
+}
 
-	var failedEmails int
-	for i := 0; i < len(messages); i++ {
-		success := <-emailStatus
-		if !success {
-			failedEmails++
+// isSESContentRejected reports whether SES rejected a message because of its content.
+func isSESContentRejected(awsErr awserr.Error) bool {
+	if awsErr.Code() != "MessageRejected" {
+		return false
+	}
+	message := strings.ToLower(awsErr.Message())
+	for _, rejected := range sesRejectedContentMessages {
+		if strings.Contains(message, rejected) {
+			return true
 		}
 	}
-	close(emailStatus)
+	return false
+}
 
-	failures <- failedEmails
+// classifySESError turns an error of SES into a permanent error if SES refused the
+// message itself (but not if it refused the account, see sesRejectedContentMessages), or into a throttled error if SES refused to take more messages for
+// now. Once the 24 hour quota is used up, sending is retried after quotaRetryAfter.
+func classifySESError(err error, quotaRetryAfter time.Duration) error {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	if sesPermanentErrorCodes[awsErr.Code()] || isSESContentRejected(awsErr) {
+		return newPermanentError(err)
+	}
+	if isSESDailyQuotaExceeded(err) {
+		return newThrottledError(err, quotaRetryAfter)
+	}
+	if awsErr.Code() == sesThrottlingErrorCode {
+		return newThrottledError(err, minThrottleDelay)
+	}
+	return err
 }
 
-func (w *SESWorker) send(message *Message, status chan<- bool) {
-	email, err := messageToEmail(message.Message)
+func isSESDailyQuotaExceeded(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == sesThrottlingErrorCode && strings.Contains(awsErr.Message(), sesDailyQuotaExceeded)
+}
+
+// SESWorker sends emails through SES as raw MIME messages (see mimeBuilder), no faster
+// than the maximum send rate of the account and only as long as its 24 hour sending
+// quota lasts. Both are read from SES every sesQuotaPollInterval while the pipeline runs
+// (see pace). The tags of an email become message tags, published to the event
+// destinations of the configuration set if there is one.
+type SESWorker struct {
+	configurationSet string
+
+	mu sync.Mutex
+	// paced at the maximum send rate of the account, nil until it is known
+	limiter     *rateLimiter
+	maxSendRate float64
+	// emails that can still be sent within the 24 hour quota, infinite if unlimited or
+	// not known yet
+	quotaLeft  float64
+	nextPollAt time.Time
+}
+
+func newSESWorker(config SESConfig) *SESWorker {
+	return &SESWorker{configurationSet: config.ConfigurationSet, quotaLeft: math.Inf(1)}
+}
+
+func (w *SESWorker) Send(email *Email) (string, error) {
+	if err := w.reserveQuota(); err != nil {
+		return "", err
+	}
+	w.rateLimiter().Wait()
+
+	// SES gives the message a Message-ID of its own
+	input := &ses.SendRawEmailInput{
+		Source:       aws.String(email.FromEmail),
+		Destinations: []*string{aws.String(email.ToEmail)},
+		RawMessage:   &ses.RawMessage{Data: formatEmail(email, "", time.Now())},
+	}
+	if w.configurationSet != "" {
+		input.ConfigurationSetName = aws.String(w.configurationSet)
+	}
+	for _, name := range sortedKeys(email.Tags) {
+		input.Tags = append(input.Tags, &ses.MessageTag{Name: aws.String(name), Value: aws.String(email.Tags[name])})
+	}
+	output, err := sesClient.SendRawEmail(input)
 	if err != nil {
-		log.Print("[ERROR] Could not convert sqs message to email: ", err.Error())
-		deleteFromQueue(message)
-		status <- true
-		// TODO push message to dead letter queue
+		w.releaseQuota(isSESDailyQuotaExceeded(err))
+		return "", classifySESError(err, w.untilNextPoll())
+	}
+	return aws.StringValue(output.MessageId), nil
+}
+
+func (w *SESWorker) rateLimiter() *rateLimiter {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.limiter
+}
+
+// untilNextPoll returns how long it is until the sending limits are read again.
+func (w *SESWorker) untilNextPoll() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if wait := w.nextPollAt.Sub(time.Now()); wait > 0 {
+		return wait
+	}
+	return sesQuotaPollInterval
+}
+
+// reserveQuota takes an email off the quota before it is sent, or returns a throttled
+// error if the quota is used up. If the quota could not be read when it was due, SES is
+// left to tell whether it is used up.
+func (w *SESWorker) reserveQuota() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.quotaLeft < 1 && time.Now().Before(w.nextPollAt) {
+		retryAfter := w.nextPollAt.Sub(time.Now())
+		return newThrottledError(fmt.Errorf("SES 24 hour sending quota is used up"), retryAfter)
+	}
+	w.quotaLeft--
+	return nil
+}
 
+// releaseQuota gives back the quota reserved for an email SES did not send. If SES said
+// the quota is used up, nothing is sent until the quota is read again.
+func (w *SESWorker) releaseQuota(quotaExceeded bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if quotaExceeded {
+		w.quotaLeft = 0
+		if !time.Now().Before(w.nextPollAt) {
+			w.nextPollAt = time.Now().Add(sesQuotaPollInterval)
+		}
 		return
 	}
+	w.quotaLeft++
+}
+
+// pace reads the sending limits of the SES account every sesQuotaPollInterval until ctx
+// is done.
+func (w *SESWorker) pace(ctx context.Context) {
+	ticker := time.NewTicker(sesQuotaPollInterval)
+	defer ticker.Stop()
+	for {
+		w.pollQuota()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
-	_, err = sesClient.SendEmail(&ses.SendEmailInput{
-		Source: aws.String(email.From()),
-		Destination: &ses.Destination{
-			ToAddresses: []*string{aws.String(email.To())},
-		},
-		Message: &ses.Message{
-			Subject: &ses.Content{Data: &email.Subject},
-			Body: &ses.Body{
-				Text: &ses.Content{Data: &email.Body},
-			},
-		},
-	})
+func (w *SESWorker) pollQuota() {
+	quota, err := sesClient.GetSendQuota(&ses.GetSendQuotaInput{})
 	if err != nil {
-		log.Print("[ERROR] SES: Could not send email: ", err.Error())
-		returnToQueue(message)
-		status <- false
+		log.Printf("[ERROR] SES: Could not read sending limits: %v", err)
 		return
 	}
+	maxSendRate := aws.Float64Value(quota.MaxSendRate)
+	max24HourSend := aws.Float64Value(quota.Max24HourSend)
+	sentLast24Hours := aws.Float64Value(quota.SentLast24Hours)
 
-	deleteFromQueue(message)
-	status <- true
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nextPollAt = time.Now().Add(sesQuotaPollInterval)
+	if maxSendRate > 0 && maxSendRate != w.maxSendRate {
+		if w.limiter == nil {
+			w.limiter = newRateLimiter(maxSendRate)
+		} else {
+			w.limiter.SetRate(maxSendRate)
+		}
+		w.maxSendRate = maxSendRate
+		log.Printf("[INFO] SES: Sending up to %g emails per second", maxSendRate)
+	}
+
+	// a negative maximum means the quota is unlimited
+	quotaLeft := math.Inf(1)
+	if max24HourSend >= 0 {
+		quotaLeft = max24HourSend - sentLast24Hours
+	}
+	if quotaLeft < 1 && w.quotaLeft >= 1 {
+		log.Printf("[ERROR] SES: 24 hour sending quota of %g emails is used up", max24HourSend)
+	}
+	w.quotaLeft = quotaLeft
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"gomail/awsmock"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SESWorkerSuite struct {
+	suite.Suite
+}
+
+func TestSESWorkerSuite(t *testing.T) {
+	suite.Run(t, new(SESWorkerSuite))
+}
+
+// fakeSES answers the SES calls the worker makes, and counts the emails it sends.
+type fakeSES struct {
+	sesiface.SESAPI
+	quota   ses.GetSendQuotaOutput
+	sendErr error
+	sent    int
+	// the last email sent
+	lastInput *ses.SendRawEmailInput
+}
+
+func (f *fakeSES) GetSendQuota(*ses.GetSendQuotaInput) (*ses.GetSendQuotaOutput, error) {
+	return &f.quota, nil
+}
+
+func (f *fakeSES) SendRawEmail(input *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
+	if f.sendErr != nil {
+		return nil, f.sendErr
+	}
+	f.sent++
+	f.lastInput = input
+	return &ses.SendRawEmailOutput{MessageId: aws.String(fmt.Sprintf("ses-%d", f.sent))}, nil
+}
+
+func (s *SESWorkerSuite) TestSend() {
+	testCases := []struct {
+		Case    string
+		SendErr error
+
+		ExpectedMessageId string
+		ExpectedPermanent bool
+		ExpectedThrottled bool
+	}{
+		{
+			Case:              "Sent",
+			ExpectedMessageId: "ses-1",
+		},
+		{
+			Case:              "Rejected content",
+			SendErr:           awsmock.NewMockAwsErr("MessageRejected", "Message rejected: the message content contains a virus."),
+			ExpectedPermanent: true,
+		},
+		{
+			Case:    "Rejected address not verified in the sandbox",
+			SendErr: awsmock.NewMockAwsErr("MessageRejected", "Email address is not verified. The following identities failed the check in region US-EAST-1: to@example.com"),
+		},
+		{
+			Case:    "Rejected while sending is paused",
+			SendErr: awsmock.NewMockAwsErr("MessageRejected", "Sending paused for this account."),
+		},
+		{
+			Case:              "Invalid parameter",
+			SendErr:           awsmock.NewMockAwsErr("InvalidParameterValue", "Missing final '@domain'"),
+			ExpectedPermanent: true,
+		},
+		{
+			Case:              "Maximum send rate exceeded",
+			SendErr:           awsmock.NewMockAwsErr(sesThrottlingErrorCode, "Maximum sending rate exceeded."),
+			ExpectedThrottled: true,
+		},
+		{
+			Case:              "Daily quota exceeded",
+			SendErr:           awsmock.NewMockAwsErr(sesThrottlingErrorCode, "Daily message quota exceeded."),
+			ExpectedThrottled: true,
+		},
+		{
+			Case:    "Service unavailable",
+			SendErr: awsmock.NewMockAwsErr("ServiceUnavailable", "Service is unavailable."),
+		},
+	}
+
+	for _, testCase := range testCases {
+		fake := &fakeSES{sendErr: testCase.SendErr}
+		sesClient = fake
+		messageId, err := newSESWorker(SESConfig{}).Send(testEmail())
+		if testCase.SendErr == nil {
+			assert.NoError(s.T(), err, testCase.Case)
+			assert.Equal(s.T(), testCase.ExpectedMessageId, messageId, testCase.Case)
+			assert.Equal(s.T(), "from@example.com", aws.StringValue(fake.lastInput.Source), testCase.Case)
+			assert.Equal(s.T(), []string{"to@example.com"}, aws.StringValueSlice(fake.lastInput.Destinations), testCase.Case)
+			// SES sets the Message-ID itself
+			raw := string(fake.lastInput.RawMessage.Data)
+			assert.Contains(s.T(), raw, "To: <to@example.com>\r\nSubject: Test subject\r\n", testCase.Case)
+			assert.NotContains(s.T(), raw, "Message-ID", testCase.Case)
+			continue
+		}
+		if assert.Error(s.T(), err, testCase.Case) {
+			assert.Equal(s.T(), testCase.ExpectedPermanent, isPermanent(err), testCase.Case)
+			assert.Equal(s.T(), testCase.ExpectedThrottled, isThrottled(err), testCase.Case)
+		}
+	}
+}
+
+func (s *SESWorkerSuite) TestQuota() {
+	fake := &fakeSES{quota: ses.GetSendQuotaOutput{
+		MaxSendRate:     aws.Float64(100),
+		Max24HourSend:   aws.Float64(200),
+		SentLast24Hours: aws.Float64(198),
+	}}
+	sesClient = fake
+	w := newSESWorker(SESConfig{})
+	w.pollQuota()
+	assert.Equal(s.T(), float64(100), w.rateLimiter().Rate())
+
+	// the 2 emails left are sent 10ms apart, after which SES is not asked again until the
+	// quota is read again
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := w.Send(testEmail())
+		assert.NoError(s.T(), err)
+	}
+	assert.True(s.T(), time.Since(start) >= 10*time.Millisecond)
+	_, err := w.Send(testEmail())
+	if assert.True(s.T(), isThrottled(err)) {
+		retryAfter, _ := requestedRetryDelay(err)
+		assert.True(s.T(), retryAfter > 0 && retryAfter <= sesQuotaPollInterval)
+	}
+	assert.Equal(s.T(), 2, fake.sent)
+
+	// an unlimited quota never runs out
+	fake.quota.Max24HourSend = aws.Float64(-1)
+	w.pollQuota()
+	assert.Equal(s.T(), math.Inf(1), w.quotaLeft)
+	_, err = w.Send(testEmail())
+	assert.NoError(s.T(), err)
+}
+
+func (s *SESWorkerSuite) TestTags() {
+	fake := &fakeSES{}
+	sesClient = fake
+	email := testEmail()
+	email.ReplyTo = "support@example.com"
+	email.Tags = map[string]string{"campaign": "spring-2017", "batch": "7"}
+
+	_, err := newSESWorker(SESConfig{ConfigurationSet: "gomail"}).Send(email)
+	if assert.NoError(s.T(), err) {
+		assert.Equal(s.T(), "gomail", aws.StringValue(fake.lastInput.ConfigurationSetName))
+		assert.Equal(s.T(), []*ses.MessageTag{
+			{Name: aws.String("batch"), Value: aws.String("7")},
+			{Name: aws.String("campaign"), Value: aws.String("spring-2017")},
+		}, fake.lastInput.Tags)
+		assert.Contains(s.T(), string(fake.lastInput.RawMessage.Data), "\r\nReply-To: <support@example.com>\r\n")
+	}
+
+	// without a configuration set, SES uses the default one of the account, if any
+	_, err = newSESWorker(SESConfig{}).Send(testEmail())
+	if assert.NoError(s.T(), err) {
+		assert.Nil(s.T(), fake.lastInput.ConfigurationSetName)
+		assert.Empty(s.T(), fake.lastInput.Tags)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handBack returns a message the pipeline is not going to send to its queue right away,
+// so that another pipeline node can pick it up without waiting for its visibility
+// timeout to expire.
+func (p *Pipeline) handBack(message *Message) {
+	atomic.AddInt64(&p.stats.handedBack, 1)
+	acks.ChangeVisibility(message, 0, nil)
+}
+
+// shutdown stops the pipeline once its context is done: no more messages are received,
+// sends that already started get up to shutdown_timeout_seconds to finish, messages that
+// were received but not sent yet are handed back, and all pending acknowledgements are
+// flushed before returning.
+func (p *Pipeline) shutdown(consumers, senders *sync.WaitGroup) {
+	log.Print("[INFO] Shutting down pipeline, no more messages will be received")
+	inFlight.Close()
+
+	timeout := time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+	deadline := time.Now().Add(timeout)
+	if !waitUntil(senders, deadline) {
+		log.Printf("[ERROR] Sends did not finish within %v", timeout)
+	}
+	if !waitUntil(consumers, deadline) {
+		log.Printf("[ERROR] Consumers did not stop within %v", timeout)
+	}
+
+	// whatever is left in the buffers was never picked up by a worker
+	for _, message := range p.messages.Drain() {
+		p.handBack(message)
+	}
+	for _, w := range p.workers {
+		for drained := false; !drained; {
+			select {
+			case message := <-w.jobs:
+				p.handBack(message)
+			default:
+				drained = true
+			}
+		}
+	}
+
+	for _, message := range groups.Drain() {
+		p.handBack(message)
+	}
+
+	acks.Flush()
+	log.Printf(
+		"[INFO] Pipeline stopped: %d messages received, %d sent, %d failed, %d expired, %d handed back, %d abandoned",
+		atomic.LoadInt64(&p.stats.received),
+		atomic.LoadInt64(&p.stats.sent),
+		atomic.LoadInt64(&p.stats.failed),
+		atomic.LoadInt64(&p.stats.expired),
+		atomic.LoadInt64(&p.stats.handedBack),
+		inFlight.InFlight(),
+	)
+}
+
+// waitUntil waits for wg, and returns false if deadline passed first.
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
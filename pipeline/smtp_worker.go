@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const smtpQuitTimeout = time.Second
+
+// SMTP reply codes that mean the relay refused our credentials rather than the message
+var smtpAuthenticationReplyCodes = map[int]bool{
+	530: true, // authentication required
+	534: true, // authentication mechanism is too weak
+	535: true, // authentication credentials invalid
+}
+
+// classifySMTPError turns an error of delivering a message into a permanent error if
+// the relay rejected the message for good (a 5xx reply to MAIL, RCPT or DATA). 4xx
+// replies, authentication failures and connection errors go away eventually.
+func classifySMTPError(err error) error {
+	if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code >= 500 && !smtpAuthenticationReplyCodes[protoErr.Code] {
+		return newPermanentError(err)
+	}
+	return err
+}
+
+// smtpConn is a connection to the relay that can be reused for further messages.
+type smtpConn struct {
+	conn     net.Conn
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+func (c *smtpConn) close() {
+	// a connection that is being closed is not worth waiting for
+	c.conn.SetDeadline(time.Now().Add(smtpQuitTimeout))
+	c.client.Quit()
+	c.client.Close()
+}
+
+// SMTPWorker delivers emails through an SMTP relay. Connections are kept open and
+// reused, up to one per concurrent send.
+type SMTPWorker struct {
+	config    SMTPConfig
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	idle []*smtpConn
+}
+
+func newSMTPWorker(config SMTPConfig) *SMTPWorker {
+	return &SMTPWorker{
+		config:    config,
+		tlsConfig: &tls.Config{ServerName: config.Host},
+	}
+}
+
+func (w *SMTPWorker) Send(email *Email) (string, error) {
+	// a relay that refuses the connection (e.g. a 554 greeting, or a 5xx reply to
+	// STARTTLS or AUTH) refuses every message, so it counts against the health of the
+	// worker rather than having the message dead-lettered
+	c, err := w.conn()
+	if err != nil {
+		return "", err
+	}
+
+	messageId := newMessageId(email)
+	c.conn.SetDeadline(time.Now().Add(w.timeout()))
+	err = deliverSMTP(c.client, email, messageId)
+	if err == nil {
+		w.release(c)
+		return messageId, nil
+	}
+
+	// if the relay refused the message, the connection can still be used for the next one
+	if _, ok := err.(*textproto.Error); ok && c.client.Reset() == nil {
+		w.release(c)
+	} else {
+		c.close()
+	}
+	return "", classifySMTPError(err)
+}
+
+func deliverSMTP(client *smtp.Client, email *Email, messageId string) error {
+	if err := client.Mail(email.FromEmail); err != nil {
+		return err
+	}
+	if err := client.Rcpt(email.ToEmail); err != nil {
+		return err
+	}
+	wc, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(formatEmail(email, messageId, time.Now())); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// conn returns an idle connection to the relay, or opens a new one if there is none.
+// Idle connections the relay may have dropped already are checked before being reused.
+func (w *SMTPWorker) conn() (*smtpConn, error) {
+	for {
+		w.mu.Lock()
+		if len(w.idle) == 0 {
+			w.mu.Unlock()
+			return w.dial()
+		}
+		c := w.idle[len(w.idle)-1]
+		w.idle = w.idle[:len(w.idle)-1]
+		w.mu.Unlock()
+
+		if time.Since(c.lastUsed) < w.idleTimeout() {
+			c.conn.SetDeadline(time.Now().Add(w.timeout()))
+			if c.client.Noop() == nil {
+				return c, nil
+			}
+		}
+		c.close()
+	}
+}
+
+// release returns a connection to the pool, or closes it if the pool is full.
+func (w *SMTPWorker) release(c *smtpConn) {
+	c.lastUsed = time.Now()
+	w.mu.Lock()
+	if len(w.idle) < w.config.MaxConcurrency {
+		w.idle = append(w.idle, c)
+		c = nil
+	}
+	w.mu.Unlock()
+	if c != nil {
+		c.close()
+	}
+}
+
+func (w *SMTPWorker) dial() (*smtpConn, error) {
+	addr := net.JoinHostPort(w.config.Host, strconv.Itoa(w.config.Port))
+	dialer := &net.Dialer{Timeout: w.timeout()}
+	var conn net.Conn
+	var err error
+	if w.config.TLS == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, w.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(w.timeout()))
+	client, err := smtp.NewClient(conn, w.config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &smtpConn{conn: conn, client: client}
+	if err := w.setup(client); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// setup upgrades a new connection to TLS and authenticates, as configured.
+func (w *SMTPWorker) setup(client *smtp.Client) error {
+	if w.config.TLS == smtpTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smtp relay %s does not support STARTTLS", w.config.Host)
+		}
+		if err := client.StartTLS(w.tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	var auth smtp.Auth
+	switch w.config.Auth {
+	case smtpAuthNone:
+		return nil
+	case smtpAuthPlain:
+		auth = smtp.PlainAuth("", w.config.Username, w.config.Password, w.config.Host)
+	case smtpAuthLogin:
+		auth = &loginAuth{username: w.config.Username, password: w.config.Password, host: w.config.Host}
+	case smtpAuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(w.config.Username, w.config.Password)
+	}
+	return client.Auth(auth)
+}
+
+func (w *SMTPWorker) timeout() time.Duration {
+	return time.Duration(w.config.TimeoutSeconds) * time.Second
+}
+
+func (w *SMTPWorker) idleTimeout() time.Duration {
+	return time.Duration(w.config.IdleTimeoutSeconds) * time.Second
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which net/smtp does not
+// provide. Like smtp.PlainAuth, it only sends credentials over TLS or to localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %s", fromServer)
+}
+
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// newMessageId generates a globally unique Message-ID for an email, without the angle
+// brackets, on the domain of its sender.
+func newMessageId(email *Email) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// This should never happen
+		panic("Could not generate message id: " + err.Error())
+	}
+	domain := emailDomain(email.FromEmail)
+	if domain == "" {
+		domain = "localhost"
+	}
+	return hex.EncodeToString(b) + "@" + domain
+}
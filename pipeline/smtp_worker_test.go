@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SMTPWorkerSuite struct {
+	suite.Suite
+}
+
+func TestSMTPWorkerSuite(t *testing.T) {
+	suite.Run(t, new(SMTPWorkerSuite))
+}
+
+const (
+	testSMTPUsername = "gomail"
+	testSMTPPassword = "secret"
+)
+
+// fakeSMTPServer is a minimal SMTP relay that accepts every message, unless told to
+// greet or reply to RCPT with an error.
+type fakeSMTPServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	rcptReply   string
+	// close the connection after every message
+	dropConnections bool
+
+	mu            sync.Mutex
+	greetingReply string
+	connections   int
+	mechanisms    []string
+	messages      []string
+}
+
+func newFakeSMTPServer(tlsConfig *tls.Config, implicitTLS bool) *fakeSMTPServer {
+	var l net.Listener
+	var err error
+	if implicitTLS {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	s := &fakeSMTPServer{listener: l, tlsConfig: tlsConfig, implicitTLS: implicitTLS}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.connections++
+			s.mu.Unlock()
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) Close() {
+	s.listener.Close()
+}
+
+// RefuseConnections makes the server greet new connections with an error reply, and
+// close them.
+func (s *fakeSMTPServer) RefuseConnections(reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.greetingReply = reply
+}
+
+func (s *fakeSMTPServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+func (s *fakeSMTPServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	s.mu.Lock()
+	greetingReply := s.greetingReply
+	s.mu.Unlock()
+	if greetingReply != "" {
+		tp.PrintfLine("%s", greetingReply)
+		return
+	}
+	tp.PrintfLine("220 localhost ESMTP")
+	secure := s.implicitTLS
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			if s.tlsConfig != nil && !secure {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN LOGIN CRAM-MD5")
+		case "STARTTLS":
+			tp.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, tp, secure = tlsConn, textproto.NewConn(tlsConn), true
+		case "AUTH":
+			if s.authenticate(tp, arg) {
+				tp.PrintfLine("235 2.7.0 Authentication successful")
+			} else {
+				tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+			}
+		case "RCPT":
+			if s.rcptReply != "" {
+				tp.PrintfLine("%s", s.rcptReply)
+			} else {
+				tp.PrintfLine("250 OK")
+			}
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+			if s.dropConnections {
+				return
+			}
+		case "MAIL", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) authenticate(tp *textproto.Conn, arg string) bool {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return false
+	}
+	s.mu.Lock()
+	s.mechanisms = append(s.mechanisms, strings.ToUpper(fields[0]))
+	s.mu.Unlock()
+
+	challenge := func(prompt string) string {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, _ := tp.ReadLine()
+		response, _ := base64.StdEncoding.DecodeString(line)
+		return string(response)
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		if len(fields) < 2 {
+			return false
+		}
+		response, _ := base64.StdEncoding.DecodeString(fields[1])
+		return string(response) == "\x00"+testSMTPUsername+"\x00"+testSMTPPassword
+	case "LOGIN":
+		return challenge("Username:") == testSMTPUsername && challenge("Password:") == testSMTPPassword
+	case "CRAM-MD5":
+		nonce := "<1234@localhost>"
+		d := hmac.New(md5.New, []byte(testSMTPPassword))
+		d.Write([]byte(nonce))
+		return challenge(nonce) == testSMTPUsername+" "+hex.EncodeToString(d.Sum(nil))
+	}
+	return false
+}
+
+// testTLSConfig returns a server TLS config with a self-signed certificate for
+// 127.0.0.1, and a pool of roots that trusts it.
+func testTLSConfig() (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, roots
+}
+
+func newTestSMTPWorker(server *fakeSMTPServer, roots *x509.CertPool, smtpConfig SMTPConfig) *SMTPWorker {
+	smtpConfig.Host = "127.0.0.1"
+	smtpConfig.Port = server.Port()
+	smtpConfig.MaxConcurrency = 1
+	if smtpConfig.Username == "" {
+		smtpConfig.Username = testSMTPUsername
+	}
+	smtpConfig.Password = testSMTPPassword
+	smtpConfig.TimeoutSeconds = 5
+	smtpConfig.IdleTimeoutSeconds = 60
+	w := newSMTPWorker(smtpConfig)
+	w.tlsConfig.RootCAs = roots
+	return w
+}
+
+func testEmail() *Email {
+	return &Email{
+		FromEmail: "from@example.com",
+		FromName:  "From Name",
+		ToEmail:   "to@example.com",
+		Subject:   "Test subject",
+		Body:      "Test body\nSecond line",
+	}
+}
+
+func (s *SMTPWorkerSuite) TestSend() {
+	serverTLSConfig, roots := testTLSConfig()
+	testCases := []struct {
+		Case          string
+		TLS           string
+		Auth          string
+		Username      string
+		GreetingReply string
+		RcptReply     string
+
+		ExpectedError     bool
+		ExpectedPermanent bool
+		ExpectedMechanism string
+	}{
+		{
+			Case:              "PLAIN without TLS to localhost",
+			TLS:               smtpTLSNone,
+			Auth:              smtpAuthPlain,
+			ExpectedMechanism: "PLAIN",
+		},
+		{
+			Case:              "LOGIN over STARTTLS",
+			TLS:               smtpTLSStartTLS,
+			Auth:              smtpAuthLogin,
+			ExpectedMechanism: "LOGIN",
+		},
+		{
+			Case:              "CRAM-MD5 over implicit TLS",
+			TLS:               smtpTLSImplicit,
+			Auth:              smtpAuthCRAMMD5,
+			ExpectedMechanism: "CRAM-MD5",
+		},
+		{
+			Case: "No authentication",
+			TLS:  smtpTLSStartTLS,
+			Auth: smtpAuthNone,
+		},
+		{
+			Case:              "Invalid credentials",
+			TLS:               smtpTLSStartTLS,
+			Auth:              smtpAuthPlain,
+			Username:          "someone-else",
+			ExpectedError:     true,
+			ExpectedPermanent: false,
+			ExpectedMechanism: "PLAIN",
+		},
+		{
+			Case:              "Connection refused by the relay",
+			TLS:               smtpTLSStartTLS,
+			Auth:              smtpAuthNone,
+			GreetingReply:     "554 5.7.1 No SMTP service here",
+			ExpectedError:     true,
+			ExpectedPermanent: false,
+		},
+		{
+			Case:              "Recipient rejected",
+			TLS:               smtpTLSStartTLS,
+			Auth:              smtpAuthNone,
+			RcptReply:         "550 5.1.1 No such user",
+			ExpectedError:     true,
+			ExpectedPermanent: true,
+		},
+		{
+			Case:              "Recipient temporarily unavailable",
+			TLS:               smtpTLSStartTLS,
+			Auth:              smtpAuthNone,
+			RcptReply:         "451 4.3.0 Try again later",
+			ExpectedError:     true,
+			ExpectedPermanent: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		server := newFakeSMTPServer(serverTLSConfig, testCase.TLS == smtpTLSImplicit)
+		if testCase.GreetingReply != "" {
+			server.RefuseConnections(testCase.GreetingReply)
+		}
+		server.rcptReply = testCase.RcptReply
+		w := newTestSMTPWorker(server, roots, SMTPConfig{
+			TLS:      testCase.TLS,
+			Auth:     testCase.Auth,
+			Username: testCase.Username,
+		})
+
+		messageId, err := w.Send(testEmail())
+		if testCase.ExpectedError {
+			if assert.Error(s.T(), err, testCase.Case) {
+				assert.Equal(s.T(), testCase.ExpectedPermanent, isPermanent(err), testCase.Case)
+			}
+			assert.Empty(s.T(), server.Messages(), testCase.Case)
+		} else if assert.NoError(s.T(), err, testCase.Case) && assert.Len(s.T(), server.Messages(), 1, testCase.Case) {
+			message := server.Messages()[0]
+			assert.Contains(s.T(), message, "From: \"From Name\" <from@example.com>\n", testCase.Case)
+			assert.Contains(s.T(), message, "To: <to@example.com>\n", testCase.Case)
+			assert.Contains(s.T(), message, "Subject: Test subject\n", testCase.Case)
+			assert.Contains(s.T(), message, "Message-ID: <"+messageId+">\n", testCase.Case)
+			assert.Contains(s.T(), message, "\n\nTest body\nSecond line\n", testCase.Case)
+		}
+		if testCase.ExpectedMechanism != "" {
+			assert.Equal(s.T(), []string{testCase.ExpectedMechanism}, server.mechanisms, testCase.Case)
+		}
+		server.Close()
+	}
+}
+
+func (s *SMTPWorkerSuite) TestConnectionReuse() {
+	testCases := []struct {
+		Case            string
+		RcptReply       string
+		DropConnections bool
+
+		ExpectedConnections int
+	}{
+		{
+			Case:                "Connection is reused",
+			ExpectedConnections: 1,
+		},
+		{
+			Case:                "Connection is reused after a rejection",
+			RcptReply:           "550 5.1.1 No such user",
+			ExpectedConnections: 1,
+		},
+		{
+			Case:                "Dropped connection is replaced",
+			DropConnections:     true,
+			ExpectedConnections: 3,
+		},
+	}
+
+	for _, testCase := range testCases {
+		server := newFakeSMTPServer(nil, false)
+		server.rcptReply = testCase.RcptReply
+		server.dropConnections = testCase.DropConnections
+		w := newTestSMTPWorker(server, nil, SMTPConfig{TLS: smtpTLSNone, Auth: smtpAuthPlain})
+
+		for i := 0; i < 3; i++ {
+			_, err := w.Send(testEmail())
+			if testCase.RcptReply == "" {
+				assert.NoError(s.T(), err, testCase.Case)
+			}
+		}
+		assert.Equal(s.T(), testCase.ExpectedConnections, server.Connections(), testCase.Case)
+		server.Close()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+const (
+	// Sendgrid takes up to 10 categories of up to 255 characters
+	sendgridMaxCategories     = 10
+	sendgridMaxCategoryLength = 255
+	// Mailgun takes up to 3 tags of up to 128 characters
+	mailgunMaxTags      = 3
+	mailgunMaxTagLength = 128
+)
+
+// sortedKeys returns the keys of a map in order, so that headers and tags are always
+// passed on in the same order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// providerTags formats the tags of an email as name:value, in the order of their names,
+// for a provider that takes up to maxTags tags of up to maxLength characters. The API
+// only knows the limits of every provider together, so the tags beyond the limits of
+// the provider are left out and logged rather than having the provider reject the email.
+func providerTags(provider string, tags map[string]string, maxTags, maxLength int) []string {
+	var formatted, dropped []string
+	for _, name := range sortedKeys(tags) {
+		tag := name + ":" + tags[name]
+		if len(formatted) >= maxTags || len(tag) > maxLength {
+			dropped = append(dropped, tag)
+			continue
+		}
+		formatted = append(formatted, tag)
+	}
+	if len(dropped) > 0 {
+		log.Printf("[INFO] %s: Leaving out tags beyond its limit of %d tags of %d characters: %v", provider, maxTags, maxLength, dropped)
+	}
+	return formatted
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"gomail/queue"
+)
+
+const (
+	// shortest time a throttled worker stops sending for, so that a provider that did
+	// not say when to come back is not asked again right away
+	minThrottleDelay = time.Second
+)
+
+// pacer is implemented by Workers that read the sending limits of their provider while
+// the pipeline runs.
+type pacer interface {
+	pace(ctx context.Context)
+}
+
+// throttle stops the worker from sending until the given time, because its provider
+// refused to take more messages for now. It returns the time the worker is throttled
+// until, which is later than the given time if it was throttled for longer already.
+func (w *worker) throttle(until time.Time, cause error) time.Time {
+	if min := time.Now().Add(minThrottleDelay); until.Before(min) {
+		until = min
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !until.After(w.throttledUntil) {
+		return w.throttledUntil
+	}
+	if !time.Now().Before(w.throttledUntil) {
+		log.Printf("[INFO] %s is throttled until %s: %v", w.name, until.UTC().Format(time.RFC3339), cause)
+	}
+	w.throttledUntil = until
+	return until
+}
+
+// IsThrottled reports whether the provider of the worker asked us to stop sending for
+// now.
+func (w *worker) IsThrottled() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Now().Before(w.throttledUntil)
+}
+
+// waitUntilUnthrottled blocks while the worker is throttled, but not past deadline. It
+// returns false if ctx was done first.
+func (w *worker) waitUntilUnthrottled(ctx context.Context, deadline time.Time) bool {
+	for {
+		w.mu.Lock()
+		until := w.throttledUntil
+		w.mu.Unlock()
+		if until.After(deadline) {
+			until = deadline
+		}
+		wait := until.Sub(time.Now())
+		if wait <= 0 {
+			return ctx.Err() == nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// recordThrottled accounts a send the provider throttled. Throttling is the provider
+// pacing us rather than failing, so it does not count against the worker's health.
+func (w *worker) recordThrottled(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.windowThrottled++
+	w.lastError = err.Error()
+	w.lastErrorAt = time.Now()
+}
+
+// tryEnqueue hands a message to the worker's pool if the pool can take it right away.
+func (w *worker) tryEnqueue(message *Message) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case w.jobs <- message:
+		w.pending++
+		w.windowRouted++
+		return true
+	default:
+		return false
+	}
+}
+
+// unthrottled leaves out the throttled workers, unless all available workers are
+// throttled.
+func unthrottled(workers []*worker) []*worker {
+	candidates := make([]*worker, 0, len(workers))
+	for _, w := range workers {
+		if w.IsAvailable() && !w.IsThrottled() {
+			candidates = append(candidates, w)
+		}
+	}
+	if len(candidates) == 0 {
+		return workers
+	}
+	return candidates
+}
+
+// holdThrottled deals with a message the provider of a worker throttled instead of
+// sending it. The message is not failed: it goes to another worker that is not throttled
+// and can take it right away, or else waits for the throttle to end and is sent by the
+// same worker again. The messages of a FIFO group stay with the worker their group is
+// pinned to. A message that would be throttled for longer than retry_max_delay_seconds
+// (e.g. by a send budget that is used up until the end of the day) is held in its queue
+// until the throttle ends instead (see holdInQueue).
+//
+// holdThrottled returns true if the message should be sent again. Otherwise the message
+// was rerouted, held or handed back.
+func (p *Pipeline) holdThrottled(ctx context.Context, w *worker, message *Message, err error, throttledSince time.Time) bool {
+	retryAfter, _ := requestedRetryDelay(err)
+	throttledUntil := w.throttle(time.Now().Add(retryAfter), err)
+	w.recordThrottled(err)
+	atomic.AddInt64(&p.stats.throttled, 1)
+
+	if _, grouped := groupOf(message); !grouped {
+		var others []*worker
+		for _, other := range p.workers {
+			if other != w && other.IsAvailable() && !other.IsThrottled() {
+				others = append(others, other)
+			}
+		}
+		if other := p.routeBetween(others); other != nil && other.tryEnqueue(message) {
+			log.Printf("[INFO] Message %s was throttled by %s, rerouting it to %s", message.Message.Id, w.name, other.name)
+			w.unassign()
+			return false
+		}
+	}
+
+	maxDelay := time.Duration(config.RetryMaxDelaySeconds) * time.Second
+	if throttledUntil.After(throttledSince.Add(maxDelay)) {
+		log.Printf("[INFO] %s: Message %s was throttled for too long, holding it in its queue", w.name, message.Message.Id)
+		w.unassign()
+		holdInQueue(message, throttledUntil)
+		return false
+	}
+	if !w.waitUntilUnthrottled(ctx, throttledSince.Add(maxDelay)) {
+		// shutting down, the message has not been sent yet
+		p.handBack(message)
+		return false
+	}
+	return true
+}
+
+// holdInQueue hands a throttled message back to its queue until the throttle ends.
+// Unlike a failed message, a held message was not attempted, so that it can wait for a
+// used up send budget to reset without being moved to the dead letter queue. Messages of
+// standard queues are requeued together with their attempt history, which starts the copy
+// off at the attempts the message had, and wait for at most 15 minutes before they are
+// received (and held) again. Messages of FIFO queues, which must keep their place in
+// their group, stay invisible until the throttle ends or for as long as the queue lets
+// them instead, and their next receive counts as an attempt.
+func holdInQueue(message *Message, until time.Time) {
+	delay := int64(math.Ceil(until.Sub(time.Now()).Seconds()))
+	if delay < 0 {
+		delay = 0
+	}
+	if !queue.IsFIFO(message.QueueUrl) {
+		if delay > queue.MaxDelaySeconds {
+			delay = queue.MaxDelaySeconds
+		}
+		if requeue(message, delay) {
+			log.Printf("[INFO] Message %s is held in its queue for %ds", message.Message.Id, delay)
+			return
+		}
+	}
+
+	// SQS keeps a received message invisible for at most 12 hours after it was received
+	received := int64(time.Since(message.receivedAt).Seconds())
+	if max := queue.MaxVisibilityTimeoutSeconds - received; delay > max {
+		delay = max
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	acks.ChangeVisibility(message, delay, nil)
+	log.Printf("[INFO] Message %s is held in its queue for %ds", message.Message.Id, delay)
+}
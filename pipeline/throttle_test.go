@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gomail/queue"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ThrottleSuite struct {
+	suite.Suite
+}
+
+func TestThrottleSuite(t *testing.T) {
+	suite.Run(t, new(ThrottleSuite))
+}
+
+// throttlingWorker throttles the first sends it is asked for, and sends the rest.
+type throttlingWorker struct {
+	throttled  int64
+	retryAfter time.Duration
+	sends      int64
+}
+
+func (w *throttlingWorker) Send(email *Email) (string, error) {
+	if atomic.AddInt64(&w.sends, 1) <= w.throttled {
+		return "", newThrottledError(fmt.Errorf("slow down"), w.retryAfter)
+	}
+	return "", nil
+}
+
+func (s *ThrottleSuite) SetupTest() {
+	config = &Config{UnhealthyThreshold: 1, HealthyThreshold: 1, RetryMaxDelaySeconds: 900, AckMaxRetries: 1}
+	queueBackend = queue.NewMemory(30)
+	acks = newAcknowledger()
+}
+
+// TearDownTest drops the visibility changes of the messages the tests handed back, so
+// that they are not flushed to the queue backend of a later suite.
+func (s *ThrottleSuite) TearDownTest() {
+	acks = newAcknowledger()
+}
+
+func (s *ThrottleSuite) TestReroute() {
+	throttling := newWorker("SES", &throttlingWorker{throttled: 1, retryAfter: time.Minute}, ProviderConfig{MaxConcurrency: 1})
+	other := newWorker("Sendgrid", &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+	p := &Pipeline{workers: []*worker{throttling, other}}
+
+	message := testMessage(1)
+	throttling.assign()
+	assert.False(s.T(), p.send(context.Background(), throttling, message))
+
+	// the message went to the other worker, without failing
+	select {
+	case rerouted := <-other.jobs:
+		assert.Equal(s.T(), message, rerouted)
+	default:
+		s.T().Error("message was not rerouted")
+	}
+	assert.Equal(s.T(), 1, other.status().Pending)
+	assert.Equal(s.T(), 0, throttling.status().Pending)
+	assert.Equal(s.T(), int64(1), p.stats.throttled)
+	assert.Equal(s.T(), int64(0), p.stats.failed)
+
+	// throttling does not count against the health of the worker
+	throttling.endWindow()
+	assert.True(s.T(), throttling.IsHealthy())
+	if status := throttling.status(); assert.NotNil(s.T(), status.ThrottledUntil) {
+		assert.WithinDuration(s.T(), time.Now().Add(time.Minute), *status.ThrottledUntil, 5*time.Second)
+	}
+
+	// and it gets no messages while it is throttled
+	assert.Equal(s.T(), map[string]int{"Sendgrid": 10}, routeCounts(p, 10))
+}
+
+func (s *ThrottleSuite) TestHold() {
+	throttling := &throttlingWorker{throttled: 2}
+	w := newWorker("SES", throttling, ProviderConfig{MaxConcurrency: 1})
+	p := &Pipeline{workers: []*worker{w}}
+
+	// with nowhere else to go, the message waits for the throttle to end
+	start := time.Now()
+	w.assign()
+	assert.True(s.T(), p.send(context.Background(), w, testMessage(1)))
+	assert.True(s.T(), time.Since(start) >= 2*minThrottleDelay)
+	assert.Equal(s.T(), int64(3), atomic.LoadInt64(&throttling.sends))
+	assert.Equal(s.T(), int64(2), p.stats.throttled)
+	assert.Equal(s.T(), int64(1), p.stats.sent)
+	assert.Equal(s.T(), 0, w.status().Pending)
+}
+
+func (s *ThrottleSuite) TestHoldShutdown() {
+	w := newWorker("SES", &throttlingWorker{throttled: 1, retryAfter: 10 * time.Minute}, ProviderConfig{MaxConcurrency: 1})
+	p := &Pipeline{workers: []*worker{w}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	w.assign()
+	assert.False(s.T(), p.send(ctx, w, testMessage(1)))
+	assert.True(s.T(), time.Since(start) < time.Minute)
+	assert.Equal(s.T(), int64(1), p.stats.handedBack)
+	assert.Equal(s.T(), int64(0), p.stats.failed)
+}
+
+func (s *ThrottleSuite) TestHoldInQueueRightAway() {
+	w := newWorker("SES", &throttlingWorker{throttled: 1, retryAfter: time.Hour}, ProviderConfig{MaxConcurrency: 1})
+	p := &Pipeline{workers: []*worker{w}}
+
+	// a throttle longer than retry_max_delay_seconds is not waited for
+	start := time.Now()
+	w.assign()
+	assert.False(s.T(), p.send(context.Background(), w, testMessage(1)))
+	assert.True(s.T(), time.Since(start) < time.Second)
+	assert.Equal(s.T(), int64(1), p.stats.throttled)
+	assert.Equal(s.T(), int64(0), p.stats.handedBack)
+	assert.Equal(s.T(), int64(0), p.stats.failed)
+	assert.Equal(s.T(), 0, w.status().Pending)
+}
+
+func (s *ThrottleSuite) TestRoutingRuleSkipsThrottledProvider() {
+	config.RoutingRules = []RoutingRule{{RecipientDomains: []string{"example.com"}, Providers: []string{"SES"}}}
+	ses := newWorker("SES", &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+	sendgrid := newWorker("Sendgrid", &nopWorker{}, ProviderConfig{MaxConcurrency: 1})
+	p := &Pipeline{workers: []*worker{ses, sendgrid}}
+	message := testMessage(1)
+	message.Email = &Email{ToEmail: "to@example.com"}
+
+	assert.Equal(s.T(), ses, p.routeMessage(message))
+	ses.throttle(time.Now().Add(time.Minute), fmt.Errorf("slow down"))
+	assert.Equal(s.T(), sendgrid, p.routeMessage(message))
+}
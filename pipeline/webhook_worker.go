@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webhookTimestampHeader = "X-Gomail-Timestamp"
+	webhookSignatureHeader = "X-Gomail-Signature"
+	// response header the service can set to the id it gave the message
+	webhookMessageIdHeader = "X-Message-Id"
+
+	// enough of the response body to tell what went wrong
+	maxWebhookErrorBodySize = 1024
+)
+
+// signWebhook calculates the signature of a webhook request: the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the request body, keyed with the shared
+// secret. Signing the timestamp lets the receiver reject replayed requests.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// classifyWebhookResponse turns an unsuccessful response of the delivery service into an
+// error. An overloaded service throttles the worker: if it said when to come back, the
+// message is not retried any sooner.
+func classifyWebhookResponse(resp *http.Response, body string, now time.Time) error {
+	err := fmt.Errorf("webhook responded with status code %d: %s", resp.StatusCode, body)
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			return newThrottledError(err, retryAfter)
+		}
+		return newThrottledError(err, minThrottleDelay)
+	}
+	return classifyHTTPStatus(resp.StatusCode, err)
+}
+
+// WebhookWorker posts emails as JSON to an in-house delivery service.
+type WebhookWorker struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newWebhookWorker(config WebhookConfig) *WebhookWorker {
+	return &WebhookWorker{
+		url:    config.Url,
+		secret: config.Secret,
+		client: &http.Client{Timeout: time.Duration(config.TimeoutSeconds) * time.Second},
+	}
+}
+
+func (w *WebhookWorker) Send(email *Email) (string, error) {
+	body, err := json.Marshal(&MessageBody{Email: email})
+	if err != nil {
+		return "", newPermanentError(err)
+	}
+
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhook(w.secret, timestamp, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebhookErrorBodySize))
+		return "", classifyWebhookResponse(resp, strings.TrimSpace(string(respBody)), time.Now())
+	}
+	// drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Header.Get(webhookMessageIdHeader), nil
+}
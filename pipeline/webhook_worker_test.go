@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type WebhookWorkerSuite struct {
+	suite.Suite
+}
+
+func TestWebhookWorkerSuite(t *testing.T) {
+	suite.Run(t, new(WebhookWorkerSuite))
+}
+
+const testWebhookSecret = "webhook-secret"
+
+func (s *WebhookWorkerSuite) TestSend() {
+	testCases := []struct {
+		Case       string
+		StatusCode int
+		RetryAfter string
+		MessageId  string
+
+		ExpectedError      bool
+		ExpectedPermanent  bool
+		ExpectedRetryAfter time.Duration
+	}{
+		{
+			Case:       "Accepted",
+			StatusCode: http.StatusAccepted,
+			MessageId:  "delivery-123",
+		},
+		{
+			Case:       "No content",
+			StatusCode: http.StatusNoContent,
+		},
+		{
+			Case:              "Rejected",
+			StatusCode:        http.StatusUnprocessableEntity,
+			ExpectedError:     true,
+			ExpectedPermanent: true,
+		},
+		{
+			Case:               "Rate limited with Retry-After",
+			StatusCode:         http.StatusTooManyRequests,
+			RetryAfter:         "30",
+			ExpectedError:      true,
+			ExpectedRetryAfter: 30 * time.Second,
+		},
+		{
+			Case:               "Rate limited without Retry-After",
+			StatusCode:         http.StatusTooManyRequests,
+			ExpectedError:      true,
+			ExpectedRetryAfter: minThrottleDelay,
+		},
+		{
+			Case:               "Unavailable with Retry-After",
+			StatusCode:         http.StatusServiceUnavailable,
+			RetryAfter:         "120",
+			ExpectedError:      true,
+			ExpectedRetryAfter: 2 * time.Minute,
+		},
+		{
+			Case:               "Unavailable without Retry-After",
+			StatusCode:         http.StatusServiceUnavailable,
+			ExpectedError:      true,
+			ExpectedRetryAfter: minThrottleDelay,
+		},
+		{
+			Case:          "Server error",
+			StatusCode:    http.StatusInternalServerError,
+			RetryAfter:    "30",
+			ExpectedError: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		var request *http.Request
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request = r
+			body, _ = ioutil.ReadAll(r.Body)
+			if testCase.RetryAfter != "" {
+				w.Header().Set("Retry-After", testCase.RetryAfter)
+			}
+			if testCase.MessageId != "" {
+				w.Header().Set(webhookMessageIdHeader, testCase.MessageId)
+			}
+			w.WriteHeader(testCase.StatusCode)
+		}))
+		w := newWebhookWorker(WebhookConfig{Url: server.URL + "/deliver", Secret: testWebhookSecret, TimeoutSeconds: 5})
+
+		messageId, err := w.Send(testEmail())
+		server.Close()
+
+		if assert.NotNil(s.T(), request, testCase.Case) {
+			assert.Equal(s.T(), "POST", request.Method, testCase.Case)
+			assert.Equal(s.T(), "/deliver", request.URL.Path, testCase.Case)
+			assert.Equal(s.T(), "application/json", request.Header.Get("Content-Type"), testCase.Case)
+			timestamp := request.Header.Get(webhookTimestampHeader)
+			assert.NotEmpty(s.T(), timestamp, testCase.Case)
+			assert.Equal(s.T(), signWebhook(testWebhookSecret, timestamp, body), request.Header.Get(webhookSignatureHeader), testCase.Case)
+
+			var messageBody MessageBody
+			if assert.NoError(s.T(), json.Unmarshal(body, &messageBody), testCase.Case) {
+				assert.Equal(s.T(), testEmail(), messageBody.Email, testCase.Case)
+			}
+		}
+		if !testCase.ExpectedError {
+			assert.NoError(s.T(), err, testCase.Case)
+			assert.Equal(s.T(), testCase.MessageId, messageId, testCase.Case)
+			continue
+		}
+		if assert.Error(s.T(), err, testCase.Case) {
+			assert.Equal(s.T(), testCase.ExpectedPermanent, isPermanent(err), testCase.Case)
+			retryAfter, throttled := requestedRetryDelay(err)
+			assert.Equal(s.T(), testCase.ExpectedRetryAfter != 0, throttled, testCase.Case)
+			assert.Equal(s.T(), testCase.ExpectedRetryAfter, retryAfter, testCase.Case)
+		}
+	}
+}
+
+func (s *WebhookWorkerSuite) TestSignWebhook() {
+	// echo -n '1488369600.{}' | openssl dgst -sha256 -hmac webhook-secret
+	assert.Equal(s.T(),
+		"sha256=e18f8aefc7fa2e541b1d7afdd318af83227279376751ebe119704ade4a18526b",
+		signWebhook(testWebhookSecret, "1488369600", []byte("{}")),
+	)
+}
+
+func (s *WebhookWorkerSuite) TestParseRetryAfter() {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		Case       string
+		RetryAfter string
+
+		ExpectedOk    bool
+		ExpectedDelay time.Duration
+	}{
+		{Case: "Seconds", RetryAfter: "90", ExpectedOk: true, ExpectedDelay: 90 * time.Second},
+		{Case: "HTTP date", RetryAfter: "Wed, 01 Mar 2017 12:05:00 GMT", ExpectedOk: true, ExpectedDelay: 5 * time.Minute},
+		{Case: "HTTP date in the past", RetryAfter: "Wed, 01 Mar 2017 11:00:00 GMT", ExpectedOk: true, ExpectedDelay: 0},
+		{Case: "Missing", RetryAfter: "", ExpectedOk: false},
+		{Case: "Negative", RetryAfter: "-5", ExpectedOk: false},
+		{Case: "Invalid", RetryAfter: "soon", ExpectedOk: false},
+	}
+
+	for _, testCase := range testCases {
+		delay, ok := parseRetryAfter(testCase.RetryAfter, now)
+		assert.Equal(s.T(), testCase.ExpectedOk, ok, testCase.Case)
+		assert.Equal(s.T(), testCase.ExpectedDelay, delay, testCase.Case)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Worker delivers emails through a single third party email service. A successful send
+// returns the id the service gave the message, if it gave one. A failed send returns an
+// error wrapped by newPermanentError if retrying the email is pointless.
+type Worker interface {
+	Send(email *Email) (string, error)
+}
+
+// worker wraps a Worker with the health tracking the pipeline uses to split messages,
+// and with the limits on how fast and how many messages are sent through it. Health is
+// evaluated once per health check window, from the results of the sends finished during
+// that window.
+type worker struct {
+	Worker
+	name        string
+	jobs        chan *Message
+	concurrency int
+	limiter     *rateLimiter
+	// nil if the provider has no send budget
+	budget *sendBudget
+
+	mu                    sync.Mutex
+	pending               int
+	isHealthy             bool
+	isDisabled            bool
+	consecHealthyChecks   int
+	consecUnhealthyChecks int
+	windowSends           int
+	windowFailures        int
+	windowThrottled       int
+	windowRouted          int
+	lastWindowRouted      int
+	probing               bool
+	lastError             string
+	lastErrorAt           time.Time
+	// the provider asked us not to send anything before then
+	throttledUntil time.Time
+}
+
+// workerStatus is a snapshot of a worker's state, as reported by the admin endpoint.
+type workerStatus struct {
+	Name                  string     `json:"name"`
+	Healthy               bool       `json:"healthy"`
+	Disabled              bool       `json:"disabled"`
+	ConsecHealthyChecks   int        `json:"consecHealthyChecks"`
+	ConsecUnhealthyChecks int        `json:"consecUnhealthyChecks"`
+	Pending               int        `json:"pending"`
+	LastError             string     `json:"lastError,omitempty"`
+	LastErrorAt           *time.Time `json:"lastErrorAt,omitempty"`
+	ThrottledUntil        *time.Time `json:"throttledUntil,omitempty"`
+	// what is left of the daily and monthly send budgets of the provider
+	Budgets []budgetStatus `json:"budgets,omitempty"`
+	// number of messages routed to the worker during the last health check window
+	Routed int `json:"routed"`
+	// share of all messages routed during the last health check window
+	Split float64 `json:"split"`
+}
+
+func newWorker(name string, w Worker, limits ProviderConfig) *worker {
+	return &worker{
+		Worker:      w,
+		name:        name,
+		jobs:        make(chan *Message, limits.MaxConcurrency),
+		concurrency: limits.MaxConcurrency,
+		limiter:     newRateLimiter(limits.MaxSendsPerSecond),
+		isHealthy:   true,
+	}
+}
+
+// Send sends an email through the provider, once it is counted against the provider's
+// send budget. An email the provider did not send is taken back from the budget.
+func (w *worker) Send(email *Email) (string, error) {
+	release, err := w.budget.Reserve(time.Now())
+	if err != nil {
+		return "", err
+	}
+	providerMessageId, err := w.Worker.Send(email)
+	if err != nil {
+		release()
+	}
+	return providerMessageId, err
+}
+
+// enqueue hands a message to the worker's pool, blocking while the pool is busy. It
+// returns false if ctx was done before the pool took the message.
+func (w *worker) enqueue(ctx context.Context, message *Message) bool {
+	w.assign()
+	select {
+	case w.jobs <- message:
+		return true
+	case <-ctx.Done():
+		w.unassign()
+		return false
+	}
+}
+
+// assign accounts a message routed to the worker, until recordResult is called for it.
+func (w *worker) assign() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending++
+	w.windowRouted++
+}
+
+// unassign takes back a message routed to the worker that it is not going to send.
+func (w *worker) unassign() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending--
+}
+
+// load returns how busy the worker is, relative to the number of messages it is
+// allowed to send concurrently.
+func (w *worker) load() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return float64(w.pending) / float64(w.concurrency)
+}
+
+func (w *worker) IsHealthy() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.isHealthy
+}
+
+// IsAvailable reports whether messages may be routed to the worker at all.
+func (w *worker) IsAvailable() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.isDisabled
+}
+
+// SetDisabled takes the worker out of (or back into) the split. A disabled worker still
+// finishes the messages already routed to it.
+func (w *worker) SetDisabled(disabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.isDisabled = disabled
+}
+
+// ForceHealthy marks the worker as healthy regardless of its recent results.
+func (w *worker) ForceHealthy() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.isHealthy = true
+	w.consecHealthyChecks = 0
+	w.consecUnhealthyChecks = 0
+}
+
+// recordResult accounts a finished send to the current health check window. err is
+// the error the send failed with, if any.
+func (w *worker) recordResult(failed bool, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending--
+	w.windowSends++
+	if failed {
+		w.windowFailures++
+	}
+	if err != nil {
+		w.lastError = err.Error()
+		w.lastErrorAt = time.Now()
+	}
+}
+
+func (w *worker) status() workerStatus {
+	// read before taking the lock, the counter store may take a while to answer
+	budgets := w.budget.Status(time.Now())
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	status := workerStatus{
+		Name:                  w.name,
+		Healthy:               w.isHealthy,
+		Disabled:              w.isDisabled,
+		ConsecHealthyChecks:   w.consecHealthyChecks,
+		ConsecUnhealthyChecks: w.consecUnhealthyChecks,
+		Pending:               w.pending,
+		LastError:             w.lastError,
+		Routed:                w.lastWindowRouted,
+		Budgets:               budgets,
+	}
+	if w.lastError != "" {
+		lastErrorAt := w.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	if time.Now().Before(w.throttledUntil) {
+		throttledUntil := w.throttledUntil
+		status.ThrottledUntil = &throttledUntil
+	}
+	return status
+}
+
+// claimProbe reports whether the unhealthy worker may take a message to check whether
+// it recovered. Only one message per health check window is handed out this way.
+func (w *worker) claimProbe() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.probing {
+		return false
+	}
+	w.probing = true
+	return true
+}
+
+// endWindow closes the current health check window and updates the health status from
+// its results. Windows in which the worker sent nothing do not count as checks.
+func (w *worker) endWindow() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sends, failures := w.windowSends, w.windowFailures
+	w.windowSends, w.windowFailures = 0, 0
+	w.lastWindowRouted, w.windowRouted = w.windowRouted, 0
+	w.probing = false
+	if w.windowThrottled > 0 {
+		log.Printf("[INFO] %s throttled %d messages", w.name, w.windowThrottled)
+		w.windowThrottled = 0
+	}
+	if sends == 0 {
+		return
+	}
+
+	log.Printf("[INFO] %s sent %d messages with %d failures", w.name, sends, failures)
+	w.updateHealthStatus(failures)
+}
+
+func (w *worker) updateHealthStatus(failures int) {
+	if failures > 0 {
+		if w.isHealthy {
+			w.consecUnhealthyChecks++
+		} else {
+			w.consecHealthyChecks = 0
+		}
+	} else {
+		if w.isHealthy {
+			w.consecUnhealthyChecks = 0
+		} else {
+			w.consecHealthyChecks++
+		}
+	}
+
+	if w.isHealthy && w.consecUnhealthyChecks >= config.UnhealthyThreshold {
+		log.Printf("[INFO] Setting worker %s health status to UNHEALTHY", w.name)
+		w.isHealthy = false
+		w.consecHealthyChecks = 0
+	}
+	if !w.isHealthy && w.consecHealthyChecks >= config.HealthyThreshold {
+		log.Printf("[INFO] Setting worker %s health status to HEALTHY", w.name)
+		w.isHealthy = true
+		w.consecUnhealthyChecks = 0
+	}
+}
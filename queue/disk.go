@@ -0,0 +1,231 @@
+package queue
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	recordFileExtension = ".json"
+	lockFileName        = ".lock"
+)
+
+// diskBackend keeps every queue in a directory, with one file per message. Messages
+// survive restarts, and processes sharing the directory (e.g. the API and the pipeline)
+// share the queues: every operation holds an exclusive lock on the queue's directory.
+type diskBackend struct {
+	directory         string
+	visibilityTimeout time.Duration
+}
+
+func NewDisk(directory string, visibilityTimeoutSeconds int64) (Backend, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	return &diskBackend{
+		directory:         directory,
+		visibilityTimeout: time.Duration(visibilityTimeoutSeconds) * time.Second,
+	}, nil
+}
+
+func (b *diskBackend) Send(queueUrl string, input SendInput) (string, error) {
+	if err := validateSendInput(queueUrl, input); err != nil {
+		return "", err
+	}
+
+	r := newRecord(queueUrl, input, time.Now())
+	id := r.Id
+	err := b.withQueue(queueUrl, func(dir string) error {
+		if r.DeduplicationId != "" {
+			records, err := loadRecords(dir)
+			if err != nil {
+				return err
+			}
+			if duplicate := findDuplicate(records, r); duplicate != nil {
+				id = duplicate.Id
+				return nil
+			}
+		}
+		return saveRecord(dir, r)
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (b *diskBackend) Receive(queueUrl string, maxMessages int, waitTimeSeconds int64) ([]*Message, error) {
+	return poll(waitTimeSeconds, func() ([]*Message, error) {
+		var messages []*Message
+		err := b.withQueue(queueUrl, func(dir string) error {
+			records, err := loadRecords(dir)
+			if err != nil {
+				return err
+			}
+			var received []*record
+			received, messages = receiveRecords(records, maxMessages, time.Now(), b.visibilityTimeout)
+			for _, r := range received {
+				if err := saveRecord(dir, r); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return messages, nil
+	})
+}
+
+func (b *diskBackend) DeleteBatch(queueUrl string, receiptHandles []string) ([]error, error) {
+	failures := make([]error, len(receiptHandles))
+	err := b.withQueue(queueUrl, func(dir string) error {
+		records, err := loadRecords(dir)
+		if err != nil {
+			return err
+		}
+		for i, receiptHandle := range receiptHandles {
+			index, err := findRecord(records, receiptHandle)
+			if err == nil {
+				err = os.Remove(recordPath(dir, records[index].Id))
+			}
+			failures[i] = err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+func (b *diskBackend) ChangeVisibilityBatch(queueUrl string, changes []VisibilityChange) ([]error, error) {
+	failures := make([]error, len(changes))
+	err := b.withQueue(queueUrl, func(dir string) error {
+		records, err := loadRecords(dir)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for i, change := range changes {
+			if err := validateVisibilityTimeout(change.VisibilityTimeout); err != nil {
+				failures[i] = err
+				continue
+			}
+			index, err := findRecord(records, change.ReceiptHandle)
+			if err != nil {
+				failures[i] = err
+				continue
+			}
+			records[index].VisibleAt = now.Add(time.Duration(change.VisibilityTimeout) * time.Second)
+			failures[i] = saveRecord(dir, records[index])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+func (b *diskBackend) VisibilityTimeout(queueUrl string) (int64, error) {
+	return int64(b.visibilityTimeout / time.Second), nil
+}
+
+func (b *diskBackend) Depth(queueUrl string) (int64, error) {
+	var depth int64
+	err := b.withQueue(queueUrl, func(dir string) error {
+		records, err := loadRecords(dir)
+		depth = countVisible(records, time.Now())
+		return err
+	})
+	return depth, err
+}
+
+// withQueue runs fn on the directory of a queue, holding the queue's lock.
+func (b *diskBackend) withQueue(queueUrl string, fn func(dir string) error) error {
+	// queue urls contain slashes, which cannot be part of a directory name
+	dir := filepath.Join(b.directory, url.PathEscape(queueUrl))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	unlock, err := LockFile(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn(dir)
+}
+
+func recordPath(dir, id string) string {
+	return filepath.Join(dir, id+recordFileExtension)
+}
+
+// loadRecords reads all messages of a queue, oldest first.
+func loadRecords(dir string) ([]*record, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*record, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		// temporary files start with a dot
+		if info.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, recordFileExtension) {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var r record
+		if err := json.Unmarshal(contents, &r); err != nil {
+			return nil, err
+		}
+		records = append(records, &r)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].SentAt.Equal(records[j].SentAt) {
+			return records[i].Id < records[j].Id
+		}
+		return records[i].SentAt.Before(records[j].SentAt)
+	})
+	return records, nil
+}
+
+// saveRecord writes a message to a temporary file first, so that a crash never leaves a
+// partially written message behind.
+func saveRecord(dir string, r *record) error {
+	contents, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(dir, "."+r.Id+".tmp")
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, recordPath(dir, r.Id))
+}
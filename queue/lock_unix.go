@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package queue
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockFile takes an exclusive lock on a file, shared with other processes, and returns
+// the function that releases it.
+func LockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,37 @@
+package queue
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// the syscall package has no file locking on windows, so LockFileEx is called from
+// kernel32 directly
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const lockfileExclusiveLock = 0x2
+
+// LockFile takes an exclusive lock on a file, shared with other processes, and returns
+// the function that releases it.
+func LockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// lock the first byte, which is enough as long as everybody locks the same one
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+		f.Close()
+	}, nil
+}
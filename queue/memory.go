@@ -0,0 +1,118 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// pollInterval is how often the memory and disk backends look for new messages while
+// long-polling.
+const pollInterval = 100 * time.Millisecond
+
+// memoryBackend keeps its queues in memory. Messages are lost when the process exits and
+// cannot be shared between processes, so it is only meant for tests and for trying
+// gomail out.
+type memoryBackend struct {
+	visibilityTimeout time.Duration
+
+	mu     sync.Mutex
+	queues map[string][]*record
+}
+
+func NewMemory(visibilityTimeoutSeconds int64) Backend {
+	return &memoryBackend{
+		visibilityTimeout: time.Duration(visibilityTimeoutSeconds) * time.Second,
+		queues:            make(map[string][]*record),
+	}
+}
+
+func (b *memoryBackend) Send(queueUrl string, input SendInput) (string, error) {
+	if err := validateSendInput(queueUrl, input); err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := newRecord(queueUrl, input, time.Now())
+	if duplicate := findDuplicate(b.queues[queueUrl], r); duplicate != nil {
+		return duplicate.Id, nil
+	}
+	b.queues[queueUrl] = append(b.queues[queueUrl], r)
+	return r.Id, nil
+}
+
+func (b *memoryBackend) Receive(queueUrl string, maxMessages int, waitTimeSeconds int64) ([]*Message, error) {
+	return poll(waitTimeSeconds, func() ([]*Message, error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		_, messages := receiveRecords(b.queues[queueUrl], maxMessages, time.Now(), b.visibilityTimeout)
+		return messages, nil
+	})
+}
+
+func (b *memoryBackend) DeleteBatch(queueUrl string, receiptHandles []string) ([]error, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failures := make([]error, len(receiptHandles))
+	for i, receiptHandle := range receiptHandles {
+		records := b.queues[queueUrl]
+		index, err := findRecord(records, receiptHandle)
+		if err != nil {
+			failures[i] = err
+			continue
+		}
+		b.queues[queueUrl] = append(records[:index], records[index+1:]...)
+	}
+	return failures, nil
+}
+
+func (b *memoryBackend) ChangeVisibilityBatch(queueUrl string, changes []VisibilityChange) ([]error, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	failures := make([]error, len(changes))
+	for i, change := range changes {
+		if err := validateVisibilityTimeout(change.VisibilityTimeout); err != nil {
+			failures[i] = err
+			continue
+		}
+		records := b.queues[queueUrl]
+		index, err := findRecord(records, change.ReceiptHandle)
+		if err != nil {
+			failures[i] = err
+			continue
+		}
+		records[index].VisibleAt = now.Add(time.Duration(change.VisibilityTimeout) * time.Second)
+	}
+	return failures, nil
+}
+
+func (b *memoryBackend) VisibilityTimeout(queueUrl string) (int64, error) {
+	return int64(b.visibilityTimeout / time.Second), nil
+}
+
+func (b *memoryBackend) Depth(queueUrl string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return countVisible(b.queues[queueUrl], time.Now()), nil
+}
+
+// poll calls receive until it returns messages or waitTimeSeconds have passed.
+func poll(waitTimeSeconds int64, receive func() ([]*Message, error)) ([]*Message, error) {
+	deadline := time.Now().Add(time.Duration(waitTimeSeconds) * time.Second)
+	for {
+		messages, err := receive()
+		if err != nil || len(messages) > 0 {
+			return messages, err
+		}
+
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return messages, nil
+		}
+		if remaining > pollInterval {
+			remaining = pollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
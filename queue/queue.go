@@ -0,0 +1,178 @@
+// Package queue abstracts the message queues the API publishes emails to and the
+// pipeline consumes them from. Amazon SQS is used in production; the in-memory and
+// on-disk backends make it possible to run gomail without AWS.
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	BackendSQS    = "sqs"
+	BackendMemory = "memory"
+	BackendDisk   = "disk"
+
+	// MaxBatchSize is the largest number of entries a batch request can hold.
+	MaxBatchSize = 10
+	// MaxVisibilityTimeoutSeconds is the longest a message can stay invisible (12 hours).
+	MaxVisibilityTimeoutSeconds = 43200
+	// MaxDelaySeconds is the longest the delivery of a message can be delayed (15 minutes).
+	MaxDelaySeconds = 900
+
+	defaultVisibilityTimeoutSeconds = 30
+
+	// fifoSuffix ends the url of every FIFO queue.
+	fifoSuffix = ".fifo"
+	// deduplicationInterval is how long a FIFO queue drops messages sent again with the same
+	// deduplication id.
+	deduplicationInterval = 5 * time.Minute
+)
+
+// IsFIFO reports whether a queue is a FIFO queue, which delivers the messages of a
+// message group in the order they were sent, one batch at a time.
+func IsFIFO(queueUrl string) bool {
+	return strings.HasSuffix(queueUrl, fifoSuffix)
+}
+
+// Message is a message received from a queue.
+type Message struct {
+	Id string
+	// identifies this particular receipt of the message, to delete it or change its visibility
+	ReceiptHandle string
+	Body          string
+	Attributes    map[string]Attribute
+	// number of times the message has been received, this time included
+	ReceiveCount int
+	// message group of a message received from a FIFO queue
+	GroupId string
+}
+
+// SendInput is a message to be sent to a queue.
+type SendInput struct {
+	Body       string
+	Attributes map[string]Attribute
+	// required by FIFO queues: messages of the same group are delivered in order
+	GroupId string
+	// FIFO queues drop messages sent with the same deduplication id within 5 minutes
+	DeduplicationId string
+	// the message is only delivered after this many seconds, not supported by FIFO queues
+	DelaySeconds int64
+}
+
+// Attribute is a typed message attribute, as known from SQS.
+type Attribute struct {
+	// String or Number
+	DataType    string `json:"dataType"`
+	StringValue string `json:"stringValue"`
+}
+
+func StringAttribute(value string) Attribute {
+	return Attribute{DataType: "String", StringValue: value}
+}
+
+func NumberAttribute(value int) Attribute {
+	return Attribute{DataType: "Number", StringValue: strconv.Itoa(value)}
+}
+
+// VisibilityChange is an entry of a ChangeVisibilityBatch request.
+type VisibilityChange struct {
+	ReceiptHandle string
+	// seconds from now until the message becomes visible again
+	VisibilityTimeout int64
+}
+
+// EntryError is the failure of a single entry of a batch request.
+type EntryError struct {
+	Code    string
+	Message string
+	// the entry would fail the same way if retried (e.g. its receipt handle expired)
+	SenderFault bool
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// IsSenderFault reports whether err is the failure of a batch entry that is not worth
+// retrying.
+func IsSenderFault(err error) bool {
+	entryErr, ok := err.(*EntryError)
+	return ok && entryErr.SenderFault
+}
+
+// Backend is a set of queues, identified by url. The memory and disk backends accept any
+// string as the url of a queue, and create queues as they are used. Queues whose url ends
+// with .fifo are FIFO queues: while a message of a group is in flight, no further
+// messages of that group are received.
+type Backend interface {
+	// Send publishes a message, and returns its id. A message sent to a FIFO queue again
+	// with the same deduplication id is dropped, and the id of the first one returned.
+	Send(queueUrl string, input SendInput) (string, error)
+	// Receive waits up to waitTimeSeconds for messages to arrive, and returns up to
+	// maxMessages of them. Received messages stay invisible for the visibility timeout of
+	// the queue.
+	Receive(queueUrl string, maxMessages int, waitTimeSeconds int64) ([]*Message, error)
+	// DeleteBatch deletes up to MaxBatchSize received messages. It returns the failure
+	// of every entry (nil if it succeeded), or an error if the request failed as a whole.
+	DeleteBatch(queueUrl string, receiptHandles []string) ([]error, error)
+	// ChangeVisibilityBatch changes the visibility timeout of up to MaxBatchSize received
+	// messages. It returns the failure of every entry like DeleteBatch.
+	ChangeVisibilityBatch(queueUrl string, changes []VisibilityChange) ([]error, error)
+	// VisibilityTimeout returns the default visibility timeout of a queue, in seconds.
+	VisibilityTimeout(queueUrl string) (int64, error)
+	// Depth returns the (approximate) number of messages waiting to be received.
+	Depth(queueUrl string) (int64, error)
+}
+
+// Config selects and configures the queue backend.
+type Config struct {
+	// sqs, memory or disk
+	Type string `yaml:"type"`
+	// where the disk backend keeps its queues
+	Directory string `yaml:"directory"`
+	// visibility timeout of the queues of the memory and disk backends
+	VisibilityTimeoutSeconds int64 `yaml:"visibility_timeout_seconds"`
+}
+
+func (c *Config) SetDefaults() {
+	if c.Type == "" {
+		c.Type = BackendSQS
+	}
+	if c.VisibilityTimeoutSeconds == 0 {
+		c.VisibilityTimeoutSeconds = defaultVisibilityTimeoutSeconds
+	}
+}
+
+func (c Config) Validate() error {
+	switch c.Type {
+	case BackendSQS, BackendMemory:
+	case BackendDisk:
+		if c.Directory == "" {
+			return fmt.Errorf("queue_backend.directory is missing")
+		}
+	default:
+		return fmt.Errorf("queue_backend.type must be one of sqs, memory or disk")
+	}
+	if c.VisibilityTimeoutSeconds < 0 || c.VisibilityTimeoutSeconds > MaxVisibilityTimeoutSeconds {
+		return fmt.Errorf("queue_backend.visibility_timeout_seconds must be between 1 and %d", MaxVisibilityTimeoutSeconds)
+	}
+	return nil
+}
+
+// New returns the backend selected by config. sqsClient is only used by the sqs backend.
+func New(config Config, sqsClient sqsiface.SQSAPI) (Backend, error) {
+	switch config.Type {
+	case BackendMemory:
+		return NewMemory(config.VisibilityTimeoutSeconds), nil
+	case BackendDisk:
+		return NewDisk(config.Directory, config.VisibilityTimeoutSeconds)
+	case BackendSQS:
+		return NewSQS(sqsClient), nil
+	}
+	return nil, fmt.Errorf("unknown queue backend %s", config.Type)
+}
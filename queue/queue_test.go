@@ -0,0 +1,257 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+const testQueueUrl = "https://sqs.us-east-1.amazonaws.com/111111111111/gomail-mails"
+
+type QueueSuite struct {
+	suite.Suite
+	dir string
+}
+
+func TestQueueSuite(t *testing.T) {
+	suite.Run(t, new(QueueSuite))
+}
+
+func (s *QueueSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "gomail-queue")
+	s.Require().NoError(err)
+	s.dir = dir
+}
+
+func (s *QueueSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+// backends returns an empty instance of every local backend.
+func (s *QueueSuite) backends(visibilityTimeoutSeconds int64) map[string]Backend {
+	dir, err := ioutil.TempDir(s.dir, "disk")
+	s.Require().NoError(err)
+	disk, err := NewDisk(dir, visibilityTimeoutSeconds)
+	s.Require().NoError(err)
+	return map[string]Backend{
+		BackendMemory: NewMemory(visibilityTimeoutSeconds),
+		BackendDisk:   disk,
+	}
+}
+
+func (s *QueueSuite) TestSendReceive() {
+	for name, backend := range s.backends(30) {
+		attributes := map[string]Attribute{"gomail-attempts": NumberAttribute(2)}
+		id, err := backend.Send(testQueueUrl, SendInput{Body: "first", Attributes: attributes})
+		assert.NoError(s.T(), err, name)
+		_, err = backend.Send(testQueueUrl, SendInput{Body: "second"})
+		assert.NoError(s.T(), err, name)
+
+		depth, err := backend.Depth(testQueueUrl)
+		assert.NoError(s.T(), err, name)
+		assert.Equal(s.T(), int64(2), depth, name)
+
+		messages, err := backend.Receive(testQueueUrl, 1, 0)
+		assert.NoError(s.T(), err, name)
+		if assert.Len(s.T(), messages, 1, name) {
+			assert.Equal(s.T(), id, messages[0].Id, name)
+			assert.Equal(s.T(), "first", messages[0].Body, name)
+			assert.Equal(s.T(), attributes, messages[0].Attributes, name)
+			assert.Equal(s.T(), 1, messages[0].ReceiveCount, name)
+			assert.NotEmpty(s.T(), messages[0].ReceiptHandle, name)
+		}
+
+		// the received message stays invisible
+		depth, _ = backend.Depth(testQueueUrl)
+		assert.Equal(s.T(), int64(1), depth, name)
+		messages, _ = backend.Receive(testQueueUrl, 10, 0)
+		if assert.Len(s.T(), messages, 1, name) {
+			assert.Equal(s.T(), "second", messages[0].Body, name)
+		}
+
+		// other queues are not affected
+		messages, _ = backend.Receive(testQueueUrl+"-dlq", 10, 0)
+		assert.Empty(s.T(), messages, name)
+	}
+}
+
+func (s *QueueSuite) TestDelete() {
+	for name, backend := range s.backends(30) {
+		backend.Send(testQueueUrl, SendInput{Body: "body"})
+		messages, _ := backend.Receive(testQueueUrl, 10, 0)
+		s.Require().Len(messages, 1, name)
+
+		failures, err := backend.DeleteBatch(testQueueUrl, []string{messages[0].ReceiptHandle, "invalid"})
+		assert.NoError(s.T(), err, name)
+		assert.NoError(s.T(), failures[0], name)
+		assert.True(s.T(), IsSenderFault(failures[1]), name)
+
+		// deleting twice fails
+		failures, _ = backend.DeleteBatch(testQueueUrl, []string{messages[0].ReceiptHandle})
+		assert.True(s.T(), IsSenderFault(failures[0]), name)
+	}
+}
+
+func (s *QueueSuite) TestChangeVisibility() {
+	for name, backend := range s.backends(30) {
+		backend.Send(testQueueUrl, SendInput{Body: "body"})
+		messages, _ := backend.Receive(testQueueUrl, 10, 0)
+		s.Require().Len(messages, 1, name)
+		first := messages[0]
+
+		failures, err := backend.ChangeVisibilityBatch(testQueueUrl, []VisibilityChange{
+			{ReceiptHandle: first.ReceiptHandle, VisibilityTimeout: 0},
+			{ReceiptHandle: first.ReceiptHandle, VisibilityTimeout: MaxVisibilityTimeoutSeconds + 1},
+		})
+		assert.NoError(s.T(), err, name)
+		assert.NoError(s.T(), failures[0], name)
+		assert.True(s.T(), IsSenderFault(failures[1]), name)
+
+		// the message is visible right away, and comes back with a new receipt handle
+		messages, _ = backend.Receive(testQueueUrl, 10, 0)
+		if assert.Len(s.T(), messages, 1, name) {
+			assert.Equal(s.T(), first.Id, messages[0].Id, name)
+			assert.Equal(s.T(), 2, messages[0].ReceiveCount, name)
+			assert.NotEqual(s.T(), first.ReceiptHandle, messages[0].ReceiptHandle, name)
+		}
+
+		// the receipt handle of the first receipt expired
+		failures, _ = backend.DeleteBatch(testQueueUrl, []string{first.ReceiptHandle})
+		assert.True(s.T(), IsSenderFault(failures[0]), name)
+	}
+}
+
+func (s *QueueSuite) TestVisibilityTimeout() {
+	for name, backend := range s.backends(1) {
+		timeout, err := backend.VisibilityTimeout(testQueueUrl)
+		assert.NoError(s.T(), err, name)
+		assert.Equal(s.T(), int64(1), timeout, name)
+
+		backend.Send(testQueueUrl, SendInput{Body: "body"})
+		messages, _ := backend.Receive(testQueueUrl, 10, 0)
+		s.Require().Len(messages, 1, name)
+
+		// long-polling picks the message up again once its visibility timeout expired
+		messages, err = backend.Receive(testQueueUrl, 10, 2)
+		assert.NoError(s.T(), err, name)
+		if assert.Len(s.T(), messages, 1, name) {
+			assert.Equal(s.T(), 2, messages[0].ReceiveCount, name)
+		}
+	}
+}
+
+func (s *QueueSuite) TestDelay() {
+	for name, backend := range s.backends(30) {
+		_, err := backend.Send(testQueueUrl, SendInput{Body: "too late", DelaySeconds: MaxDelaySeconds + 1})
+		assert.Error(s.T(), err, name)
+		_, err = backend.Send(testQueueUrl+".fifo", SendInput{Body: "delayed", GroupId: "a", DelaySeconds: 1})
+		assert.Error(s.T(), err, name)
+
+		_, err = backend.Send(testQueueUrl, SendInput{Body: "delayed", DelaySeconds: 1})
+		assert.NoError(s.T(), err, name)
+
+		// delayed messages are not delivered before their delay passed
+		messages, _ := backend.Receive(testQueueUrl, 10, 0)
+		assert.Empty(s.T(), messages, name)
+		messages, _ = backend.Receive(testQueueUrl, 10, 2)
+		if assert.Len(s.T(), messages, 1, name) {
+			assert.Equal(s.T(), "delayed", messages[0].Body, name)
+		}
+	}
+}
+
+func (s *QueueSuite) TestFIFO() {
+	const fifoQueueUrl = "gomail-mails.fifo"
+	for name, backend := range s.backends(30) {
+		_, err := backend.Send(fifoQueueUrl, SendInput{Body: "no group"})
+		assert.Error(s.T(), err, name)
+
+		first, _ := backend.Send(fifoQueueUrl, SendInput{Body: "a1", GroupId: "a", DeduplicationId: "1"})
+		duplicate, err := backend.Send(fifoQueueUrl, SendInput{Body: "a1 again", GroupId: "a", DeduplicationId: "1"})
+		assert.NoError(s.T(), err, name)
+		assert.Equal(s.T(), first, duplicate, name)
+		backend.Send(fifoQueueUrl, SendInput{Body: "b1", GroupId: "b", DeduplicationId: "2"})
+		backend.Send(fifoQueueUrl, SendInput{Body: "a2", GroupId: "a", DeduplicationId: "3"})
+
+		messages, _ := backend.Receive(fifoQueueUrl, 2, 0)
+		if assert.Len(s.T(), messages, 2, name) {
+			assert.Equal(s.T(), "a1", messages[0].Body, name)
+			assert.Equal(s.T(), "a", messages[0].GroupId, name)
+			assert.Equal(s.T(), "b1", messages[1].Body, name)
+		}
+
+		// a2 is held back while a1 is in flight
+		more, _ := backend.Receive(fifoQueueUrl, 10, 0)
+		assert.Empty(s.T(), more, name)
+
+		backend.DeleteBatch(fifoQueueUrl, []string{messages[0].ReceiptHandle})
+		more, _ = backend.Receive(fifoQueueUrl, 10, 0)
+		if assert.Len(s.T(), more, 1, name) {
+			assert.Equal(s.T(), "a2", more[0].Body, name)
+		}
+	}
+}
+
+func (s *QueueSuite) TestDiskPersistence() {
+	backend, err := NewDisk(s.dir, 30)
+	s.Require().NoError(err)
+	backend.Send(testQueueUrl, SendInput{Body: "first"})
+	backend.Send(testQueueUrl, SendInput{Body: "second"})
+	messages, _ := backend.Receive(testQueueUrl, 1, 0)
+	s.Require().Len(messages, 1)
+
+	// another process sees the same queue, including the received message being invisible
+	other, err := NewDisk(s.dir, 30)
+	s.Require().NoError(err)
+	depth, err := other.Depth(testQueueUrl)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), depth)
+
+	failures, err := other.DeleteBatch(testQueueUrl, []string{messages[0].ReceiptHandle})
+	assert.NoError(s.T(), err)
+	assert.NoError(s.T(), failures[0])
+	messages, _ = other.Receive(testQueueUrl, 10, 0)
+	if assert.Len(s.T(), messages, 1) {
+		assert.Equal(s.T(), "second", messages[0].Body)
+	}
+}
+
+func (s *QueueSuite) TestConfig() {
+	testCases := []struct {
+		Case          string
+		Config        Config
+		ExpectedError string
+	}{
+		{
+			Case:   "Defaults",
+			Config: Config{},
+		},
+		{
+			Case:   "Disk",
+			Config: Config{Type: BackendDisk, Directory: "/var/lib/gomail"},
+		},
+		{
+			Case:          "Disk without directory",
+			Config:        Config{Type: BackendDisk},
+			ExpectedError: "queue_backend.directory is missing",
+		},
+		{
+			Case:          "Unknown type",
+			Config:        Config{Type: "redis"},
+			ExpectedError: "queue_backend.type must be one of sqs, memory or disk",
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase.Config.SetDefaults()
+		err := testCase.Config.Validate()
+		if testCase.ExpectedError == "" {
+			assert.NoError(s.T(), err, testCase.Case)
+		} else {
+			assert.EqualError(s.T(), err, testCase.ExpectedError, testCase.Case)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// record is a message stored by the memory and disk backends.
+type record struct {
+	Id              string               `json:"id"`
+	Body            string               `json:"body"`
+	Attributes      map[string]Attribute `json:"attributes,omitempty"`
+	SentAt          time.Time            `json:"sentAt"`
+	VisibleAt       time.Time            `json:"visibleAt"`
+	ReceiveCount    int                  `json:"receiveCount"`
+	ReceiptHandle   string               `json:"receiptHandle,omitempty"`
+	GroupId         string               `json:"groupId,omitempty"`
+	DeduplicationId string               `json:"deduplicationId,omitempty"`
+}
+
+// newRecord creates the record of a message sent to a queue. Group and deduplication ids
+// are only kept for FIFO queues.
+func newRecord(queueUrl string, input SendInput, now time.Time) *record {
+	r := &record{
+		Id:         randomId(),
+		Body:       input.Body,
+		Attributes: copyAttributes(input.Attributes),
+		SentAt:     now,
+		VisibleAt:  now.Add(time.Duration(input.DelaySeconds) * time.Second),
+	}
+	if IsFIFO(queueUrl) {
+		r.GroupId = input.GroupId
+		r.DeduplicationId = input.DeduplicationId
+	}
+	return r
+}
+
+// validateSendInput rejects a message a queue would not accept.
+func validateSendInput(queueUrl string, input SendInput) error {
+	if IsFIFO(queueUrl) && input.GroupId == "" {
+		return fmt.Errorf("MissingParameter: messages sent to FIFO queue (%s) need a group id", queueUrl)
+	}
+	if IsFIFO(queueUrl) && input.DelaySeconds != 0 {
+		return fmt.Errorf("InvalidParameterValue: messages sent to FIFO queue (%s) cannot be delayed", queueUrl)
+	}
+	if input.DelaySeconds < 0 || input.DelaySeconds > MaxDelaySeconds {
+		return fmt.Errorf("InvalidParameterValue: delay %d is out of range", input.DelaySeconds)
+	}
+	return nil
+}
+
+// findDuplicate returns the record sent with the same deduplication id as r during the
+// last 5 minutes, if any. Only records still in the queue are taken into account.
+func findDuplicate(records []*record, r *record) *record {
+	if r.DeduplicationId == "" {
+		return nil
+	}
+	for _, other := range records {
+		if other.DeduplicationId == r.DeduplicationId && r.SentAt.Sub(other.SentAt) < deduplicationInterval {
+			return other
+		}
+	}
+	return nil
+}
+
+// receive hands the record out, hiding it for visibilityTimeout. Receipt handles of
+// earlier receipts stop working.
+func (r *record) receive(now time.Time, visibilityTimeout time.Duration) *Message {
+	r.ReceiveCount++
+	r.VisibleAt = now.Add(visibilityTimeout)
+	r.ReceiptHandle = r.Id + "." + randomId()
+	return &Message{
+		Id:            r.Id,
+		ReceiptHandle: r.ReceiptHandle,
+		Body:          r.Body,
+		Attributes:    copyAttributes(r.Attributes),
+		ReceiveCount:  r.ReceiveCount,
+		GroupId:       r.GroupId,
+	}
+}
+
+func (r *record) visible(now time.Time) bool {
+	return !r.VisibleAt.After(now)
+}
+
+// receiveRecords hands out up to max visible records, oldest first. Records of a message
+// group that already has a record in flight are held back, so that groups are received
+// in order.
+func receiveRecords(records []*record, max int, now time.Time, visibilityTimeout time.Duration) ([]*record, []*Message) {
+	inFlightGroups := make(map[string]bool)
+	for _, r := range records {
+		if r.GroupId != "" && !r.visible(now) {
+			inFlightGroups[r.GroupId] = true
+		}
+	}
+
+	received := make([]*record, 0, max)
+	messages := make([]*Message, 0, max)
+	for _, r := range records {
+		if len(messages) == max {
+			break
+		}
+		if r.visible(now) && !inFlightGroups[r.GroupId] {
+			received = append(received, r)
+			messages = append(messages, r.receive(now, visibilityTimeout))
+		}
+	}
+	return received, messages
+}
+
+// findRecord returns the index of the record a receipt handle belongs to.
+func findRecord(records []*record, receiptHandle string) (int, error) {
+	id := receiptHandle
+	if i := strings.Index(receiptHandle, "."); i >= 0 {
+		id = receiptHandle[:i]
+	}
+	for i, r := range records {
+		if r.Id == id && r.ReceiptHandle == receiptHandle {
+			return i, nil
+		}
+	}
+	return -1, &EntryError{
+		Code:        "ReceiptHandleIsInvalid",
+		Message:     fmt.Sprintf("receipt handle %s is invalid or expired", receiptHandle),
+		SenderFault: true,
+	}
+}
+
+func validateVisibilityTimeout(visibilityTimeout int64) error {
+	if visibilityTimeout < 0 || visibilityTimeout > MaxVisibilityTimeoutSeconds {
+		return &EntryError{
+			Code:        "InvalidParameterValue",
+			Message:     fmt.Sprintf("visibility timeout %d is out of range", visibilityTimeout),
+			SenderFault: true,
+		}
+	}
+	return nil
+}
+
+func countVisible(records []*record, now time.Time) int64 {
+	var depth int64
+	for _, r := range records {
+		if r.visible(now) {
+			depth++
+		}
+	}
+	return depth
+}
+
+func copyAttributes(attributes map[string]Attribute) map[string]Attribute {
+	if len(attributes) == 0 {
+		return nil
+	}
+	copied := make(map[string]Attribute, len(attributes))
+	for name, value := range attributes {
+		copied[name] = value
+	}
+	return copied
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// This should never happen
+		panic("Could not generate random id: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,231 @@
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	approximateReceiveCount     = "ApproximateReceiveCount"
+	approximateNumberOfMessages = "ApproximateNumberOfMessages"
+	allMessageAttributes        = "All"
+	messageGroupId              = "MessageGroupId"
+	messageDeduplicationId      = "MessageDeduplicationId"
+)
+
+type sqsBackend struct {
+	client sqsiface.SQSAPI
+}
+
+func NewSQS(client sqsiface.SQSAPI) Backend {
+	return &sqsBackend{client: client}
+}
+
+func (b *sqsBackend) Send(queueUrl string, input SendInput) (string, error) {
+	sendInput := &sqs.SendMessageInput{
+		QueueUrl:    &queueUrl,
+		MessageBody: aws.String(input.Body),
+	}
+	if input.DelaySeconds > 0 {
+		sendInput.DelaySeconds = aws.Int64(input.DelaySeconds)
+	}
+	if len(input.Attributes) > 0 {
+		sendInput.MessageAttributes = make(map[string]*sqs.MessageAttributeValue, len(input.Attributes))
+		for name, attribute := range input.Attributes {
+			sendInput.MessageAttributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String(attribute.DataType),
+				StringValue: aws.String(attribute.StringValue),
+			}
+		}
+	}
+
+	if input.GroupId == "" && input.DeduplicationId == "" {
+		resp, err := b.client.SendMessage(sendInput)
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(resp.MessageId), nil
+	}
+
+	// our version of the SDK predates FIFO queues, so their parameters are added to the
+	// request once it has been built
+	params := url.Values{}
+	if input.GroupId != "" {
+		params.Set(messageGroupId, input.GroupId)
+	}
+	if input.DeduplicationId != "" {
+		params.Set(messageDeduplicationId, input.DeduplicationId)
+	}
+	req, resp := b.client.SendMessageRequest(sendInput)
+	req.Handlers.Build.PushBack(addQueryParams(params))
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.MessageId), nil
+}
+
+// addQueryParams returns a build handler that adds params to the form encoded body of a
+// query protocol request.
+func addQueryParams(params url.Values) func(*request.Request) {
+	return func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed reading Query request", err)
+			return
+		}
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed decoding Query request", err)
+			return
+		}
+		for name := range params {
+			values.Set(name, params.Get(name))
+		}
+		r.SetBufferBody([]byte(values.Encode()))
+	}
+}
+
+func (b *sqsBackend) Receive(queueUrl string, maxMessages int, waitTimeSeconds int64) ([]*Message, error) {
+	resp, err := b.client.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:              &queueUrl,
+		MaxNumberOfMessages:   aws.Int64(int64(maxMessages)),
+		WaitTimeSeconds:       aws.Int64(waitTimeSeconds),
+		AttributeNames:        []*string{aws.String(approximateReceiveCount), aws.String(messageGroupId)},
+		MessageAttributeNames: []*string{aws.String(allMessageAttributes)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*Message, len(resp.Messages))
+	for i, message := range resp.Messages {
+		messages[i] = fromSQSMessage(message)
+	}
+	return messages, nil
+}
+
+func fromSQSMessage(message *sqs.Message) *Message {
+	m := &Message{
+		Id:            aws.StringValue(message.MessageId),
+		ReceiptHandle: aws.StringValue(message.ReceiptHandle),
+		Body:          aws.StringValue(message.Body),
+		ReceiveCount:  receiveCount(message),
+		GroupId:       aws.StringValue(message.Attributes[messageGroupId]),
+	}
+	if len(message.MessageAttributes) > 0 {
+		m.Attributes = make(map[string]Attribute, len(message.MessageAttributes))
+		for name, value := range message.MessageAttributes {
+			m.Attributes[name] = Attribute{
+				DataType:    aws.StringValue(value.DataType),
+				StringValue: aws.StringValue(value.StringValue),
+			}
+		}
+	}
+	return m
+}
+
+// receiveCount returns the number of times SQS has handed out the message, which is
+// also the number of the current delivery attempt.
+func receiveCount(message *sqs.Message) int {
+	countStr, ok := message.Attributes[approximateReceiveCount]
+	if !ok || countStr == nil {
+		return 1
+	}
+	count, err := strconv.Atoi(*countStr)
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
+
+func (b *sqsBackend) DeleteBatch(queueUrl string, receiptHandles []string) ([]error, error) {
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(receiptHandles))
+	for i, receiptHandle := range receiptHandles {
+		entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: aws.String(receiptHandle),
+		}
+	}
+
+	resp, err := b.client.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: &queueUrl,
+		Entries:  entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batchFailures(len(entries), resp.Failed), nil
+}
+
+func (b *sqsBackend) ChangeVisibilityBatch(queueUrl string, changes []VisibilityChange) ([]error, error) {
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(changes))
+	for i, change := range changes {
+		entries[i] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			ReceiptHandle:     aws.String(change.ReceiptHandle),
+			VisibilityTimeout: aws.Int64(change.VisibilityTimeout),
+		}
+	}
+
+	resp, err := b.client.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: &queueUrl,
+		Entries:  entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batchFailures(len(entries), resp.Failed), nil
+}
+
+// batchFailures lines up the failed entries of a batch response with the entries of the
+// request, whose ids are their indexes.
+func batchFailures(entries int, failed []*sqs.BatchResultErrorEntry) []error {
+	failures := make([]error, entries)
+	for _, failure := range failed {
+		i, err := strconv.Atoi(aws.StringValue(failure.Id))
+		if err != nil || i < 0 || i >= entries {
+			continue
+		}
+		failures[i] = &EntryError{
+			Code:        aws.StringValue(failure.Code),
+			Message:     aws.StringValue(failure.Message),
+			SenderFault: aws.BoolValue(failure.SenderFault),
+		}
+	}
+	return failures
+}
+
+func (b *sqsBackend) VisibilityTimeout(queueUrl string) (int64, error) {
+	return b.intAttribute(queueUrl, sqs.QueueAttributeNameVisibilityTimeout)
+}
+
+func (b *sqsBackend) Depth(queueUrl string) (int64, error) {
+	return b.intAttribute(queueUrl, approximateNumberOfMessages)
+}
+
+func (b *sqsBackend) intAttribute(queueUrl string, name string) (int64, error) {
+	resp, err := b.client.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		AttributeNames: []*string{aws.String(name)},
+		QueueUrl:       &queueUrl,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := resp.Attributes[name]
+	if !ok || value == nil {
+		return 0, fmt.Errorf("queue (%s) did not return its %s", queueUrl, name)
+	}
+	return strconv.ParseInt(*value, 10, 64)
+}
@@ -0,0 +1,158 @@
+package queue
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gomail/awsmock/mocks"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SQSSuite struct {
+	suite.Suite
+}
+
+func TestSQSSuite(t *testing.T) {
+	suite.Run(t, new(SQSSuite))
+}
+
+func (s *SQSSuite) TestReceiveCount() {
+	testCases := []struct {
+		Case          string
+		Attributes    map[string]*string
+		ExpectedCount int
+	}{
+		{
+			Case:          "Attribute missing",
+			Attributes:    nil,
+			ExpectedCount: 1,
+		},
+		{
+			Case:          "Valid attribute",
+			Attributes:    map[string]*string{approximateReceiveCount: aws.String("4")},
+			ExpectedCount: 4,
+		},
+		{
+			Case:          "Invalid attribute",
+			Attributes:    map[string]*string{approximateReceiveCount: aws.String("four")},
+			ExpectedCount: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		count := receiveCount(&sqs.Message{Attributes: testCase.Attributes})
+		assert.Equal(s.T(), testCase.ExpectedCount, count, testCase.Case)
+	}
+}
+
+func (s *SQSSuite) TestReceive() {
+	mockSQS := new(mocks.SQSAPI)
+	mockSQS.On("ReceiveMessage", &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(testQueueUrl),
+		MaxNumberOfMessages:   aws.Int64(5),
+		WaitTimeSeconds:       aws.Int64(20),
+		AttributeNames:        []*string{aws.String(approximateReceiveCount), aws.String(messageGroupId)},
+		MessageAttributeNames: []*string{aws.String(allMessageAttributes)},
+	}).Return(&sqs.ReceiveMessageOutput{Messages: []*sqs.Message{{
+		MessageId:     aws.String("1"),
+		ReceiptHandle: aws.String("receipt"),
+		Body:          aws.String("body"),
+		Attributes: map[string]*string{
+			approximateReceiveCount: aws.String("2"),
+			messageGroupId:          aws.String("to@example.com"),
+		},
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"gomail-attempts": {DataType: aws.String("Number"), StringValue: aws.String("3")},
+		},
+	}}}, nil)
+
+	messages, err := NewSQS(mockSQS).Receive(testQueueUrl, 5, 20)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), []*Message{{
+		Id:            "1",
+		ReceiptHandle: "receipt",
+		Body:          "body",
+		Attributes:    map[string]Attribute{"gomail-attempts": NumberAttribute(3)},
+		ReceiveCount:  2,
+		GroupId:       "to@example.com",
+	}}, messages)
+}
+
+func (s *SQSSuite) TestDeleteBatch() {
+	mockSQS := new(mocks.SQSAPI)
+	mockSQS.On("DeleteMessageBatch", &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(testQueueUrl),
+		Entries: []*sqs.DeleteMessageBatchRequestEntry{
+			{Id: aws.String("0"), ReceiptHandle: aws.String("receipt-0")},
+			{Id: aws.String("1"), ReceiptHandle: aws.String("receipt-1")},
+		},
+	}).Return(&sqs.DeleteMessageBatchOutput{Failed: []*sqs.BatchResultErrorEntry{{
+		Id:          aws.String("1"),
+		Code:        aws.String("ReceiptHandleIsInvalid"),
+		Message:     aws.String("expired"),
+		SenderFault: aws.Bool(true),
+	}}}, nil)
+
+	failures, err := NewSQS(mockSQS).DeleteBatch(testQueueUrl, []string{"receipt-0", "receipt-1"})
+	assert.NoError(s.T(), err)
+	assert.NoError(s.T(), failures[0])
+	assert.EqualError(s.T(), failures[1], "ReceiptHandleIsInvalid: expired")
+	assert.True(s.T(), IsSenderFault(failures[1]))
+}
+
+func (s *SQSSuite) TestDepth() {
+	mockSQS := new(mocks.SQSAPI)
+	mockSQS.On("GetQueueAttributes", &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(testQueueUrl),
+		AttributeNames: []*string{aws.String(approximateNumberOfMessages)},
+	}).Return(&sqs.GetQueueAttributesOutput{
+		Attributes: map[string]*string{approximateNumberOfMessages: aws.String("42")},
+	}, nil)
+
+	depth, err := NewSQS(mockSQS).Depth(testQueueUrl)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(42), depth)
+}
+
+func (s *SQSSuite) TestSendFIFO() {
+	const fifoQueueUrl = "https://sqs.us-east-1.amazonaws.com/111111111111/gomail-mails.fifo"
+	forms := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		forms <- r.PostForm
+		sum := md5.Sum([]byte(r.PostForm.Get("MessageBody")))
+		fmt.Fprintf(w, `<SendMessageResponse><SendMessageResult><MD5OfMessageBody>%s</MD5OfMessageBody>`+
+			`<MessageId>1</MessageId></SendMessageResult></SendMessageResponse>`, hex.EncodeToString(sum[:]))
+	}))
+	defer server.Close()
+
+	client := sqs.New(session.New(aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", ""))))
+	id, err := NewSQS(client).Send(fifoQueueUrl, SendInput{
+		Body:            "body",
+		GroupId:         "to@example.com",
+		DeduplicationId: "dedup",
+	})
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "1", id)
+
+	form := <-forms
+	assert.Equal(s.T(), "SendMessage", form.Get("Action"))
+	assert.Equal(s.T(), fifoQueueUrl, form.Get("QueueUrl"))
+	assert.Equal(s.T(), "body", form.Get("MessageBody"))
+	assert.Equal(s.T(), "to@example.com", form.Get(messageGroupId))
+	assert.Equal(s.T(), "dedup", form.Get(messageDeduplicationId))
+}